@@ -0,0 +1,208 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"knative.dev/async-component/pkg/status"
+)
+
+const (
+	asyncRequestIDHeader = "Async-Request-Id"
+	// asyncSignatureHeader carries the hex encoded HMAC-SHA256 of the
+	// timestamp, request ID and body of the callback, joined by dots and keyed
+	// with the callback secret of the request.
+	asyncSignatureHeader = "Async-Signature"
+	signaturePrefix      = "sha256="
+	// asyncTimestampHeader is the Unix time in seconds the callback was sent
+	// at, so receivers can turn away callbacks that are replayed later.
+	asyncTimestampHeader = "Async-Timestamp"
+)
+
+// errCallbackBlocked is returned for callbacks to addresses they can't reach.
+var errCallbackBlocked = errors.New("callbacks can't reach the address")
+
+// callbackNetworks are the networks callbacks may reach even though they are
+// private, such as the cluster's service network.
+var callbackNetworks []*net.IPNet
+
+// blockedNetworks are the networks callbacks can't reach unless they are
+// allowed, beyond the loopback, private, link-local and multicast ones Go
+// knows about. Callback URLs are given by clients, who could otherwise have
+// the consumer call services of the cluster or the metadata of the cloud.
+var blockedNetworks = parseNetworks("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4")
+
+// parseNetworks parses CIDRs known to be valid.
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// callbackAllowed reports whether callbacks may reach the IP.
+func callbackAllowed(ip net.IP) bool {
+	for _, network := range callbackNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// callbackClient returns a client that only connects to addresses callbacks
+// may reach. The address is checked once it is resolved, including for
+// redirects, so host names can't resolve to a blocked address later on.
+func callbackClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: env.CallbackTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !callbackAllowed(ip) {
+				return fmt.Errorf("%w %s", errCallbackBlocked, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: env.CallbackTimeout,
+		// Proxies aren't used, as the proxy would be checked instead of the
+		// address the callback is for.
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: env.CallbackTimeout,
+		},
+	}
+}
+
+// callbackPayload is posted to the callback URL of a request once it is done.
+type callbackPayload struct {
+	ID     string         `json:"id"`
+	State  status.State   `json:"state"`
+	Reason string         `json:"reason,omitempty"`
+	Result *status.Result `json:"result,omitempty"`
+}
+
+// notify sends the callback of a request in the background, so that neither
+// the request nor the queue wait for it. A callback that is still being sent
+// when the consumer stops is lost.
+func notify(data *requestData, state status.State, reason string, result *status.Result) {
+	go func() {
+		if err := sendCallback(context.Background(), data, state, reason, result); err != nil {
+			log.Println("Error sending callback ", err)
+		}
+	}()
+}
+
+// sendCallback posts the outcome of a request to its callback URL, retrying
+// with exponential backoff on connection errors and retryable responses.
+func sendCallback(ctx context.Context, data *requestData, state status.State, reason string, result *status.Result) error {
+	body, err := json.Marshal(callbackPayload{
+		ID:     data.ID,
+		State:  state,
+		Reason: reason,
+		Result: result,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal callback for %q: %w", data.ID, err)
+	}
+
+	client := callbackClient()
+	defer client.CloseIdleConnections()
+	backoff := env.CallbackBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := postCallback(ctx, client, data, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= env.CallbackMaxAttempts {
+			return fmt.Errorf("callback for %q failed after %d attempts: %w", data.ID, attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// postCallback makes a single callback attempt and reports whether a failed
+// attempt is worth retrying.
+func postCallback(ctx context.Context, client *http.Client, data *requestData, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, data.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(asyncRequestIDHeader, data.ID)
+	if data.CallbackSecret != "" {
+		timestamp := strconv.FormatInt(now().Unix(), 10)
+		req.Header.Set(asyncTimestampHeader, timestamp)
+		req.Header.Set(asyncSignatureHeader, signaturePrefix+sign(data.CallbackSecret, timestamp, data.ID, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return !errors.Is(err, errCallbackBlocked), err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode < http.StatusMultipleChoices:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return true, fmt.Errorf("callback responded with status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("callback responded with status %d", resp.StatusCode)
+	}
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the timestamp, ID and body
+// joined by dots, keyed with secret.
+func sign(secret, timestamp, id string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + id + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
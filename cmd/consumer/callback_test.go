@@ -0,0 +1,160 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/status"
+)
+
+func TestSendCallback(t *testing.T) {
+	tests := []struct {
+		name         string
+		secret       string
+		responses    []int
+		wantAttempts int
+		wantErr      bool
+	}{{
+		name:         "accepted on first attempt",
+		responses:    []int{http.StatusOK},
+		wantAttempts: 1,
+	}, {
+		name:         "signed callback",
+		secret:       "s3cr3t",
+		responses:    []int{http.StatusNoContent},
+		wantAttempts: 1,
+	}, {
+		name:         "retried after server errors",
+		responses:    []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+		wantAttempts: 3,
+	}, {
+		name:         "client errors are not retried",
+		responses:    []int{http.StatusBadRequest},
+		wantAttempts: 1,
+		wantErr:      true,
+	}, {
+		name:         "gives up after max attempts",
+		responses:    []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK},
+		wantAttempts: 3,
+		wantErr:      true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{
+				CallbackMaxAttempts: 3,
+				CallbackBackoff:     time.Millisecond,
+				CallbackTimeout:     time.Second,
+			}
+			callbackNetworks = parseNetworks("127.0.0.0/8", "::1/128")
+			defer func() { callbackNetworks = nil }()
+			attempts := 0
+			callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				payload := callbackPayload{}
+				if err := json.Unmarshal(body, &payload); err != nil {
+					t.Errorf("error unmarshalling callback: %v", err)
+				}
+				if payload.ID != "123" || payload.State != status.Succeeded || payload.Result.StatusCode != http.StatusOK {
+					t.Errorf("unexpected callback payload %+v", payload)
+				}
+				if got := r.Header.Get(asyncRequestIDHeader); got != "123" {
+					t.Errorf("got request id %q, want %q", got, "123")
+				}
+				wantSignature := ""
+				timestamp := r.Header.Get(asyncTimestampHeader)
+				if test.secret != "" {
+					if sent, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+						t.Errorf("got timestamp %q, want the time the callback was sent", timestamp)
+					}
+					wantSignature = signaturePrefix + sign(test.secret, timestamp, "123", body)
+				}
+				if got := r.Header.Get(asyncSignatureHeader); got != wantSignature {
+					t.Errorf("got signature %q, want %q", got, wantSignature)
+				}
+				w.WriteHeader(test.responses[attempts])
+				attempts++
+			}))
+			defer callbackServer.Close()
+
+			data := &requestData{
+				ID:             "123",
+				CallbackURL:    callbackServer.URL,
+				CallbackSecret: test.secret,
+			}
+			result := &status.Result{StatusCode: http.StatusOK, Body: []byte("done")}
+			err := sendCallback(context.Background(), data, status.Succeeded, "", result)
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %v", err, test.wantErr)
+			}
+			if attempts != test.wantAttempts {
+				t.Errorf("got %d attempts, want %d", attempts, test.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestSendCallbackBlocked(t *testing.T) {
+	env = envInfo{
+		CallbackMaxAttempts: 3,
+		CallbackBackoff:     time.Hour,
+		CallbackTimeout:     time.Second,
+	}
+	attempts := 0
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+	}))
+	defer callbackServer.Close()
+
+	// Blocked addresses aren't retried.
+	data := &requestData{ID: "123", CallbackURL: callbackServer.URL}
+	if err := sendCallback(context.Background(), data, status.Succeeded, "", nil); !errors.Is(err, errCallbackBlocked) {
+		t.Errorf("got error %v, want %v", err, errCallbackBlocked)
+	}
+	if attempts != 0 {
+		t.Errorf("got %d attempts, want none", attempts)
+	}
+}
+
+func TestCallbackAllowed(t *testing.T) {
+	callbackNetworks = parseNetworks("10.96.0.0/12")
+	defer func() { callbackNetworks = nil }()
+	for ip, want := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"10.96.0.10":       true,
+		"10.0.0.1":         false,
+		"127.0.0.1":        false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"fd00::1":          false,
+		"fe80::1":          false,
+		"::ffff:127.0.0.1": false,
+	} {
+		if got := callbackAllowed(net.ParseIP(ip)); got != want {
+			t.Errorf("callbackAllowed(%s) = %t, want %t", ip, got, want)
+		}
+	}
+}
@@ -14,58 +14,756 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
-	"strings"
+	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/bradleypeabody/gouuidv6"
 	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/go-redis/redis/v9"
+	"github.com/kelseyhightower/envconfig"
+
+	"knative.dev/async-component/pkg/claimcheck"
+	"knative.dev/async-component/pkg/compression"
+	"knative.dev/async-component/pkg/deadletter"
+	"knative.dev/async-component/pkg/depth"
+	"knative.dev/async-component/pkg/encryption"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/redisclient"
+	"knative.dev/async-component/pkg/retry"
+	"knative.dev/async-component/pkg/status"
 )
 
+type envInfo struct {
+	// RedisAddress is where request status is recorded. Status updates are
+	// skipped when it is empty.
+	RedisAddress    string        `envconfig:"REDIS_ADDRESS"`
+	TlsCert         string        `envconfig:"TLS_CERT"`
+	StatusKeyPrefix string        `envconfig:"STATUS_KEY_PREFIX" default:"async-status:"`
+	StatusTTL       time.Duration `envconfig:"STATUS_TTL" default:"24h"`
+	// ResultBodyLimit is the number of bytes of the target's response body
+	// that are kept; longer bodies are truncated.
+	ResultBodyLimit int64 `envconfig:"RESULT_BODY_LIMIT" default:"1000000"`
+	// ResultHeaders are the response headers of the target that are kept.
+	ResultHeaders []string      `envconfig:"RESULT_HEADERS" default:"Content-Type,Content-Encoding,Content-Language,Location"`
+	ResultTTL     time.Duration `envconfig:"RESULT_TTL" default:"24h"`
+	// CallbackMaxAttempts is how often a callback is tried before giving up.
+	CallbackMaxAttempts int `envconfig:"CALLBACK_MAX_ATTEMPTS" default:"5"`
+	// CallbackBackoff is the delay before the first retry of a callback,
+	// which doubles with every further attempt.
+	CallbackBackoff time.Duration `envconfig:"CALLBACK_BACKOFF" default:"1s"`
+	CallbackTimeout time.Duration `envconfig:"CALLBACK_TIMEOUT" default:"10s"`
+	// CallbackAllowedNetworks are CIDRs callbacks may reach, although they
+	// are private. All other private networks are off limits to callbacks.
+	CallbackAllowedNetworks []string `envconfig:"CALLBACK_ALLOWED_NETWORKS"`
+	// RequestTimeout bounds every attempt of delivering a request, unless the
+	// request overrides it. Zero leaves attempts unbounded.
+	RequestTimeout time.Duration `envconfig:"REQUEST_TIMEOUT" default:"5m"`
+	// PushTimeout bounds the attempts of a request pushed to the consumer and
+	// the waits between them, which have to end before the timeout of the
+	// consumer's revision, 5 minutes by default. Otherwise the request is
+	// pushed again while it is still being retried. Zero leaves them
+	// unbounded.
+	PushTimeout time.Duration `envconfig:"PUSH_TIMEOUT" default:"4m30s"`
+	// MaxRequestAge is how long after being accepted requests expire, unless
+	// they expire earlier by themselves. Zero keeps requests until delivered.
+	MaxRequestAge time.Duration `envconfig:"MAX_REQUEST_AGE"`
+	// MetricsPort is where metrics are served for Prometheus.
+	MetricsPort string `envconfig:"METRICS_PORT" default:"9090"`
+	// RetryMaxAttempts is how often a request is sent to the target service
+	// before giving up, unless the service overrides it.
+	RetryMaxAttempts int `envconfig:"RETRY_MAX_ATTEMPTS" default:"3"`
+	// RetryStatusCodes are the response codes of the target service that
+	// are retried. Requests failing to connect are always retried.
+	RetryStatusCodes []int `envconfig:"RETRY_STATUS_CODES" default:"408,429,500,502,503,504"`
+	// RetryBackoff is the delay before the first retry of a request, which
+	// doubles with every further attempt up to RetryMaxBackoff.
+	RetryBackoff    time.Duration `envconfig:"RETRY_BACKOFF" default:"1s"`
+	RetryMaxBackoff time.Duration `envconfig:"RETRY_MAX_BACKOFF" default:"60s"`
+	// RetryMaxAttemptsLimit and RetryMaxBackoffLimit bound the retry policy
+	// services and requests may ask for. Zero leaves it unbounded.
+	RetryMaxAttemptsLimit int           `envconfig:"RETRY_MAX_ATTEMPTS_LIMIT" default:"20"`
+	RetryMaxBackoffLimit  time.Duration `envconfig:"RETRY_MAX_BACKOFF_LIMIT" default:"1h"`
+	// DeadLetterStream is the Redis stream requests that failed for good are
+	// written to. Nothing is dead-lettered when it or RedisAddress is empty.
+	DeadLetterStream string `envconfig:"DEAD_LETTER_STREAM" default:"async-dead-letter"`
+	// DeadLetterMaxLen is the number of entries kept in the dead-letter
+	// stream before the oldest are dropped, along with their bodies.
+	DeadLetterMaxLen int64 `envconfig:"DEAD_LETTER_MAX_LEN" default:"10000"`
+	// DepthKey is the Redis hash the producer counts queued requests in,
+	// which finished requests are taken off.
+	DepthKey string `envconfig:"DEPTH_KEY" default:"async-depth"`
+	// EncryptionKeysDir holds the keys of a mounted Secret, which encrypted
+	// requests are decrypted with. It needs every key requests still queued
+	// may be encrypted with. The keys are read again every
+	// EncryptionReloadInterval.
+	EncryptionKeysDir        string        `envconfig:"ENCRYPTION_KEYS_DIR"`
+	EncryptionReloadInterval time.Duration `envconfig:"ENCRYPTION_RELOAD_INTERVAL" default:"30s"`
+}
+
 type requestData struct {
+	// Version is the format of the message. Messages without one are from
+	// before bodies were encoded.
+	Version   int                 `json:"version,omitempty"`
 	ID        string              `json:"id"`
 	ReqURL    string              `json:"url"`
 	ReqBody   string              `json:"body"`
 	ReqHeader map[string][]string `json:"header"`
 	ReqMethod string              `json:"method"`
+	// BodyEncoding is how ReqBody is encoded. Bodies without an encoding are
+	// sent as they are.
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+	// BodyRef is the key of a body kept in the body store, which is BodySize
+	// bytes long.
+	BodyRef  string `json:"bodyRef,omitempty"`
+	BodySize int64  `json:"bodySize,omitempty"`
+	// Compression is set on messages wrapping a request compressed with it,
+	// and KeyID on those wrapping a request encrypted with DataKey, which is
+	// in turn encrypted with the key of that ID. Besides the ID, that request
+	// in Payload is all they carry.
+	Compression string `json:"compression,omitempty"`
+	KeyID       string `json:"keyID,omitempty"`
+	DataKey     []byte `json:"dataKey,omitempty"`
+	Payload     []byte `json:"payload,omitempty"`
+	// CallbackURL is where the result is posted once the request is done.
+	CallbackURL    string `json:"callbackURL,omitempty"`
+	CallbackSecret string `json:"callbackSecret,omitempty"`
+	// Retry overrides the default retry policy for this request.
+	Retry *retry.Policy `json:"retry,omitempty"`
+	// Timeout overrides the default timeout of every attempt of delivering
+	// this request.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Expires is when the request expires if it hasn't been delivered.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Replayed is when the request was last replayed from the dead letters.
+	// Encrypted requests carry it on the message wrapping them.
+	Replayed *time.Time `json:"replayed,omitempty"`
 }
 
 const (
 	preferHeaderField = "Prefer"
 	preferSyncValue   = "respond-sync"
+	// attemptHeader tells the target service how often it has been sent the
+	// request, starting at 1.
+	attemptHeader = "Async-Attempt"
+	// messageVersion is the latest message format the consumer understands.
+	messageVersion = 5
+	// base64Encoding marks request bodies encoded with standard base64.
+	base64Encoding = "base64"
 )
 
-func consumeEvent(event cloudevents.Event) error {
-	data := &requestData{}
+var env envInfo
+var queueConfig queue.Config
+var claimCheckConfig claimcheck.Config
+var redisConfig redisclient.Config
+var store status.Store
+var deadLetters deadletter.Store
+var depths depth.Counter
+var bodies claimcheck.Store
+var keyring *encryption.Keyring
+var now = time.Now
+
+// consumeEvent handles requests pushed to the consumer as CloudEvents.
+func consumeEvent(ctx context.Context, event cloudevents.Event) error {
+	// The RedisStreamSource sends the stream entry as a list of field names
+	// and values, other sources send the request itself.
+	payload := event.Data()
 	datastrings := make([]string, 0)
-	event.DataAs(&datastrings)
+	if err := event.DataAs(&datastrings); err == nil && len(datastrings) > 1 {
+		payload = []byte(datastrings[1])
+	}
+	var until time.Time
+	if env.PushTimeout > 0 {
+		until = now().Add(env.PushTimeout)
+	}
+	return consumeRequest(ctx, payload, until)
+}
+
+// consumeMessage handles requests pulled from the queue. Requests the queue
+// delivered too often are given up on.
+func consumeMessage(ctx context.Context, msg queue.Message) error {
+	if msg.Exhausted {
+		return giveUp(ctx, msg.Data)
+	}
+	return consumeRequest(ctx, msg.Data, time.Time{})
+}
+
+// readRequest decodes a JSON encoded request. Encrypted and compressed
+// requests are unwrapped, and handled like the request they carry from then
+// on. It returns the request along with the payload it is dead-lettered as,
+// which is the request as it came if it was encrypted, so it isn't kept in
+// the clear. Requests that can't be read are returned as far as they could be.
+func readRequest(payload []byte) (*requestData, []byte, error) {
+	data := &requestData{}
 	// unmarshal the string to request
-	if err := json.Unmarshal([]byte(datastrings[1]), data); err != nil {
-		return fmt.Errorf("error unmarshalling json: %w", err)
+	if err := json.Unmarshal(payload, data); err != nil {
+		return data, payload, fmt.Errorf("error unmarshalling json: %w", err)
+	}
+	encrypted := false
+	for data.KeyID != "" || data.Compression != "" {
+		unwrapped, err := unwrap(data)
+		if err != nil {
+			return data, payload, err
+		}
+		encrypted = encrypted || data.KeyID != ""
+		inner := &requestData{}
+		if err := json.Unmarshal(unwrapped, inner); err != nil {
+			return data, payload, fmt.Errorf("error unmarshalling json: %w", err)
+		}
+		if inner.Replayed == nil {
+			inner.Replayed = data.Replayed
+		}
+		data = inner
+		if !encrypted {
+			payload = unwrapped
+		}
+	}
+	return data, payload, nil
+}
+
+// giveUp fails a request without sending it again, because the queue delivered
+// it too often, likely as it kept the consumer from finishing it. It is
+// dead-lettered like any request that failed for good.
+func giveUp(ctx context.Context, payload []byte) error {
+	data, payload, err := readRequest(payload)
+	if err != nil {
+		// With nowhere to dead-letter it to, the request is dropped.
+		if deadLetter(ctx, data, payload, err.Error(), nil) || deadLetters == nil {
+			return nil
+		}
+		return err
+	}
+	if !start(ctx, data) {
+		return nil
+	}
+	if !fail(ctx, data, payload, "request was delivered too often", nil, nil) {
+		return fmt.Errorf("unable to dead-letter request %s", data.ID)
+	}
+	return nil
+}
+
+// consumeRequest delivers a JSON encoded request to the target service,
+// retrying it according to the retry policy of the request until it expires.
+// No attempt runs past until, unless it is zero, and no retry is started that
+// would only happen after it: the last attempt is final then. Requests that
+// fail for good are dead-lettered, and only reported as an error if that
+// fails too, so the queue can deliver them again.
+func consumeRequest(ctx context.Context, payload []byte, until time.Time) error {
+	data, payload, err := readRequest(payload)
+	if err != nil {
+		if deadLetter(ctx, data, payload, err.Error(), nil) {
+			return nil
+		}
+		return err
+	}
+	if !start(ctx, data) {
+		return nil
+	}
+	policy := defaultRetryPolicy().Merge(data.Retry).Limit(env.RetryMaxAttemptsLimit, env.RetryMaxBackoffLimit)
+	if expired(data) {
+		finish(ctx, data, status.Expired, "request expired before it could be delivered", nil)
+		return nil
 	}
 
 	// client for sending request
 	client := &http.Client{}
-	req, err := http.NewRequest(data.ReqMethod, data.ReqURL, strings.NewReader(data.ReqBody))
+	attempts := make([]deadletter.Attempt, 0, 1)
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest(ctx, data, attempt)
+		if err != nil {
+			if fail(ctx, data, payload, err.Error(), nil, attempts) {
+				return nil
+			}
+			return fmt.Errorf("unable to create new request %w", err)
+		}
+		sent := now().UTC()
+		client.Timeout = attemptTimeout(data, until)
+		resp, err := client.Do(req)
+		var delay time.Duration
+		if err != nil {
+			attempts = append(attempts, deadletter.Attempt{Time: sent, Error: err.Error()})
+			delay = policy.Delay(attempt, "")
+			if attempt >= policy.MaxAttempts || pastUntil(data, delay, until) {
+				if fail(ctx, data, payload, err.Error()+attemptsSuffix(attempt), nil, attempts) {
+					return nil
+				}
+				return fmt.Errorf("problem calling url: %w", err)
+			}
+			log.Printf("Attempt %d of request %s failed, retrying: %v", attempt, data.ID, err)
+		} else {
+			attempts = append(attempts, deadletter.Attempt{Time: sent, StatusCode: resp.StatusCode})
+			delay = policy.Delay(attempt, resp.Header.Get("Retry-After"))
+			if attempt >= policy.MaxAttempts || !policy.Retryable(resp.StatusCode) || pastUntil(data, delay, until) {
+				if !deliver(ctx, data, payload, resp, attempts) {
+					return fmt.Errorf("unable to dead-letter request %s", data.ID)
+				}
+				return nil
+			}
+			log.Printf("Attempt %d of request %s got status %d, retrying", attempt, data.ID, resp.StatusCode)
+			// Drain the body so the connection can be reused.
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if expires, ok := expiry(data); ok && now().Add(delay).After(expires) {
+			// The request would expire before the next attempt.
+			finish(ctx, data, status.Expired, fmt.Sprintf("request expired before attempt %d", attempt+1), nil)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			// The request is left in flight for the queue to deliver again.
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// accepted returns when the producer accepted the request, which is encoded
+// in its UUIDv6 ID.
+func accepted(data *requestData) (time.Time, bool) {
+	id, err := gouuidv6.Parse(data.ID)
+	if err != nil || id.IsNil() {
+		return time.Time{}, false
+	}
+	return id.Time(), true
+}
+
+// expiry returns when the request expires, which is the earlier of its own
+// expiry and the maximum age of requests, or false if it never does. Replayed
+// requests are as old as the time they were replayed.
+func expiry(data *requestData) (time.Time, bool) {
+	var expires time.Time
+	if data.Expires != nil {
+		expires = *data.Expires
+	}
+	at, ok := accepted(data)
+	if data.Replayed != nil && (!ok || data.Replayed.After(at)) {
+		at, ok = *data.Replayed, true
+	}
+	if ok && env.MaxRequestAge > 0 {
+		if maxAge := at.Add(env.MaxRequestAge); expires.IsZero() || maxAge.Before(expires) {
+			expires = maxAge
+		}
+	}
+	return expires, !expires.IsZero()
+}
+
+// expired reports whether the request has expired.
+func expired(data *requestData) bool {
+	expires, ok := expiry(data)
+	return ok && !now().Before(expires)
+}
+
+// pastUntil reports whether an attempt of the request after the given delay
+// would start after until. Requests expiring before until are left to expire.
+func pastUntil(data *requestData, delay time.Duration, until time.Time) bool {
+	if until.IsZero() {
+		return false
+	}
+	if expires, ok := expiry(data); ok && !until.Before(expires) {
+		return false
+	}
+	return now().Add(delay).After(until)
+}
+
+// attemptTimeout returns how long an attempt of delivering the request may
+// take, which is cut short if the request expires before, or at until.
+func attemptTimeout(data *requestData, until time.Time) time.Duration {
+	timeout := env.RequestTimeout
+	if data.Timeout > 0 {
+		timeout = data.Timeout
+	}
+	expires, ok := expiry(data)
+	if !until.IsZero() && (!ok || until.Before(expires)) {
+		expires, ok = until, true
+	}
+	if ok {
+		if left := expires.Sub(now()); timeout <= 0 || left < timeout {
+			timeout = left
+		}
+		// A zero or negative timeout would leave the attempt unbounded.
+		if timeout < time.Millisecond {
+			timeout = time.Millisecond
+		}
+	}
+	return timeout
+}
+
+// defaultRetryPolicy returns the retry policy of requests not overriding it.
+func defaultRetryPolicy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts: env.RetryMaxAttempts,
+		StatusCodes: env.RetryStatusCodes,
+		Backoff:     env.RetryBackoff,
+		MaxBackoff:  env.RetryMaxBackoff,
+	}
+}
+
+// newRequest builds the given attempt of sending a request to the target service.
+func newRequest(ctx context.Context, data *requestData, attempt int) (*http.Request, error) {
+	body, size, err := openBody(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(data.ReqMethod, data.ReqURL, body)
 	if err != nil {
-		return fmt.Errorf("unable to create new request %w", err)
+		if c, ok := body.(io.Closer); ok {
+			c.Close()
+		}
+		return nil, err
 	}
-	req.Header = data.ReqHeader
-	if req.Header == nil {
-		req.Header = make(map[string][]string)
+	req.ContentLength = size
+	req.Header = make(http.Header, len(data.ReqHeader)+2)
+	for k, v := range data.ReqHeader {
+		req.Header[k] = v
 	}
 	req.Header.Set(preferHeaderField, preferSyncValue) // We do not want to make this request as async
-	resp, err := client.Do(req)
+	req.Header.Set(attemptHeader, strconv.Itoa(attempt))
+	return req, nil
+}
+
+// unwrap returns the JSON of the request an encrypted or compressed message
+// wraps.
+func unwrap(data *requestData) ([]byte, error) {
+	if data.Version > messageVersion {
+		return nil, fmt.Errorf("unsupported message version %d", data.Version)
+	}
+	if data.KeyID == "" {
+		return compression.Decompress(data.Compression, data.Payload)
+	}
+	if keyring == nil {
+		return nil, errors.New("request is encrypted, but no keys are configured")
+	}
+	return keyring.Open(&encryption.Sealed{KeyID: data.KeyID, DataKey: data.DataKey, Payload: data.Payload}, []byte(data.ID))
+}
+
+// openBody returns the body of a request and its length. Bodies kept in the
+// body store are streamed from it, and closed once the request is sent.
+func openBody(ctx context.Context, data *requestData) (io.Reader, int64, error) {
+	if data.BodyRef == "" {
+		b, err := data.body()
+		if err != nil {
+			return nil, 0, err
+		}
+		return bytes.NewReader(b), int64(len(b)), nil
+	}
+	if data.Version > messageVersion {
+		return nil, 0, fmt.Errorf("unsupported message version %d", data.Version)
+	}
+	if bodies == nil {
+		return nil, 0, errors.New("request body is kept in a body store, but none is configured")
+	}
+	r, err := bodies.Get(ctx, data.BodyRef)
 	if err != nil {
-		return fmt.Errorf("problem calling url: %w", err)
+		return nil, 0, err
+	}
+	return r, data.BodySize, nil
+}
+
+// body returns the original bytes of the request body.
+func (d *requestData) body() ([]byte, error) {
+	if d.Version > messageVersion {
+		return nil, fmt.Errorf("unsupported message version %d", d.Version)
+	}
+	switch d.BodyEncoding {
+	case "":
+		return []byte(d.ReqBody), nil
+	case base64Encoding:
+		b, err := base64.StdEncoding.DecodeString(d.ReqBody)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request body: %w", err)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unsupported body encoding %q", d.BodyEncoding)
 	}
+}
+
+// deliver records the final response of the target service to a request.
+// Requests the target failed are dead-lettered, and it reports whether the
+// request is done with, like fail.
+func deliver(ctx context.Context, data *requestData, payload []byte, resp *http.Response, attempts []deadletter.Attempt) bool {
 	defer resp.Body.Close()
-	return nil
+	result, err := readResult(resp)
+	if err != nil {
+		log.Println("Error reading response body ", err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		reason := fmt.Sprintf("target responded with status %d", resp.StatusCode) + attemptsSuffix(len(attempts))
+		return fail(ctx, data, payload, reason, result, attempts)
+	}
+	finish(ctx, data, status.Succeeded, "", result)
+	return true
+}
+
+// fail dead-letters a request that failed for good and records it as failed.
+// It reports whether the request is done with, which it isn't if it couldn't
+// be dead-lettered. It is left in flight then, for the queue to deliver again,
+// and only finished once that succeeds. Without a dead-letter store requests
+// are done with right away.
+func fail(ctx context.Context, data *requestData, payload []byte, reason string, result *status.Result, attempts []deadletter.Attempt) bool {
+	deadLettered := deadLetter(ctx, data, payload, reason, attempts)
+	if !deadLettered && deadLetters != nil {
+		return false
+	}
+	finish(ctx, data, status.Failed, reason, result)
+	// The body of a dead-lettered request is kept until its dead letter is
+	// trimmed, so that it can be replayed.
+	if !deadLettered {
+		discardBody(ctx, data)
+	}
+	return true
+}
+
+// deadLetter writes a request to the dead-letter store, if one is configured.
+// It reports whether the request was written.
+func deadLetter(ctx context.Context, data *requestData, payload []byte, reason string, attempts []deadletter.Attempt) bool {
+	if deadLetters == nil {
+		return false
+	}
+	entry := deadletter.Entry{
+		ID:       data.ID,
+		Reason:   reason,
+		Attempts: attempts,
+		Failed:   now().UTC(),
+		Request:  payload,
+	}
+	if u, err := url.Parse(data.ReqURL); err == nil {
+		entry.Service = u.Hostname()
+	}
+	if n := len(attempts); n > 0 {
+		entry.StatusCode = attempts[n-1].StatusCode
+	}
+	// Requests that can't be read are kept as a JSON string.
+	if !json.Valid(payload) {
+		entry.Request, _ = json.Marshal(string(payload))
+	}
+	trimmed, err := deadLetters.Add(ctx, entry)
+	if err != nil {
+		log.Println("Error writing dead letter ", err)
+		return false
+	}
+	for _, old := range trimmed {
+		// Requests that can't be read have no body in the store.
+		if data, _, err := readRequest(old.Request); err == nil {
+			discardBody(ctx, data)
+		}
+	}
+	return true
+}
+
+// attemptsSuffix notes the number of attempts in the reason a request failed,
+// if it was retried.
+func attemptsSuffix(attempts int) string {
+	if attempts < 2 {
+		return ""
+	}
+	return fmt.Sprintf(" after %d attempts", attempts)
+}
+
+// finish records the final state and result of a request, takes it off the
+// depth of its service's queue, and notifies the callback URL of the request
+// if it has one.
+func finish(ctx context.Context, data *requestData, state status.State, reason string, result *status.Result) {
+	// Record the result before the final state, so it is available as soon
+	// as the request is reported as done.
+	if result != nil {
+		setResult(ctx, data.ID, result)
+	}
+	setStatus(ctx, data.ID, state, reason)
+	observeLatency(data, state)
+	release(ctx, data)
+	// The body of a failed request is kept if it was dead-lettered, see fail.
+	if state != status.Failed {
+		discardBody(ctx, data)
+	}
+	if data.CallbackURL != "" {
+		notify(data, state, reason, result)
+	}
+}
+
+// pickedUp lists the states a request can be picked up in. Requests the queue
+// delivers again may be in flight already, but those that are done aren't
+// run again.
+var pickedUp = []status.State{status.Scheduled, status.Queued, status.InFlight}
+
+// start records a request as in flight, unless it was cancelled or is done.
+// Cancelled requests are taken off the depth of their service's queue and
+// skipped. Requests that are done were already taken off when they finished,
+// and the bodies of those dead-lettered are kept for the replay.
+func start(ctx context.Context, data *requestData) bool {
+	if store == nil || data.ID == "" {
+		return true
+	}
+	st, err := store.Transition(ctx, data.ID, pickedUp, status.InFlight, "")
+	switch {
+	case errors.Is(err, status.ErrConflict):
+		log.Printf("Skipping request %s, which is %s", data.ID, st.State)
+		if st.State == status.Cancelled {
+			release(ctx, data)
+			discardBody(ctx, data)
+		}
+		return false
+	case errors.Is(err, status.ErrNotFound):
+		// The status has expired, which doesn't stop the request.
+		setStatus(ctx, data.ID, status.InFlight, "")
+	case err != nil:
+		log.Println("Error recording request status ", err)
+	}
+	return true
+}
+
+// release takes a request off the depth of its service's queue, if its status
+// records that it counts towards it. The record is cleared, so requests
+// delivered again or withdrawn by the producer meanwhile are taken off once.
+func release(ctx context.Context, data *requestData) {
+	if depths == nil || store == nil || data.ID == "" {
+		return
+	}
+	reserved, err := store.Unreserve(ctx, data.ID)
+	if err != nil {
+		log.Println("Error taking request off the depth ", err)
+		return
+	} else if !reserved {
+		return
+	}
+	if u, err := url.Parse(data.ReqURL); err == nil {
+		if _, err := depths.Add(ctx, u.Hostname(), -1); err != nil {
+			log.Println("Error counting finished request ", err)
+		}
+	}
+}
+
+// discardBody removes the body of a request that is done from the body store.
+func discardBody(ctx context.Context, data *requestData) {
+	if data.BodyRef == "" || bodies == nil {
+		return
+	}
+	if err := bodies.Delete(ctx, data.BodyRef); err != nil {
+		log.Println("Error deleting request body ", err)
+	}
+}
+
+// setStatus records the state of a request, if a status store is configured.
+// Failing to record status is logged but doesn't fail the request.
+func setStatus(ctx context.Context, id string, state status.State, reason string) {
+	if store == nil || id == "" {
+		return
+	}
+	if err := store.Set(ctx, id, state, reason); err != nil {
+		log.Println("Error recording request status ", err)
+	}
+}
+
+// setResult records the response of the target service, if a status store is
+// configured. Failing to record the result is logged but doesn't fail the request.
+func setResult(ctx context.Context, id string, result *status.Result) {
+	if store == nil || id == "" {
+		return
+	}
+	if err := store.SetResult(ctx, id, result, env.ResultTTL); err != nil {
+		log.Println("Error recording request result ", err)
+	}
+}
+
+// readResult reads the status code, kept headers and the body of the target's
+// response, cutting the body to the configured limit.
+func readResult(resp *http.Response) (*status.Result, error) {
+	result := &status.Result{
+		StatusCode: resp.StatusCode,
+		Header:     make(http.Header),
+	}
+	for _, h := range env.ResultHeaders {
+		if values := resp.Header.Values(h); len(values) > 0 {
+			result.Header[http.CanonicalHeaderKey(h)] = values
+		}
+	}
+	// Read one byte past the limit to find out whether the body was cut.
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, env.ResultBodyLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > env.ResultBodyLimit {
+		body = body[:env.ResultBodyLimit]
+		result.Truncated = true
+	}
+	result.Body = body
+	return result, nil
 }
 
 func main() {
+	err := envconfig.Process("", &env)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	for _, cidr := range env.CallbackAllowedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		callbackNetworks = append(callbackNetworks, network)
+	}
+	err = envconfig.Process("", &redisConfig)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	var client redis.Cmdable
+	if env.RedisAddress != "" {
+		c, err := redisclient.New(env.RedisAddress, env.TlsCert, redisConfig)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		client = c
+		store = status.NewRedisStore(client, env.StatusKeyPrefix, env.StatusTTL)
+		depths = depth.NewRedisCounter(client, env.DepthKey)
+		if env.DeadLetterStream != "" {
+			deadLetters = deadletter.NewRedisStore(client, env.DeadLetterStream, env.DeadLetterMaxLen)
+		}
+	}
+
+	err = envconfig.Process("", &queueConfig)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	err = envconfig.Process("", &claimCheckConfig)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	bodies, err = claimcheck.New(claimCheckConfig)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if env.EncryptionKeysDir != "" {
+		keyring, err = encryption.LoadKeyring(env.EncryptionKeysDir, "", env.EncryptionReloadInterval)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	go serveMetrics(env.MetricsPort)
+
+	// Backends the consumer pulls from are read in the background. The
+	// CloudEvents receiver is started regardless, so requests can be pushed
+	// too and the Knative Service has a port to probe.
+	sub, err := queue.NewSubscriber(queueConfig, client)
+	if err == nil {
+		go func() {
+			log.Fatal(sub.Subscribe(context.Background(), consumeMessage))
+		}()
+	} else if !errors.Is(err, queue.ErrPushOnly) {
+		log.Fatal(err.Error())
+	}
+
 	c, err := cloudevents.NewDefaultClient()
 	if err != nil {
 		log.Fatal("Failed to create client, ", err)
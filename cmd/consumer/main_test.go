@@ -14,15 +14,33 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"knative.dev/async-component/pkg/claimcheck"
+	"knative.dev/async-component/pkg/compression"
+	"knative.dev/async-component/pkg/deadletter"
+	"knative.dev/async-component/pkg/depth"
+	"knative.dev/async-component/pkg/encryption"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/retry"
+	"knative.dev/async-component/pkg/status"
 )
 
 var (
@@ -50,6 +68,11 @@ func TestConsumeEvent(t *testing.T) {
 				t.Errorf("Expected body with POST request to match %s", expectedBodyString)
 			}
 		case http.MethodGet:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("X-Internal", "secret")
+			w.Write([]byte("hello world"))
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusServiceUnavailable)
 		default:
 			t.Errorf("Expected POST or GET request, got %s", r.Method)
 		}
@@ -61,29 +84,63 @@ func TestConsumeEvent(t *testing.T) {
 		body        string
 		reqURL      string
 		expectedErr string
+		state       status.State
+		reason      string
+		result      *status.Result
 	}{{
 		name:        "proper request data, get request",
 		method:      http.MethodGet,
 		reqURL:      testserver.URL,
 		expectedErr: "",
+		state:       status.Succeeded,
+		result: &status.Result{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       []byte("hello"),
+			Truncated:  true,
+		},
 	}, {
 		name:        "proper request data, post request",
 		method:      http.MethodPost,
 		reqURL:      testserver.URL,
 		expectedErr: "",
+		state:       status.Succeeded,
+		result: &status.Result{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+		},
+	}, {
+		name:        "target responds with an error",
+		method:      http.MethodDelete,
+		reqURL:      testserver.URL,
+		expectedErr: "",
+		state:       status.Failed,
+		result: &status.Result{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{},
+		},
 	}, {
 		name:        "bad url format",
 		method:      http.MethodGet,
 		reqURL:      "http://badurl",
-		expectedErr: "no such host",
+		expectedErr: "",
+		state:       status.Failed,
+		reason:      "no such host",
 	}, {
 		name:        "no request URL, get request",
 		method:      http.MethodGet,
 		reqURL:      "",
-		expectedErr: "unsupported protocol scheme",
+		expectedErr: "",
+		state:       status.Failed,
+		reason:      "unsupported protocol scheme",
 	}}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{
+				ResultBodyLimit: 5,
+				ResultHeaders:   []string{"content-type"},
+			}
+			store = status.NewMemoryStore()
 			// create data for Request.
 			data.ID = "123"
 			data.ReqURL = test.reqURL
@@ -101,7 +158,7 @@ func TestConsumeEvent(t *testing.T) {
 			// setdata in the event
 			myEvent.SetData(cloudevents.ApplicationJSON, testData)
 
-			got := consumeEvent(myEvent)
+			got := consumeEvent(context.Background(), myEvent)
 			if test.expectedErr != "" {
 				msg := got.Error()
 				if !strings.Contains(msg, test.expectedErr) {
@@ -110,6 +167,756 @@ func TestConsumeEvent(t *testing.T) {
 			} else if got != nil {
 				t.Errorf("got error when one was unexpected")
 			}
+			if st, _ := store.Get(context.Background(), "123"); st == nil || st.State != test.state || !strings.Contains(st.Reason, test.reason) {
+				t.Errorf("got status %v, want %q with reason %q", st, test.state, test.reason)
+			}
+			result, _ := store.GetResult(context.Background(), "123")
+			if diff := cmp.Diff(test.result, result, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("unexpected result (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestConsumeRequestFormats(t *testing.T) {
+	calls := 0
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer testserver.Close()
+	env = envInfo{}
+	store = status.NewMemoryStore()
+	// Both requests were counted as queued by the producer.
+	depths = depth.NewMemoryCounter()
+	defer func() { depths = nil }()
+	for _, id := range []string{"123", "456"} {
+		store.Set(context.Background(), id, status.Queued, "")
+		store.SetReserved(context.Background(), id)
+		depths.Add(context.Background(), "127.0.0.1", 1)
+	}
+
+	out, err := json.Marshal(requestData{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodGet})
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+
+	// A CloudEvent carrying the request itself, as sent by a broker.
+	event := cloudevents.NewEvent("1.0")
+	event.SetType("dev.knative.async.request")
+	event.SetSource("async-producer")
+	event.SetID("123")
+	event.SetData(cloudevents.ApplicationJSON, json.RawMessage(out))
+	if err := consumeEvent(context.Background(), event); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// A message pulled from a queue.
+	out, err = json.Marshal(requestData{ID: "456", ReqURL: testserver.URL, ReqMethod: http.MethodGet})
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+	if err := consumeMessage(context.Background(), queue.Message{ID: "456", Data: out}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if calls != 2 {
+		t.Errorf("got %d calls to the target, want 2", calls)
+	}
+	if all, _ := depths.All(context.Background()); len(all) != 0 {
+		t.Errorf("got depths %v, want finished requests to be taken off", all)
+	}
+}
+
+func TestConsumeRequestBodies(t *testing.T) {
+	binary := []byte{0x1f, 0x8b, 0x08, 0x00, 0xff, 0xfe, 0x00, 0x80}
+	var received []byte
+	var contentType string
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+		contentType = r.Header.Get("Content-Type")
+	}))
+	defer testserver.Close()
+
+	tests := []struct {
+		name   string
+		data   requestData
+		want   []byte
+		reason string
+	}{{
+		name: "plain body of the first version",
+		data: requestData{ReqBody: `{"body":"test body"}`},
+		want: []byte(`{"body":"test body"}`),
+	}, {
+		name: "binary body",
+		data: requestData{Version: messageVersion, ReqBody: base64.StdEncoding.EncodeToString(binary), BodyEncoding: base64Encoding},
+		want: binary,
+	}, {
+		name:   "invalid base64",
+		data:   requestData{Version: messageVersion, ReqBody: "not base64!", BodyEncoding: base64Encoding},
+		reason: "invalid request body",
+	}, {
+		name:   "unknown encoding",
+		data:   requestData{Version: messageVersion, ReqBody: "abc", BodyEncoding: "base32"},
+		reason: "unsupported body encoding",
+	}, {
+		name:   "newer version",
+		data:   requestData{Version: messageVersion + 1, ReqBody: "abc", BodyEncoding: base64Encoding},
+		reason: "unsupported message version",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{}
+			store = status.NewMemoryStore()
+			received, contentType = nil, ""
+			test.data.ID = "123"
+			test.data.ReqURL = testserver.URL
+			test.data.ReqMethod = http.MethodPost
+			test.data.ReqHeader = map[string][]string{"Content-Type": {"application/octet-stream"}}
+			out, err := json.Marshal(test.data)
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+
+			if err := consumeMessage(context.Background(), queue.Message{ID: "123", Data: out}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.reason != "" {
+				if st, _ := store.Get(context.Background(), "123"); st == nil || st.State != status.Failed || !strings.Contains(st.Reason, test.reason) {
+					t.Errorf("got status %v, want it failed with %q", st, test.reason)
+				}
+				return
+			}
+			if !bytes.Equal(received, test.want) {
+				t.Errorf("got body %v, want %v", received, test.want)
+			}
+			if contentType != "application/octet-stream" {
+				t.Errorf("got content type %q, want it kept", contentType)
+			}
+		})
+	}
+}
+
+func TestConsumeRequestClaimCheck(t *testing.T) {
+	body := []byte("a body kept in the body store")
+	var received []byte
+	var contentLength int64
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+		contentLength = r.ContentLength
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer testserver.Close()
+	ctx := context.Background()
+	files, err := claimcheck.NewFile(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bodies = files
+	defer func() { bodies = nil }()
+
+	dead := &trimmingDeadLetters{}
+	defer func() { deadLetters = nil }()
+	consume := func(id, path string) error {
+		bodies.Put(ctx, id, bytes.NewReader(body), -1)
+		out, err := json.Marshal(requestData{
+			Version:   messageVersion,
+			ID:        id,
+			ReqURL:    testserver.URL + path,
+			ReqMethod: http.MethodPost,
+			BodyRef:   id,
+			BodySize:  int64(len(body)),
+		})
+		if err != nil {
+			t.Fatalf("Error marshaling json for test")
+		}
+		return consumeMessage(ctx, queue.Message{ID: id, Data: out})
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		deadLetters deadletter.Store
+		keepBody    bool
+	}{{
+		name: "body is deleted once delivered",
+	}, {
+		name: "body of a failed request is deleted",
+		path: "/fail",
+	}, {
+		name:        "body of a dead-lettered request is kept",
+		path:        "/fail",
+		deadLetters: dead,
+		keepBody:    true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{}
+			store = status.NewMemoryStore()
+			deadLetters = test.deadLetters
+			if err := consume("123", test.path); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(received, body) || contentLength != int64(len(body)) {
+				t.Errorf("got body %q of length %d, want %q", received, contentLength, body)
+			}
+			_, err = bodies.Get(ctx, "123")
+			if kept := err == nil; kept != test.keepBody {
+				t.Errorf("got body kept %v, want %v", kept, test.keepBody)
+			}
+		})
+	}
+
+	// The body of a dead letter is deleted once it is trimmed.
+	deadLetters = dead
+	if err := consume("789", "/fail"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := bodies.Get(ctx, "123"); err == nil {
+		t.Errorf("body of a trimmed dead letter was kept")
+	}
+	if _, err := bodies.Get(ctx, "789"); err != nil {
+		t.Errorf("body of a dead-lettered request is gone: %v", err)
+	}
+	deadLetters = nil
+
+	// Requests whose body is gone fail.
+	out, _ := json.Marshal(requestData{Version: messageVersion, ID: "456", ReqURL: testserver.URL, ReqMethod: http.MethodPost, BodyRef: "456"})
+	if err := consumeMessage(ctx, queue.Message{ID: "456", Data: out}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if st, _ := store.Get(ctx, "456"); st == nil || st.State != status.Failed || !strings.Contains(st.Reason, claimcheck.ErrNotFound.Error()) {
+		t.Errorf("got status %v, want it failed with %v", st, claimcheck.ErrNotFound)
+	}
+}
+
+func TestConsumeRequestCompressed(t *testing.T) {
+	var received string
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received = string(b)
+	}))
+	defer testserver.Close()
+	env = envInfo{}
+	ctx := context.Background()
+	body := `{"body":"test body"}`
+	request, err := json.Marshal(requestData{
+		Version:      messageVersion,
+		ID:           "123",
+		ReqURL:       testserver.URL,
+		ReqMethod:    http.MethodPost,
+		ReqBody:      base64.StdEncoding.EncodeToString([]byte(body)),
+		BodyEncoding: base64Encoding,
+	})
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+
+	for _, algorithm := range []string{compression.Gzip, compression.Zstd} {
+		t.Run(algorithm, func(t *testing.T) {
+			store = status.NewMemoryStore()
+			received = ""
+			payload, err := compression.Compress(algorithm, request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			out, _ := json.Marshal(requestData{Version: messageVersion, ID: "123", Compression: algorithm, Payload: payload})
+			if err := consumeMessage(ctx, queue.Message{ID: "123", Data: out}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if received != body {
+				t.Errorf("got body %q, want %q", received, body)
+			}
+			if st, _ := store.Get(ctx, "123"); st == nil || st.State != status.Succeeded {
+				t.Errorf("got status %v, want %q", st, status.Succeeded)
+			}
+		})
+	}
+
+	// Requests that fail to decompress are dead-lettered as they are.
+	deadLetters = deadletter.NewMemoryStore()
+	defer func() { deadLetters = nil }()
+	out, _ := json.Marshal(requestData{Version: messageVersion, ID: "456", Compression: compression.Zstd, Payload: request})
+	if err := consumeMessage(ctx, queue.Message{ID: "456", Data: out}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, _, _ := deadLetters.List(ctx, deadletter.Filter{}, "", 0)
+	if len(entries) != 1 || entries[0].ID != "456" {
+		t.Errorf("got dead letters %v, want the request", entries)
+	}
+}
+
+func TestConsumeRequestEncrypted(t *testing.T) {
+	var authorization string
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer testserver.Close()
+	env = envInfo{}
+	ctx := context.Background()
+	old := bytes.Repeat([]byte{1}, 32)
+	producerKeys, _ := encryption.NewKeyring(map[string][]byte{"old": old}, "old")
+	// The consumer has the key requests were encrypted with before rotating.
+	keyring, _ = encryption.NewKeyring(map[string][]byte{"old": old, "new": bytes.Repeat([]byte{2}, 32)}, "")
+	defer func() { keyring = nil }()
+	deadLetters = deadletter.NewMemoryStore()
+	defer func() { deadLetters = nil }()
+
+	seal := func(id, path string) []byte {
+		request, _ := json.Marshal(requestData{
+			Version:   messageVersion,
+			ID:        id,
+			ReqURL:    testserver.URL + path,
+			ReqMethod: http.MethodGet,
+			ReqHeader: map[string][]string{"Authorization": {"Bearer secret"}},
+		})
+		payload, _ := compression.Compress(compression.Gzip, request)
+		compressed, _ := json.Marshal(requestData{Version: messageVersion, ID: id, Compression: compression.Gzip, Payload: payload})
+		sealed, err := producerKeys.Seal(compressed, []byte(id))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		out, _ := json.Marshal(requestData{Version: messageVersion, ID: id, KeyID: sealed.KeyID, DataKey: sealed.DataKey, Payload: sealed.Payload})
+		return out
+	}
+
+	store = status.NewMemoryStore()
+	if err := consumeMessage(ctx, queue.Message{ID: "123", Data: seal("123", "")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if authorization != "Bearer secret" {
+		t.Errorf("got authorization %q, want Bearer secret", authorization)
+	}
+
+	// Failed requests are dead-lettered encrypted.
+	if err := consumeMessage(ctx, queue.Message{ID: "456", Data: seal("456", "/fail")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, _, _ := deadLetters.List(ctx, deadletter.Filter{}, "", 0)
+	if len(entries) != 1 || bytes.Contains(entries[0].Request, []byte("Bearer")) || !bytes.Contains(entries[0].Request, []byte(`"keyID":"old"`)) {
+		t.Errorf("got dead letters %v, want the request encrypted", entries)
+	}
+
+	// Requests can't be passed off as others.
+	if err := consumeMessage(ctx, queue.Message{ID: "789", Data: bytes.Replace(seal("789", ""), []byte(`"id":"789"`), []byte(`"id":"123"`), 1)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entries, _, _ := deadLetters.List(ctx, deadletter.Filter{}, "", 0); len(entries) != 2 {
+		t.Errorf("got %d dead letters, want the tampered request too", len(entries))
+	}
+}
+
+func TestConsumeRequestCancelled(t *testing.T) {
+	calls := 0
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer testserver.Close()
+	env = envInfo{}
+	ctx := context.Background()
+	store = status.NewMemoryStore()
+	store.Set(ctx, "123", status.Queued, "")
+	store.SetReserved(ctx, "123")
+	store.Set(ctx, "123", status.Cancelled, "cancelled by client")
+	depths = depth.NewMemoryCounter()
+	defer func() { depths = nil }()
+	depths.Add(ctx, "127.0.0.1", 1)
+
+	out, err := json.Marshal(requestData{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodGet})
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+	if err := consumeMessage(ctx, queue.Message{ID: "123", Data: out}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if calls != 0 {
+		t.Errorf("got %d calls to the target, want none", calls)
+	}
+	if st, _ := store.Get(ctx, "123"); st.State != status.Cancelled {
+		t.Errorf("got state %q, want %q", st.State, status.Cancelled)
+	}
+	if all, _ := depths.All(ctx); len(all) != 0 {
+		t.Errorf("got depths %v, want cancelled requests to be taken off", all)
+	}
+}
+
+func TestConsumeRequestDone(t *testing.T) {
+	calls := 0
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer testserver.Close()
+	env = envInfo{}
+	ctx := context.Background()
+	store = status.NewMemoryStore()
+	depths = depth.NewMemoryCounter()
+	defer func() { depths = nil }()
+	// Another request of the service is still queued.
+	depths.Add(ctx, "127.0.0.1", 1)
+
+	for i, state := range []status.State{status.Succeeded, status.Failed, status.Expired} {
+		id := strconv.Itoa(i)
+		store.Set(ctx, id, state, "")
+		out, err := json.Marshal(requestData{ID: id, ReqURL: testserver.URL, ReqMethod: http.MethodGet})
+		if err != nil {
+			t.Fatalf("Error marshaling json for test")
+		}
+		// The queue delivers the request again after it is done.
+		if err := consumeMessage(ctx, queue.Message{ID: id, Data: out}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if st, _ := store.Get(ctx, id); st.State != state {
+			t.Errorf("got state %q, want %q", st.State, state)
+		}
+	}
+
+	if calls != 0 {
+		t.Errorf("got %d calls to the target, want none", calls)
+	}
+	if all, _ := depths.All(ctx); all["127.0.0.1"] != 1 {
+		t.Errorf("got depths %v, want requests that are done not taken off again", all)
+	}
+}
+
+func TestConsumeMessageExhausted(t *testing.T) {
+	calls := 0
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer testserver.Close()
+	env = envInfo{}
+	ctx := context.Background()
+	store = status.NewMemoryStore()
+	store.Set(ctx, "123", status.InFlight, "")
+	store.SetReserved(ctx, "123")
+	deadLetters = deadletter.NewMemoryStore()
+	depths = depth.NewMemoryCounter()
+	defer func() {
+		deadLetters = nil
+		depths = nil
+	}()
+	depths.Add(ctx, "127.0.0.1", 1)
+
+	out, err := json.Marshal(requestData{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodGet})
+	if err != nil {
+		t.Fatalf("Error marshaling json for test")
+	}
+	if err := consumeMessage(ctx, queue.Message{ID: "123", Data: out, Exhausted: true}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if calls != 0 {
+		t.Errorf("got %d calls to the target, want none", calls)
+	}
+	if st, _ := store.Get(ctx, "123"); st.State != status.Failed || st.Reason != "request was delivered too often" {
+		t.Errorf("got status %v, want it failed for being delivered too often", st)
+	}
+	if got, _, _ := deadLetters.List(ctx, deadletter.Filter{}, "", 0); len(got) != 1 || got[0].ID != "123" {
+		t.Errorf("got dead letters %v, want the request", got)
+	}
+	if all, _ := depths.All(ctx); len(all) != 0 {
+		t.Errorf("got depths %v, want the request to be taken off", all)
+	}
+}
+
+func TestConsumeRequestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		retry    *retry.Policy
+		// retryAfter is the delay the target asks for, in seconds.
+		retryAfter string
+		// until bounds the attempts, as for pushed requests.
+		until    time.Duration
+		attempts []string
+		state    status.State
+		reason   string
+	}{{
+		name:     "succeeds after retries",
+		failures: 2,
+		attempts: []string{"1", "2", "3"},
+		state:    status.Succeeded,
+	}, {
+		name:     "gives up after max attempts",
+		failures: 5,
+		attempts: []string{"1", "2", "3"},
+		state:    status.Failed,
+		reason:   "target responded with status 503 after 3 attempts",
+	}, {
+		name:     "request overrides max attempts",
+		failures: 5,
+		retry:    &retry.Policy{MaxAttempts: 1},
+		attempts: []string{"1"},
+		state:    status.Failed,
+		reason:   "target responded with status 503",
+	}, {
+		name:     "request overrides retried status codes",
+		failures: 5,
+		retry:    &retry.Policy{StatusCodes: []int{http.StatusBadGateway}},
+		attempts: []string{"1"},
+		state:    status.Failed,
+		reason:   "target responded with status 503",
+	}, {
+		name:     "request asks for more attempts than allowed",
+		failures: 10,
+		retry:    &retry.Policy{MaxAttempts: 1000},
+		attempts: []string{"1", "2", "3", "4"},
+		state:    status.Failed,
+		reason:   "target responded with status 503 after 4 attempts",
+	}, {
+		name:       "no retry past the push timeout",
+		failures:   5,
+		retryAfter: "1",
+		until:      100 * time.Millisecond,
+		attempts:   []string{"1"},
+		state:      status.Failed,
+		reason:     "target responded with status 503",
+	}, {
+		name:     "retries within the push timeout",
+		failures: 2,
+		until:    time.Minute,
+		attempts: []string{"1", "2", "3"},
+		state:    status.Succeeded,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := []string{}
+			testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts = append(attempts, r.Header.Get(attemptHeader))
+				if len(attempts) <= test.failures {
+					retryAfter := "0"
+					if test.retryAfter != "" {
+						retryAfter = test.retryAfter
+					}
+					w.Header().Set("Retry-After", retryAfter)
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer testserver.Close()
+			env = envInfo{
+				RetryMaxAttempts: 3,
+				RetryStatusCodes: []int{http.StatusServiceUnavailable},
+				RetryBackoff:     time.Millisecond,
+				RetryMaxBackoff:  time.Second,
+
+				RetryMaxAttemptsLimit: 4,
+			}
+			store = status.NewMemoryStore()
+
+			out, err := json.Marshal(requestData{ID: "123", ReqURL: testserver.URL, ReqMethod: http.MethodGet, Retry: test.retry})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			var until time.Time
+			if test.until > 0 {
+				until = time.Now().Add(test.until)
+			}
+			if err := consumeRequest(context.Background(), out, until); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(test.attempts, attempts); diff != "" {
+				t.Errorf("unexpected attempts (-want, +got): %s", diff)
+			}
+			st, _ := store.Get(context.Background(), "123")
+			if st == nil || st.State != test.state || st.Reason != test.reason {
+				t.Errorf("got status %v, want %q with reason %q", st, test.state, test.reason)
+			}
+		})
+	}
+}
+
+func TestConsumeRequestDeadLetter(t *testing.T) {
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer testserver.Close()
+	sent := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return sent }
+	defer func() {
+		now = time.Now
+		deadLetters = nil
+		depths = nil
+	}()
+
+	tests := []struct {
+		name    string
+		payload string
+		failing bool
+		want    []deadletter.Entry
+		wantErr bool
+		// counted is whether the request still counts towards the depth.
+		counted bool
+	}{{
+		name:    "delivered request",
+		payload: `{"id":"1","url":"` + testserver.URL + `","method":"GET"}`,
+	}, {
+		name:    "target keeps failing",
+		payload: `{"id":"2","url":"` + testserver.URL + `","method":"DELETE"}`,
+		want: []deadletter.Entry{{
+			ID:         "2",
+			Service:    "127.0.0.1",
+			Reason:     "target responded with status 503 after 2 attempts",
+			StatusCode: http.StatusServiceUnavailable,
+			Attempts: []deadletter.Attempt{
+				{Time: sent, StatusCode: http.StatusServiceUnavailable},
+				{Time: sent, StatusCode: http.StatusServiceUnavailable},
+			},
+			Failed:  sent,
+			Request: json.RawMessage(`{"id":"2","url":"` + testserver.URL + `","method":"DELETE"}`),
+		}},
+	}, {
+		name:    "unreadable request",
+		payload: `not json`,
+		want: []deadletter.Entry{{
+			Reason:  "error unmarshalling json: invalid character 'o' in literal null (expecting 'u')",
+			Failed:  sent,
+			Request: json.RawMessage(`"not json"`),
+		}},
+		counted: true,
+	}, {
+		name:    "dead letter can't be written",
+		payload: `{"id":"3","url":"` + testserver.URL + `","method":"DELETE"}`,
+		failing: true,
+		wantErr: true,
+		counted: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{
+				RetryMaxAttempts: 2,
+				RetryStatusCodes: []int{http.StatusServiceUnavailable},
+				RetryBackoff:     time.Millisecond,
+			}
+			store = status.NewMemoryStore()
+			depths = depth.NewMemoryCounter()
+			for _, id := range []string{"1", "2", "3"} {
+				store.Set(context.Background(), id, status.Queued, "")
+				store.SetReserved(context.Background(), id)
+			}
+			depths.Add(context.Background(), "127.0.0.1", 1)
+			deadLetters = deadletter.NewMemoryStore()
+			if test.failing {
+				deadLetters = failingDeadLetters{deadLetters}
+			}
+
+			err := consumeRequest(context.Background(), []byte(test.payload), time.Time{})
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %t", err, test.wantErr)
+			}
+			// Requests are only taken off once they are done with.
+			if all, _ := depths.All(context.Background()); (len(all) != 0) != test.counted {
+				t.Errorf("got depths %v, want the request counted %t", all, test.counted)
+			}
+			got, _, _ := deadLetters.List(context.Background(), deadletter.Filter{}, "", 0)
+			if diff := cmp.Diff(test.want, got, cmpopts.EquateEmpty(), cmpopts.IgnoreFields(deadletter.Entry{}, "Key")); diff != "" {
+				t.Errorf("unexpected dead letters (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+// failingDeadLetters is a dead-letter store that can't be written to.
+type failingDeadLetters struct {
+	deadletter.Store
+}
+
+func (failingDeadLetters) Add(context.Context, deadletter.Entry) ([]deadletter.Entry, error) {
+	return nil, errors.New("dead-letter stream unavailable")
+}
+
+// trimmingDeadLetters is a dead-letter store that only keeps the last entry.
+type trimmingDeadLetters struct {
+	deadletter.Store
+	last []deadletter.Entry
+}
+
+func (s *trimmingDeadLetters) Add(ctx context.Context, entry deadletter.Entry) ([]deadletter.Entry, error) {
+	trimmed := s.last
+	s.last = []deadletter.Entry{entry}
+	return trimmed, nil
+}
+
+func TestConsumeRequestDeadlines(t *testing.T) {
+	// Timed out attempts leave the handler running, so calls is counted
+	// atomically.
+	var calls int32
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Method == http.MethodPut {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer testserver.Close()
+	past := time.Now().Add(-time.Minute)
+	soon := time.Now().Add(time.Minute)
+
+	tests := []struct {
+		name    string
+		data    requestData
+		calls   int32
+		state   status.State
+		reason  string
+		timeout bool
+	}{{
+		name: "attempt times out",
+		data: requestData{
+			ReqMethod: http.MethodPut,
+			Timeout:   50 * time.Millisecond,
+			Retry:     &retry.Policy{MaxAttempts: 1},
+		},
+		calls:   1,
+		state:   status.Failed,
+		timeout: true,
+	}, {
+		name:   "expired before delivery",
+		data:   requestData{ReqMethod: http.MethodGet, Expires: &past},
+		state:  status.Expired,
+		reason: "request expired before it could be delivered",
+	}, {
+		name:   "expires before the next retry",
+		data:   requestData{ReqMethod: http.MethodGet, Expires: &soon},
+		calls:  1,
+		state:  status.Expired,
+		reason: "request expired before attempt 2",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			env = envInfo{
+				RequestTimeout:   time.Minute,
+				RetryMaxAttempts: 3,
+				RetryStatusCodes: []int{http.StatusServiceUnavailable},
+				RetryBackoff:     time.Hour,
+			}
+			store = status.NewMemoryStore()
+			test.data.ID = "123"
+			test.data.ReqURL = testserver.URL
+
+			out, err := json.Marshal(test.data)
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			consumeRequest(context.Background(), out, time.Time{})
+			if got := atomic.LoadInt32(&calls); got != test.calls {
+				t.Errorf("got %d calls to the target, want %d", got, test.calls)
+			}
+			st, _ := store.Get(context.Background(), "123")
+			if st == nil || st.State != test.state {
+				t.Fatalf("got status %v, want %q", st, test.state)
+			}
+			if test.timeout && !strings.Contains(st.Reason, "Client.Timeout exceeded") {
+				t.Errorf("got reason %q, want a timeout", st.Reason)
+			} else if !test.timeout && st.Reason != test.reason {
+				t.Errorf("got reason %q, want %q", st.Reason, test.reason)
+			}
 		})
 	}
 }
@@ -0,0 +1,55 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"knative.dev/async-component/pkg/status"
+)
+
+// requestLatency is the time from the producer accepting a request to the
+// consumer finishing it, by the final state of the request.
+var requestLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "async",
+	Name:      "request_latency_seconds",
+	Help:      "Time from accepting an asynchronous request to finishing it, by final state.",
+	// From 100ms to about an hour.
+	Buckets: prometheus.ExponentialBuckets(0.1, 2, 16),
+}, []string{"state"})
+
+func init() {
+	prometheus.MustRegister(requestLatency)
+}
+
+// observeLatency records the end-to-end latency of a finished request, taking
+// the time it was accepted from its ID.
+func observeLatency(data *requestData, state status.State) {
+	at, ok := accepted(data)
+	if !ok {
+		return
+	}
+	requestLatency.WithLabelValues(string(state)).Observe(now().Sub(at).Seconds())
+}
+
+// serveMetrics serves the metrics of the consumer on the given port.
+func serveMetrics(port string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Fatal(http.ListenAndServe(":"+port, mux))
+}
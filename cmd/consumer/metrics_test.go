@@ -0,0 +1,97 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bradleypeabody/gouuidv6"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"knative.dev/async-component/pkg/status"
+)
+
+// latencyCount returns how many latencies were observed for the given state.
+func latencyCount(t *testing.T, state status.State) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := requestLatency.WithLabelValues(string(state)).(prometheus.Histogram).Write(m); err != nil {
+		t.Fatalf("error reading metric: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestMaxRequestAge(t *testing.T) {
+	calls := 0
+	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer testserver.Close()
+
+	recently := time.Now().Add(-time.Minute)
+	tests := []struct {
+		name     string
+		accepted time.Time
+		replayed *time.Time
+		calls    int
+		state    status.State
+	}{{
+		name:     "fresh request",
+		accepted: time.Now().Add(-time.Minute),
+		calls:    1,
+		state:    status.Succeeded,
+	}, {
+		name:     "stale request",
+		accepted: time.Now().Add(-2 * time.Hour),
+		state:    status.Expired,
+	}, {
+		name:     "recently replayed request",
+		accepted: time.Now().Add(-2 * time.Hour),
+		replayed: &recently,
+		calls:    1,
+		state:    status.Succeeded,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls = 0
+			env = envInfo{MaxRequestAge: time.Hour}
+			store = status.NewMemoryStore()
+			id := gouuidv6.NewFromTime(test.accepted).String()
+			observed := latencyCount(t, test.state)
+
+			out, err := json.Marshal(requestData{ID: id, ReqURL: testserver.URL, ReqMethod: http.MethodGet, Replayed: test.replayed})
+			if err != nil {
+				t.Fatalf("Error marshaling json for test")
+			}
+			if err := consumeRequest(context.Background(), out, time.Time{}); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if calls != test.calls {
+				t.Errorf("got %d calls to the target, want %d", calls, test.calls)
+			}
+			if st, _ := store.Get(context.Background(), id); st == nil || st.State != test.state {
+				t.Errorf("got status %v, want %q", st, test.state)
+			}
+			if got := latencyCount(t, test.state) - observed; got != 1 {
+				t.Errorf("got %d latencies observed, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/status"
+)
+
+// batchQueue counts the messages and batches written to it.
+type batchQueue struct {
+	mu       sync.Mutex
+	messages int
+	batches  int
+}
+
+func (bq *batchQueue) Publish(ctx context.Context, msg queue.Message) error {
+	return bq.PublishBatch(ctx, []queue.Message{msg})[0]
+}
+
+func (bq *batchQueue) PublishBatch(ctx context.Context, msgs []queue.Message) []error {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	bq.messages += len(msgs)
+	bq.batches++
+	// Writing a batch takes a round trip.
+	time.Sleep(time.Millisecond)
+	return make([]error, len(msgs))
+}
+
+func TestHandleRequestConcurrent(t *testing.T) {
+	bq := &batchQueue{}
+	batcher := queue.NewBatcher(bq, 16, time.Millisecond)
+	publisher = batcher
+	store = status.NewMemoryStore()
+	env.RequestSizeLimit = 6000000
+	defer func() { queueHealth = &writeHealth{name: "the queue"} }()
+
+	const requests = 100
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			handleRequest(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello")))
+			codes <- rr.Code
+		}()
+	}
+	wg.Wait()
+	batcher.Close()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusAccepted {
+			t.Errorf("returned %d, want %d", code, http.StatusAccepted)
+		}
+	}
+	if bq.messages != requests {
+		t.Errorf("got %d messages written, want %d", bq.messages, requests)
+	}
+	if bq.batches >= requests {
+		t.Errorf("got %d batches for %d requests, want fewer", bq.batches, requests)
+	}
+}
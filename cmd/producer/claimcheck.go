@@ -0,0 +1,59 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// storeBody streams a request body to the body store under the request ID,
+// starting with the head already read from it. size is the length of the
+// whole body, or -1 if it isn't known. It returns the length of the body and
+// its hash as computed by idempotency.HashBody, which can't be given the body
+// itself.
+func storeBody(ctx context.Context, id string, head []byte, rest io.Reader, size int64) (int64, string, error) {
+	hash := sha256.New()
+	body := &countingReader{r: io.TeeReader(io.MultiReader(bytes.NewReader(head), rest), hash)}
+	if err := bodies.Put(ctx, id, body, size); err != nil {
+		return 0, "", err
+	}
+	return body.n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// discardBody removes a body from the body store that is no longer needed.
+func discardBody(ctx context.Context, ref string) {
+	if ref == "" || bodies == nil {
+		return
+	}
+	if err := bodies.Delete(ctx, ref); err != nil {
+		log.Println("Error deleting request body ", err)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"knative.dev/async-component/pkg/claimcheck"
+	"knative.dev/async-component/pkg/idempotency"
+)
+
+func TestHandleRequestClaimCheck(t *testing.T) {
+	setupFakeQueue()
+	dir := t.TempDir()
+	store, err := claimcheck.NewFile(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bodies = store
+	idempotencyKeys = idempotency.NewMemoryStore()
+	defer func() { bodies, idempotencyKeys = nil, nil }()
+	// The request size limit only applies to bodies that are queued.
+	env = envInfo{RequestSizeLimit: 4}
+	claimCheckConfig = claimcheck.Config{Threshold: 8, SizeLimit: 32}
+
+	send := func(body []byte, key string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		request.Header.Set(asyncOriginalHostHeader, "hello.default.svc.cluster.local")
+		if key != "" {
+			request.Header.Set(idempotencyKeyHeader, key)
+		}
+		rr := httptest.NewRecorder()
+		handleRequest(rr, request)
+		return rr
+	}
+	written := func() requestData {
+		reqData := requestData{}
+		if err := json.Unmarshal(publisher.(*fakeQueue).written, &reqData); err != nil {
+			t.Fatalf("error unmarshalling request: %v", err)
+		}
+		return reqData
+	}
+	files := func() int {
+		entries, _ := ioutil.ReadDir(dir)
+		return len(entries)
+	}
+
+	// Bodies up to the threshold go on the queue.
+	if rr := send([]byte("small"), ""); rr.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	if reqData := written(); reqData.BodyRef != "" || reqData.Version != messageVersion {
+		t.Errorf("got body reference %q with version %d, want the body queued", reqData.BodyRef, reqData.Version)
+	}
+
+	big := []byte("a body too big for the queue")
+	rr := send(big, "upload")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	resp := acceptedResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	reqData := written()
+	if reqData.Version != claimCheckVersion || reqData.BodyRef != resp.ID || reqData.BodySize != int64(len(big)) || reqData.ReqBody != "" {
+		t.Errorf("got version %d, reference %q of %d bytes and body %q, want version %d and a reference to %q of %d bytes",
+			reqData.Version, reqData.BodyRef, reqData.BodySize, reqData.ReqBody, claimCheckVersion, resp.ID, len(big))
+	}
+	r, err := bodies.Get(context.Background(), resp.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(got, big) {
+		t.Errorf("got stored body %q, want %q", got, big)
+	}
+
+	// A repeated request is matched by the hash of its whole body, and its
+	// copy of the body is dropped.
+	rr = send(big, "upload")
+	repeated := acceptedResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &repeated)
+	if rr.Code != http.StatusAccepted || repeated.ID != resp.ID {
+		t.Errorf("got %d with ID %q, want %d with %q", rr.Code, repeated.ID, http.StatusAccepted, resp.ID)
+	}
+	if n := files(); n != 1 {
+		t.Errorf("got %d stored bodies, want 1", n)
+	}
+
+	// Bodies past the limit of the body store are turned away.
+	if rr := send(bytes.Repeat([]byte("a"), 64), ""); rr.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+	if n := files(); n != 1 {
+		t.Errorf("got %d stored bodies, want 1", n)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"knative.dev/async-component/pkg/compression"
+)
+
+// compressedData wraps a compressed request. The consumer tells it apart from
+// plain requests by its compression.
+type compressedData struct {
+	Version     int    `json:"version"`
+	ID          string `json:"id"`
+	Compression string `json:"compression"`
+	// Payload is the compressed JSON of the request.
+	Payload []byte `json:"payload"`
+}
+
+var (
+	compressedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "async",
+		Name:      "requests_compressed_total",
+		Help:      "Requests compressed before they were queued, by compression.",
+	}, []string{"compression"})
+	// compressionSavedBytes counts the bytes compressing requests saved,
+	// after wrapping them.
+	compressionSavedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "async",
+		Name:      "compression_saved_bytes_total",
+		Help:      "Bytes saved by compressing requests before they were queued, by compression.",
+	}, []string{"compression"})
+)
+
+func init() {
+	prometheus.MustRegister(compressedRequests, compressionSavedBytes)
+}
+
+// compressRequest returns the JSON of a request to queue, compressed if it is
+// big enough for compression to be configured and make it any smaller.
+func compressRequest(id string, data []byte) []byte {
+	if env.Compression == "" || len(data) < env.CompressionThreshold {
+		return data
+	}
+	payload, err := compression.Compress(env.Compression, data)
+	if err != nil {
+		log.Println("Error compressing request ", err)
+		return data
+	}
+	wrapped, err := json.Marshal(compressedData{
+		Version:     compressedVersion,
+		ID:          id,
+		Compression: env.Compression,
+		Payload:     payload,
+	})
+	if err != nil {
+		log.Println("Error compressing request ", err)
+		return data
+	}
+	if len(wrapped) >= len(data) {
+		return data
+	}
+	compressedRequests.WithLabelValues(env.Compression).Inc()
+	compressionSavedBytes.WithLabelValues(env.Compression).Add(float64(len(data) - len(wrapped)))
+	return wrapped
+}
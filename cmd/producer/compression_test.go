@@ -0,0 +1,94 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"knative.dev/async-component/pkg/compression"
+)
+
+func TestHandleRequestCompression(t *testing.T) {
+	setupFakeQueue()
+	body := strings.Repeat(`{"name":"hello","greeting":"world"}`, 20)
+	send := func() []byte {
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		request.Header.Set(asyncOriginalHostHeader, "hello.default.svc.cluster.local")
+		rr := httptest.NewRecorder()
+		handleRequest(rr, request)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+		}
+		return publisher.(*fakeQueue).written
+	}
+
+	tests := []struct {
+		name        string
+		compression string
+		threshold   int
+		want        string
+	}{{
+		name: "compression off",
+	}, {
+		name:        "below threshold",
+		compression: compression.Zstd,
+		threshold:   1 << 20,
+	}, {
+		name:        "gzip",
+		compression: compression.Gzip,
+		want:        compression.Gzip,
+	}, {
+		name:        "zstd",
+		compression: compression.Zstd,
+		want:        compression.Zstd,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{RequestSizeLimit: 1 << 20, Compression: test.compression, CompressionThreshold: test.threshold}
+			written := send()
+			wrapped := compressedData{}
+			if err := json.Unmarshal(written, &wrapped); err != nil {
+				t.Fatalf("error unmarshalling request: %v", err)
+			}
+			if wrapped.Compression != test.want {
+				t.Fatalf("got compression %q, want %q", wrapped.Compression, test.want)
+			}
+			if test.want == "" {
+				return
+			}
+			if wrapped.Version != compressedVersion || wrapped.ID == "" {
+				t.Errorf("got version %d and ID %q, want version %d and an ID", wrapped.Version, wrapped.ID, compressedVersion)
+			}
+			payload, err := compression.Decompress(wrapped.Compression, wrapped.Payload)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			reqData := requestData{}
+			if err := json.Unmarshal(payload, &reqData); err != nil {
+				t.Fatalf("error unmarshalling request: %v", err)
+			}
+			if got, _ := base64.StdEncoding.DecodeString(reqData.ReqBody); string(got) != body || reqData.ID != wrapped.ID {
+				t.Errorf("got request %q with body %q, want %q with %q", reqData.ID, got, wrapped.ID, body)
+			}
+			if len(written) >= len(payload) {
+				t.Errorf("got %d bytes queued, want fewer than %d", len(written), len(payload))
+			}
+		})
+	}
+}
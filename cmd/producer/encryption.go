@@ -0,0 +1,82 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"knative.dev/async-component/pkg/deadletter"
+	"knative.dev/async-component/pkg/priority"
+)
+
+// encryptedData wraps an encrypted request. The consumer tells it apart from
+// plain requests by its key ID. The priority is kept in the clear, so replayed
+// dead letters keep their lane.
+type encryptedData struct {
+	Version  int               `json:"version"`
+	ID       string            `json:"id"`
+	Priority priority.Priority `json:"priority,omitempty"`
+	KeyID    string            `json:"keyID"`
+	DataKey  []byte            `json:"dataKey"`
+	// Payload is the encrypted JSON of the request, which may be compressed.
+	Payload []byte `json:"payload"`
+	// Replayed is when the request was replayed from the dead letters, which
+	// is kept in the clear as the request itself can't be changed.
+	Replayed *time.Time `json:"replayed,omitempty"`
+}
+
+// encryptRequest returns the JSON of a request to queue, encrypted if a
+// keyring is configured. The ciphertext is tied to the request ID.
+func encryptRequest(id string, prio priority.Priority, data []byte) ([]byte, error) {
+	if keyring == nil {
+		return data, nil
+	}
+	sealed, err := keyring.Seal(data, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encryptedData{
+		Version:  encryptedVersion,
+		ID:       id,
+		Priority: prio,
+		KeyID:    sealed.KeyID,
+		DataKey:  sealed.DataKey,
+		Payload:  sealed.Payload,
+	})
+}
+
+// prepareReplay returns the JSON of a dead-lettered request to queue again,
+// marked as replayed at the given time. The consumer keeps encrypted requests
+// as they were, and everything else is compressed and encrypted like new
+// requests.
+func prepareReplay(entry deadletter.Entry, prio priority.Priority, replayed time.Time) ([]byte, error) {
+	wrapped := encryptedData{}
+	if err := json.Unmarshal(entry.Request, &wrapped); err == nil && wrapped.KeyID != "" {
+		wrapped.Replayed = &replayed
+		return json.Marshal(wrapped)
+	}
+	// The request is changed as JSON, so fields this producer doesn't know
+	// about are kept.
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(entry.Request, &fields); err != nil {
+		return nil, err
+	}
+	fields["replayed"], _ = json.Marshal(replayed)
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return encryptRequest(entry.ID, prio, compressRequest(entry.ID, data))
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"knative.dev/async-component/pkg/compression"
+	"knative.dev/async-component/pkg/deadletter"
+	"knative.dev/async-component/pkg/encryption"
+	"knative.dev/async-component/pkg/priority"
+)
+
+func TestHandleRequestEncryption(t *testing.T) {
+	setupFakeQueue()
+	k, err := encryption.NewKeyring(map[string][]byte{"2023-01": bytes.Repeat([]byte{1}, 32)}, "2023-01")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyring = k
+	defer func() { keyring = nil }()
+	body := strings.Repeat(`{"name":"hello"}`, 100)
+
+	for _, algorithm := range []string{"", compression.Zstd} {
+		t.Run("compression "+algorithm, func(t *testing.T) {
+			env = envInfo{RequestSizeLimit: 1 << 20, Compression: algorithm, CompressionThreshold: 10}
+			request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			request.Header.Set(asyncOriginalHostHeader, "hello.default.svc.cluster.local")
+			request.Header.Set("Authorization", "Bearer secret")
+			request.Header.Set(priority.Header, string(priority.High))
+			rr := httptest.NewRecorder()
+			handleRequest(rr, request)
+			if rr.Code != http.StatusAccepted {
+				t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+			}
+
+			written := publisher.(*fakeQueue).written
+			if bytes.Contains(written, []byte("Bearer")) {
+				t.Errorf("got %s queued, want the request encrypted", written)
+			}
+			wrapped := encryptedData{}
+			if err := json.Unmarshal(written, &wrapped); err != nil {
+				t.Fatalf("error unmarshalling request: %v", err)
+			}
+			if wrapped.Version != encryptedVersion || wrapped.KeyID != "2023-01" || wrapped.Priority != priority.High {
+				t.Errorf("got version %d, key %q and priority %q, want %d, 2023-01 and %q",
+					wrapped.Version, wrapped.KeyID, wrapped.Priority, encryptedVersion, priority.High)
+			}
+			payload, err := keyring.Open(&encryption.Sealed{KeyID: wrapped.KeyID, DataKey: wrapped.DataKey, Payload: wrapped.Payload}, []byte(wrapped.ID))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if algorithm != "" {
+				compressed := compressedData{}
+				json.Unmarshal(payload, &compressed)
+				if payload, err = compression.Decompress(compressed.Compression, compressed.Payload); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			reqData := requestData{}
+			if err := json.Unmarshal(payload, &reqData); err != nil {
+				t.Fatalf("error unmarshalling request: %v", err)
+			}
+			if got := http.Header(reqData.ReqHeader).Get("Authorization"); got != "Bearer secret" || reqData.ID != wrapped.ID {
+				t.Errorf("got request %q with authorization %q, want %q with Bearer secret", reqData.ID, got, wrapped.ID)
+			}
+		})
+	}
+}
+
+func TestPrepareReplay(t *testing.T) {
+	env = envInfo{}
+	k, err := encryption.NewKeyring(map[string][]byte{"2023-01": bytes.Repeat([]byte{1}, 32)}, "2023-01")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyring = k
+	defer func() { keyring = nil }()
+
+	// Requests dead-lettered in the clear are encrypted.
+	replayed := time.Date(2023, 1, 2, 12, 0, 0, 0, time.UTC)
+	plain := deadletter.Entry{ID: "123", Request: json.RawMessage(`{"id":"123","priority":"low"}`)}
+	data, err := prepareReplay(plain, priority.Low, replayed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wrapped := encryptedData{}
+	if err := json.Unmarshal(data, &wrapped); err != nil || wrapped.KeyID != "2023-01" || wrapped.Priority != priority.Low {
+		t.Fatalf("got %s (%v), want the request encrypted", data, err)
+	}
+	payload, err := keyring.Open(&encryption.Sealed{KeyID: wrapped.KeyID, DataKey: wrapped.DataKey, Payload: wrapped.Payload}, []byte("123"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reqData := struct {
+		Replayed *time.Time `json:"replayed"`
+	}{}
+	if err := json.Unmarshal(payload, &reqData); err != nil || reqData.Replayed == nil || !reqData.Replayed.Equal(replayed) {
+		t.Errorf("got %s (%v), want the request marked as replayed", payload, err)
+	}
+
+	// Encrypted ones are queued as they are, only marked as replayed.
+	later := replayed.Add(time.Hour)
+	again, err := prepareReplay(deadletter.Entry{ID: "123", Request: data}, priority.Low, later)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rewrapped := encryptedData{}
+	if err := json.Unmarshal(again, &rewrapped); err != nil || !bytes.Equal(rewrapped.Payload, wrapped.Payload) {
+		t.Errorf("got %s (%v), want the payload of %s", again, err, data)
+	}
+	if rewrapped.Replayed == nil || !rewrapped.Replayed.Equal(later) {
+		t.Errorf("got replayed at %v, want %v", rewrapped.Replayed, later)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"knative.dev/async-component/pkg/queue"
+)
+
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+)
+
+// check reports whether a backend the producer depends on can be reached.
+type check func(ctx context.Context) error
+
+// readinessChecks are run by the readiness probe, by name.
+var readinessChecks = map[string]check{}
+
+// writeHealth tracks whether requests can be written to the queue or the
+// spill buffer.
+type writeHealth struct {
+	mu     sync.Mutex
+	failed time.Time
+	name   string
+}
+
+var queueHealth = &writeHealth{name: "the queue"}
+var spillHealth = &writeHealth{name: "the spill buffer"}
+
+// draining is set once the producer is shutting down.
+var draining int32
+
+// record notes the outcome of a write.
+func (h *writeHealth) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		h.failed = time.Time{}
+	} else if h.failed.IsZero() {
+		h.failed = now()
+	}
+}
+
+// drain marks the producer as shutting down.
+func drain() {
+	atomic.StoreInt32(&draining, 1)
+}
+
+// problem describes why writes are failing, if they are. After a failed
+// write they are taken to fail until a write succeeds or WriteFailureWindow
+// has passed, so that the producer is given traffic to try again.
+func (h *writeHealth) problem() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.failed.IsZero() && now().Sub(h.failed) < env.WriteFailureWindow {
+		return fmt.Sprintf("writes to %s failing since %s", h.name, h.failed.UTC().Format(time.RFC3339))
+	}
+	return ""
+}
+
+// publish writes the message to the queue, noting whether it could. Where
+// the message went is recorded with the request status if the queue can take
+// it back, so that cancelling the request does.
+func publish(ctx context.Context, msg queue.Message) error {
+	retracter, ok := publisher.(queue.Retracter)
+	if !ok {
+		err := publisher.Publish(ctx, msg)
+		queueHealth.record(err)
+		return err
+	}
+	ref, err := retracter.PublishRef(ctx, msg)
+	queueHealth.record(err)
+	if err == nil && ref != "" && store != nil {
+		if err := store.SetRef(ctx, msg.ID, msg.Service, ref); err != nil {
+			log.Println("Error recording queue ref ", err)
+		}
+	}
+	return err
+}
+
+// handleHealth answers the liveness probe. It doesn't depend on the backends,
+// as restarting the producer doesn't bring them back.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	// Requests routed here by the async ingress are meant for the target
+	// service, which may well have probes of its own at the same path.
+	if r.Header.Get(asyncOriginalHostHeader) != "" {
+		handleRequest(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleReady answers the readiness probe with the outcome of every check,
+// failing if one of them does or requests can't be written to the queue. With
+// a spill buffer, the producer stays ready while requests can be spilled.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(asyncOriginalHostHeader) != "" {
+		handleRequest(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), env.ReadinessTimeout)
+	defer cancel()
+	results := make(map[string]string, len(readinessChecks)+1)
+	ready := true
+	if problem := queueHealth.problem(); problem != "" {
+		ready = false
+		results["producer"] = problem
+	}
+	for name, check := range readinessChecks {
+		results[name] = "ok"
+		if err := check(ctx); err != nil {
+			ready = false
+			results[name] = err.Error()
+		}
+	}
+	if !ready && buffer != nil {
+		ready = true
+		if problem := spillHealth.problem(); problem != "" {
+			ready = false
+			results["spill"] = problem
+		}
+	}
+	if atomic.LoadInt32(&draining) != 0 {
+		ready = false
+		results["producer"] = "shutting down"
+	}
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, results)
+}
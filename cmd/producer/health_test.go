@@ -0,0 +1,178 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHandleHealth(t *testing.T) {
+	for method, want := range map[string]int{
+		http.MethodGet:  http.StatusOK,
+		http.MethodPost: http.StatusMethodNotAllowed,
+	} {
+		rr := httptest.NewRecorder()
+		handleHealth(rr, httptest.NewRequest(method, healthPath, nil))
+		if rr.Code != want {
+			t.Errorf("%s %s returned %d, want %d", method, healthPath, rr.Code, want)
+		}
+	}
+}
+
+func TestProbesOfTargetServices(t *testing.T) {
+	setupFakeQueue()
+	env = envInfo{RequestSizeLimit: 25}
+	for path, handler := range map[string]http.HandlerFunc{
+		healthPath: handleHealth,
+		readyPath:  handleReady,
+	} {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.Header.Set(asyncOriginalHostHeader, "helloworld-sleep.default.svc.cluster.local")
+		rr := httptest.NewRecorder()
+		handler(rr, request)
+		if rr.Code != http.StatusAccepted {
+			t.Errorf("GET %s for the target service returned %d, want %d", path, rr.Code, http.StatusAccepted)
+		}
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	failedAt := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	defer func() {
+		now = time.Now
+		readinessChecks = map[string]check{}
+		queueHealth = &writeHealth{name: "the queue"}
+		draining = 0
+	}()
+	env.ReadinessTimeout = time.Second
+	env.WriteFailureWindow = 10 * time.Second
+	ok := func(ctx context.Context) error { return nil }
+	down := func(ctx context.Context) error { return errors.New("connection refused") }
+
+	tests := []struct {
+		name       string
+		checks     map[string]check
+		failed     bool
+		elapsed    time.Duration
+		recovered  bool
+		draining   bool
+		returncode int
+		want       map[string]string
+	}{{
+		name:       "no checks",
+		returncode: http.StatusOK,
+		want:       map[string]string{},
+	}, {
+		name:       "backends reachable",
+		checks:     map[string]check{"redis": ok, "queue": ok},
+		returncode: http.StatusOK,
+		want:       map[string]string{"redis": "ok", "queue": "ok"},
+	}, {
+		name:       "backend unreachable",
+		checks:     map[string]check{"redis": ok, "queue": down},
+		returncode: http.StatusServiceUnavailable,
+		want:       map[string]string{"redis": "ok", "queue": "connection refused"},
+	}, {
+		name:       "write failed",
+		checks:     map[string]check{"queue": ok},
+		failed:     true,
+		elapsed:    time.Second,
+		returncode: http.StatusServiceUnavailable,
+		want: map[string]string{
+			"queue":    "ok",
+			"producer": "writes to the queue failing since 2022-12-01T12:00:00Z",
+		},
+	}, {
+		name:       "write failed before the window",
+		checks:     map[string]check{"queue": ok},
+		failed:     true,
+		elapsed:    10 * time.Second,
+		returncode: http.StatusOK,
+		want:       map[string]string{"queue": "ok"},
+	}, {
+		name:       "write succeeded after failing",
+		checks:     map[string]check{"queue": ok},
+		failed:     true,
+		recovered:  true,
+		returncode: http.StatusOK,
+		want:       map[string]string{"queue": "ok"},
+	}, {
+		name:       "shutting down",
+		checks:     map[string]check{"queue": ok},
+		draining:   true,
+		returncode: http.StatusServiceUnavailable,
+		want:       map[string]string{"queue": "ok", "producer": "shutting down"},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now = func() time.Time { return failedAt }
+			readinessChecks = test.checks
+			queueHealth = &writeHealth{name: "the queue"}
+			draining = 0
+			if test.failed {
+				queueHealth.record(errors.New("failure writing"))
+			}
+			if test.recovered {
+				queueHealth.record(nil)
+			}
+			if test.draining {
+				drain()
+			}
+			now = func() time.Time { return failedAt.Add(test.elapsed) }
+
+			rr := httptest.NewRecorder()
+			handleReady(rr, httptest.NewRequest(http.MethodGet, readyPath, nil))
+			if rr.Code != test.returncode {
+				t.Errorf("returned %d, want %d", rr.Code, test.returncode)
+			}
+			got := map[string]string{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("unexpected checks (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestHandleRequestMarksUnready(t *testing.T) {
+	setupFakeQueue()
+	defer func() { queueHealth = &writeHealth{name: "the queue"} }()
+	env.RequestSizeLimit = 6000000
+	env.WriteFailureWindow = time.Minute
+
+	for _, body := range []string{"failure", "success"} {
+		rr := httptest.NewRecorder()
+		handleRequest(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		rr = httptest.NewRecorder()
+		handleReady(rr, httptest.NewRequest(http.MethodGet, readyPath, nil))
+		want := http.StatusOK
+		if body == "failure" {
+			want = http.StatusServiceUnavailable
+		}
+		if rr.Code != want {
+			t.Errorf("readiness after a %s returned %d, want %d", body, rr.Code, want)
+		}
+	}
+}
@@ -15,53 +15,215 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bradleypeabody/gouuidv6"
 
 	"github.com/go-redis/redis/v9"
 	"github.com/kelseyhightower/envconfig"
+
+	"knative.dev/async-component/pkg/claimcheck"
+	"knative.dev/async-component/pkg/compression"
+	"knative.dev/async-component/pkg/deadletter"
+	"knative.dev/async-component/pkg/deadline"
+	"knative.dev/async-component/pkg/depth"
+	"knative.dev/async-component/pkg/encryption"
+	"knative.dev/async-component/pkg/idempotency"
+	"knative.dev/async-component/pkg/priority"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/redisclient"
+	"knative.dev/async-component/pkg/retry"
+	"knative.dev/async-component/pkg/schedule"
+	"knative.dev/async-component/pkg/spill"
+	"knative.dev/async-component/pkg/status"
 )
 
 // Request size limit in bytes.
 const bytesInMB = 1000000
 
+const (
+	asyncOriginalHostHeader = "Async-Original-Host"
+	asyncCallbackURLHeader  = "Async-Callback-URL"
+	asyncCallbackSecret     = "Async-Callback-Secret"
+	asyncTruncatedHeader    = "Async-Result-Truncated"
+	idempotencyKeyHeader    = "Idempotency-Key"
+	requestsPath            = "/requests/"
+	resultPath              = "/result"
+	deadLettersPath         = "/dead-letters/"
+	replayPath              = deadLettersPath + "replay"
+	// defaultDeadLetterLimit and maxDeadLetterLimit bound the dead letters
+	// looked at by a single listing or replay.
+	defaultDeadLetterLimit = 100
+	maxDeadLetterLimit     = 1000
+	// messageVersion is the format of the messages written to the queue.
+	messageVersion = 2
+	// claimCheckVersion is the format of messages referring to a body in
+	// the body store, which older consumers can't read.
+	claimCheckVersion = 3
+	// compressedVersion is the format of compressed messages.
+	compressedVersion = 4
+	// encryptedVersion is the format of encrypted messages.
+	encryptedVersion = 5
+	// base64Encoding marks request bodies encoded with standard base64.
+	base64Encoding = "base64"
+	// resultRetryAfter is the number of seconds clients are asked to wait
+	// before asking again for the result of a pending request.
+	resultRetryAfter = "5"
+	// cancelledReason is recorded with requests cancelled by clients.
+	cancelledReason = "cancelled by client"
+)
+
 type envInfo struct {
-	StreamName       string `envconfig:"REDIS_STREAM_NAME"`
+	// RedisAddress is used by the redis queue backend and to record request
+	// status. Status is not recorded when it is empty.
 	RedisAddress     string `envconfig:"REDIS_ADDRESS"`
 	RequestSizeLimit int64  `envconfig:"REQUEST_SIZE_LIMIT"`
 	TlsCert          string `envconfig:"TLS_CERT"`
+	// StatusKeyPrefix is prepended to request IDs to build status keys.
+	StatusKeyPrefix string `envconfig:"STATUS_KEY_PREFIX" default:"async-status:"`
+	// StatusTTL is how long request status is kept after its last update.
+	StatusTTL time.Duration `envconfig:"STATUS_TTL" default:"24h"`
+	// StatusBaseURL is prepended to the Location of accepted requests, so
+	// callers know where to reach the producer's status API.
+	StatusBaseURL string `envconfig:"STATUS_BASE_URL"`
+	// DeadLetterStream is the Redis stream the consumer writes requests that
+	// failed for good to, which are listed and replayed by the producer.
+	DeadLetterStream string `envconfig:"DEAD_LETTER_STREAM" default:"async-dead-letter"`
+	// AdminToken is the bearer token the dead letters are listed and replayed
+	// with. They can't be reached if it is empty.
+	AdminToken string `envconfig:"ADMIN_TOKEN"`
+	// IdempotencyKeyPrefix is prepended to idempotency keys to build the keys
+	// they are recorded under, for IdempotencyTTL.
+	IdempotencyKeyPrefix string        `envconfig:"IDEMPOTENCY_KEY_PREFIX" default:"async-idempotency:"`
+	IdempotencyTTL       time.Duration `envconfig:"IDEMPOTENCY_TTL" default:"24h"`
+	// DepthKey is the Redis hash counting the requests queued for every
+	// service until the consumer finishes them.
+	DepthKey string `envconfig:"DEPTH_KEY" default:"async-depth"`
+	// MaxQueueDepth limits the requests queued for all services together,
+	// and MaxServiceQueueDepth those queued for any single service. Requests
+	// past either limit are turned away. Zero means no limit.
+	MaxQueueDepth        int64 `envconfig:"MAX_QUEUE_DEPTH"`
+	MaxServiceQueueDepth int64 `envconfig:"MAX_SERVICE_QUEUE_DEPTH"`
+	// QueueFullRetryAfter is how long clients turned away are asked to wait.
+	QueueFullRetryAfter time.Duration `envconfig:"QUEUE_FULL_RETRY_AFTER" default:"30s"`
+	// TrimInterval is how often acknowledged entries are trimmed from the
+	// Redis stream, and the depth metrics are refreshed.
+	TrimInterval time.Duration `envconfig:"TRIM_INTERVAL" default:"1m"`
+	MetricsPort  string        `envconfig:"METRICS_PORT" default:"9090"`
+	// ScheduleKey is the Redis sorted set requests scheduled for later are
+	// kept in, which is checked for due requests every ScheduleInterval.
+	ScheduleKey      string        `envconfig:"SCHEDULE_KEY" default:"async-scheduled"`
+	ScheduleInterval time.Duration `envconfig:"SCHEDULE_INTERVAL" default:"1s"`
+	// Compression is the algorithm requests of at least CompressionThreshold
+	// bytes are compressed with before they are queued. Requests aren't
+	// compressed if it is empty.
+	Compression          string `envconfig:"COMPRESSION"`
+	CompressionThreshold int    `envconfig:"COMPRESSION_THRESHOLD" default:"1024"`
+	// EncryptionKeysDir holds the keys of a mounted Secret, which requests are
+	// encrypted with before they are queued. New requests are encrypted with
+	// the key named EncryptionKeyID. Requests aren't encrypted if it is empty.
+	// The keys are read again every EncryptionReloadInterval.
+	EncryptionKeysDir        string        `envconfig:"ENCRYPTION_KEYS_DIR"`
+	EncryptionKeyID          string        `envconfig:"ENCRYPTION_KEY_ID"`
+	EncryptionReloadInterval time.Duration `envconfig:"ENCRYPTION_RELOAD_INTERVAL" default:"30s"`
+	// ReadinessTimeout bounds the checks of the readiness probe. After a
+	// write to the queue fails, the producer isn't ready for
+	// WriteFailureWindow unless a later write succeeds.
+	ReadinessTimeout   time.Duration `envconfig:"READINESS_TIMEOUT" default:"2s"`
+	WriteFailureWindow time.Duration `envconfig:"WRITE_FAILURE_WINDOW" default:"10s"`
+	// ShutdownTimeout is how long requests being handled are waited for on
+	// shutdown.
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+	// SpillDir is a directory on local disk requests are kept in while the
+	// queue or the status store can't be written to, up to SpillMaxSize bytes
+	// and for up to SpillMaxAge. They are written to the queue every
+	// SpillInterval once it recovers. Requests aren't spilled if it is empty.
+	SpillDir      string        `envconfig:"SPILL_DIR"`
+	SpillMaxSize  int64         `envconfig:"SPILL_MAX_SIZE" default:"104857600"`
+	SpillMaxAge   time.Duration `envconfig:"SPILL_MAX_AGE" default:"1h"`
+	SpillInterval time.Duration `envconfig:"SPILL_INTERVAL" default:"1s"`
 }
 
 type requestData struct {
+	// Version is the format of the message. Messages without one are from
+	// before bodies were encoded, and carry them as plain strings.
+	Version   int                 `json:"version,omitempty"`
 	ID        string              `json:"id"`
 	ReqURL    string              `json:"url"`
 	ReqBody   string              `json:"body"`
 	ReqHeader map[string][]string `json:"header"`
 	ReqMethod string              `json:"method"`
+	// BodyEncoding is how ReqBody is encoded, so bodies that aren't valid
+	// UTF-8 survive being written as JSON.
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+	// BodyRef is the key of a body too big for the queue in the body store,
+	// which is BodySize bytes long. ReqBody is empty then.
+	BodyRef  string `json:"bodyRef,omitempty"`
+	BodySize int64  `json:"bodySize,omitempty"`
+	// CallbackURL is where the result is posted once the request is done.
+	CallbackURL    string `json:"callbackURL,omitempty"`
+	CallbackSecret string `json:"callbackSecret,omitempty"`
+	// Retry overrides the consumer's default retry policy for this request.
+	Retry *retry.Policy `json:"retry,omitempty"`
+	// Timeout bounds every attempt of delivering the request.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Expires is when the request expires if it hasn't been delivered.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Priority is the lane the request is queued in.
+	Priority priority.Priority `json:"priority,omitempty"`
 }
 
-type redisInterface interface {
-	write(ctx context.Context, s envInfo, reqJSON []byte, id string) error
+type TLSConfig struct {
+	TLSCertificate string
 }
 
-type myRedis struct {
-	client redis.Cmdable
+type acceptedResponse struct {
+	ID string `json:"id"`
 }
 
-type TLSConfig struct {
-	TLSCertificate string
+type deadLettersResponse struct {
+	Entries []deadletter.Entry `json:"entries"`
+	// Next is the cursor to list the next dead letters after, empty once
+	// there are none.
+	Next string `json:"next,omitempty"`
+}
+
+type replayResponse struct {
+	Replayed []string `json:"replayed"`
+	// Next is the cursor to replay the next dead letters after, empty once
+	// there are none.
+	Next string `json:"next,omitempty"`
 }
 
 var env envInfo
-var rc redisInterface
+var queueConfig queue.Config
+var claimCheckConfig claimcheck.Config
+var redisConfig redisclient.Config
+var publisher queue.Publisher
+var store status.Store
+var deadLetters deadletter.Store
+var idempotencyKeys idempotency.Store
+var depths depth.Counter
+var scheduled schedule.Store
+var bodies claimcheck.Store
+var keyring *encryption.Keyring
+var buffer *spill.Buffer
 var now = time.Now
 
 func main() {
@@ -71,51 +233,171 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
-	rc = setUpRedis()
-
-	// Start an HTTP Server,
-	http.HandleFunc("/", handleRequest)
-	log.Fatal(http.ListenAndServe(":8080", nil))
-}
+	if env.Compression != "" && !compression.Valid(env.Compression) {
+		log.Fatalf("Unknown compression %q", env.Compression)
+	}
 
-func setUpRedis() redisInterface {
-	// set up redis client
-	roots := x509.NewCertPool()
+	if env.EncryptionKeysDir != "" {
+		if env.EncryptionKeyID == "" {
+			log.Fatal("ENCRYPTION_KEY_ID is needed to encrypt requests")
+		}
+		keyring, err = encryption.LoadKeyring(env.EncryptionKeysDir, env.EncryptionKeyID, env.EncryptionReloadInterval)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
 
-	// AppendCertsFromPEM reports whether a cert was parsed
-	certFound := roots.AppendCertsFromPEM([]byte(env.TlsCert))
+	err = envconfig.Process("", &queueConfig)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	// The producer runs apart from the consumer, which would never see the
+	// requests written to a queue in its memory.
+	if queueConfig.Backend == queue.BackendMemory {
+		log.Fatal("The memory queue backend can't be used by the producer")
+	}
 
-	if certFound {
-		log.Println("found a cert")
-		opt, err := redis.ParseURL(env.RedisAddress)
+	err = envconfig.Process("", &claimCheckConfig)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	bodies, err = claimcheck.New(claimCheckConfig)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	// Bodies are written to the body store as they come, so they would be
+	// kept in the clear.
+	if bodies != nil && keyring != nil {
+		log.Fatal("Requests can't be encrypted while bodies are kept in a body store")
+	}
+	if env.SpillDir != "" {
+		buffer, err = spill.Open(env.SpillDir, env.SpillMaxSize)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
-		opt.TLSConfig = &tls.Config{
-			RootCAs: roots,
+	}
+
+	err = envconfig.Process("", &redisConfig)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	var client redis.Cmdable
+	if env.RedisAddress != "" {
+		client = setUpRedis()
+		readinessChecks["redis"] = func(ctx context.Context) error {
+			return client.Ping(ctx).Err()
 		}
-		rc = &myRedis{
-			client: redis.NewClient(opt),
+		store = status.NewRedisStore(client, env.StatusKeyPrefix, env.StatusTTL)
+		idempotencyKeys = idempotency.NewRedisStore(client, env.IdempotencyKeyPrefix, env.IdempotencyTTL)
+		depths = depth.NewRedisCounter(client, env.DepthKey)
+		scheduled = schedule.NewRedisStore(client, env.ScheduleKey)
+		if env.DeadLetterStream != "" {
+			// The consumer limits the length of the stream.
+			deadLetters = deadletter.NewRedisStore(client, env.DeadLetterStream, 0)
 		}
-	} else {
-		log.Println("didnt find a cert")
-		rc = &myRedis{
-			client: redis.NewClient(&redis.Options{
-				Addr:     env.RedisAddress,
-				Password: "",
-				DB:       0,
-			}),
+	}
+	publisher, err = queue.NewPublisher(queueConfig, client)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if checker, ok := publisher.(queue.Checker); ok {
+		readinessChecks["queue"] = checker.Check
+	}
+	// Requests handled concurrently are written to the queue together.
+	var batcher *queue.Batcher
+	if batchPublisher, ok := publisher.(queue.BatchPublisher); ok && queueConfig.BatchSize > 1 {
+		batcher = queue.NewBatcher(batchPublisher, queueConfig.BatchSize, queueConfig.BatchLinger)
+		publisher = batcher
+	}
+	// Entries of the stream are trimmed once the consumer group is done with
+	// them, or every group of the stream if the group isn't configured, such
+	// as that of a RedisStreamSource.
+	var stream *queue.Redis
+	if queueConfig.Backend == queue.BackendRedis {
+		stream = queue.NewRedisStreams(client, queueConfig)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	var background, spilling sync.WaitGroup
+	go serveMetrics(env.MetricsPort)
+	go watchQueue(ctx, stream, env.TrimInterval)
+	if scheduled != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			watchSchedule(ctx, env.ScheduleInterval)
+		}()
+	}
+	if buffer != nil {
+		observeSpill()
+		spilling.Add(1)
+		go func() {
+			defer spilling.Done()
+			watchSpill(ctx, env.SpillInterval)
+		}()
+	}
+
+	// Start an HTTP Server,
+	http.HandleFunc("/", handleRequest)
+	http.HandleFunc(requestsPath, handleStatus)
+	http.HandleFunc(deadLettersPath, handleDeadLetters)
+	http.HandleFunc(healthPath, handleHealth)
+	http.HandleFunc(readyPath, handleReady)
+	server := &http.Server{Addr: ":8080"}
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err.Error())
 		}
+	}()
+
+	// On shutdown the producer stops being ready, and the requests being
+	// written to the queue, a round of due scheduled requests and the last
+	// batch are finished before it exits. Spilled requests are written to
+	// the queue one last time, as the volume may go away with the pod.
+	<-ctx.Done()
+	log.Println("shutting down")
+	drain()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), env.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error waiting for requests to finish ", err)
+	}
+	spilling.Wait()
+	if buffer != nil {
+		replaySpilled(shutdownCtx)
+	}
+	background.Wait()
+	if batcher != nil {
+		batcher.Close()
+	}
+}
+
+func setUpRedis() redis.UniversalClient {
+	// set up redis client
+	client, err := redisclient.New(env.RedisAddress, env.TlsCert, redisConfig)
+	if err != nil {
+		log.Fatal(err.Error())
 	}
-	return rc
+	return client
 }
 
 // Handle requests coming to producer service by error checking and writing to storage.
 func handleRequest(w http.ResponseWriter, r *http.Request) {
-	// Check that body length doesn't exceed limit.
-	r.Body = http.MaxBytesReader(w, r.Body, env.RequestSizeLimit)
+	// Check that body length doesn't exceed limit. Bodies that go to the body
+	// store have a limit of their own, and are only read up to the claim check
+	// threshold here.
+	limit := env.RequestSizeLimit
+	if bodies != nil {
+		limit = claimCheckConfig.SizeLimit
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	var body io.Reader = r.Body
+	if bodies != nil {
+		body = io.LimitReader(r.Body, claimCheckConfig.Threshold+1)
+	}
 	// read the request body
-	b, err := ioutil.ReadAll(r.Body)
+	b, err := ioutil.ReadAll(body)
 	if err != nil {
 		if err.Error() == "http: request body too large" {
 			log.Println("HTTP Request body too large ", err)
@@ -126,44 +408,639 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	reqBodyString := string(b)
-	id := gouuidv6.NewFromTime(now()).String()
-	originalHost := r.Header.Get("Async-Original-Host")
+	// The ID of a request encodes when it is due, which is when it is
+	// accepted unless it is scheduled for later, so its age and deadline
+	// count from then.
+	due, later, err := schedule.FromHeaders(r.Header, now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Invalid schedule ", err)
+		return
+	}
+	if later && scheduled == nil {
+		// Scheduled requests are only kept when the producer has a Redis
+		// address.
+		w.WriteHeader(http.StatusNotImplemented)
+		log.Println("Unable to schedule request without Redis")
+		return
+	}
+	id := gouuidv6.NewFromTime(due).String()
+	originalHost := r.Header.Get(asyncOriginalHostHeader)
+	callbackURL := r.Header.Get(asyncCallbackURLHeader)
+	if callbackURL != "" && !validCallbackURL(callbackURL) {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Invalid callback URL ", callbackURL)
+		return
+	}
+	retryPolicy, err := retry.FromHeaders(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Invalid retry policy ", err)
+		return
+	}
+	limits, err := deadline.FromHeaders(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Invalid deadline ", err)
+		return
+	}
+	prio, err := priority.FromHeaders(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Invalid priority ", err)
+		return
+	}
+	// The callback, retry, deadline, priority and schedule settings are meant
+	// for us, not for the target service.
+	header := r.Header.Clone()
+	header.Del(asyncCallbackURLHeader)
+	header.Del(asyncCallbackSecret)
+	for _, h := range retry.Headers {
+		header.Del(h)
+	}
+	for _, h := range deadline.Headers {
+		header.Del(h)
+	}
+	for _, h := range priority.Headers {
+		header.Del(h)
+	}
+	for _, h := range schedule.Headers {
+		header.Del(h)
+	}
+	// Bodies above the claim check threshold are streamed to the body store,
+	// and only a reference to them is queued.
+	bodyHash := ""
+	var bodySize int64
+	claimCheck := bodies != nil && int64(len(b)) > claimCheckConfig.Threshold
+	if claimCheck {
+		bodySize, bodyHash, err = storeBody(r.Context(), id, b, r.Body, r.ContentLength)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Error writing request body to the body store ", err)
+			return
+		}
+	}
 	reqData := requestData{
-		ID:        id,
-		ReqBody:   reqBodyString,
-		ReqURL:    "http://" + originalHost + r.URL.String(),
-		ReqHeader: r.Header,
-		ReqMethod: r.Method,
+		Version:        messageVersion,
+		ID:             id,
+		ReqBody:        base64.StdEncoding.EncodeToString(b),
+		BodyEncoding:   base64Encoding,
+		ReqURL:         "http://" + originalHost + r.URL.String(),
+		ReqHeader:      header,
+		ReqMethod:      r.Method,
+		CallbackURL:    callbackURL,
+		CallbackSecret: r.Header.Get(asyncCallbackSecret),
+		Retry:          retryPolicy,
+		Timeout:        limits.Timeout,
+		Priority:       prio,
+	}
+	if expires, ok := limits.Expiry(due); ok {
+		expires = expires.UTC()
+		reqData.Expires = &expires
+	}
+	if claimCheck {
+		reqData.Version = claimCheckVersion
+		reqData.ReqBody, reqData.BodyEncoding = "", ""
+		reqData.BodyRef, reqData.BodySize = id, bodySize
 	}
 	reqJSON, err := json.Marshal(reqData)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println("Failed to marshal request: ", err)
+		discardBody(r.Context(), reqData.BodyRef)
+		return
+	}
+	reqJSON = compressRequest(id, reqJSON)
+	reqJSON, err = encryptRequest(id, prio, reqJSON)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Error encrypting request ", err)
+		discardBody(r.Context(), reqData.BodyRef)
 		return
 	}
 
-	// Write the request information to the storage.
-	if err = rc.write(r.Context(), env, reqJSON, reqData.ID); err != nil {
+	// A repeated request is answered like the first one, without queueing it
+	// again. Keys are scoped to the service the request is meant for.
+	idempotencyKey := ""
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" && idempotencyKeys != nil {
+		idempotencyKey = originalHost + ":" + key
+		hash := bodyHash
+		if hash == "" {
+			hash = idempotency.HashBody(b)
+		}
+		first, err := idempotencyKeys.Claim(r.Context(), idempotencyKey, idempotency.Record{ID: id, BodyHash: hash})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Error recording idempotency key ", err)
+			discardBody(r.Context(), reqData.BodyRef)
+			return
+		}
+		if first != nil && first.BodyHash != hash {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			log.Println("Idempotency key reused for a different request")
+			discardBody(r.Context(), reqData.BodyRef)
+			return
+		} else if first != nil {
+			log.Println("repeated request accepted")
+			discardBody(r.Context(), reqData.BodyRef)
+			accept(w, first.ID)
+			return
+		}
+	}
+
+	// The request counts towards the depth of the queue until the consumer
+	// finishes it. Scheduled requests only count once they are queued.
+	counted := false
+	if !later {
+		var ok bool
+		if ok, counted = reserve(r.Context(), originalHost); !ok {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(env.QueueFullRetryAfter/time.Second), 10))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			log.Println("Queue full, request rejected")
+			releaseIdempotencyKey(r.Context(), idempotencyKey)
+			discardBody(r.Context(), reqData.BodyRef)
+			return
+		}
+	}
+
+	// Record the request as queued before writing it, so the consumer can't
+	// race ahead of us and have its update overwritten.
+	state := status.Queued
+	if later {
+		state = status.Scheduled
+	}
+	// Requests due now are spilled if their status can't be recorded, and
+	// recorded as queued once they are written to the queue.
+	spilled := false
+	if store != nil {
+		if err = store.Set(r.Context(), id, state, ""); err != nil && (buffer == nil || later) {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("Error recording request status ", err)
+			if counted {
+				unreserve(r.Context(), originalHost)
+			}
+			releaseIdempotencyKey(r.Context(), idempotencyKey)
+			discardBody(r.Context(), reqData.BodyRef)
+			return
+		} else if err != nil {
+			log.Println("Error recording request status, spilling request ", err)
+			spilled = true
+		}
+	}
+	// Without a status, the count can't be recorded, so spilled requests
+	// are counted once they are written to the queue.
+	if counted && spilled {
+		unreserve(r.Context(), originalHost)
+	} else if counted {
+		markReserved(r.Context(), id, originalHost)
+	}
+
+	// Write the request information to the storage, or keep it until it is
+	// due.
+	msg := queue.Message{ID: id, Data: reqJSON, Service: originalHost, Priority: prio}
+	if later {
+		err = scheduled.Add(r.Context(), schedule.Entry{ID: id, Due: due, Service: originalHost, Priority: prio, Request: reqJSON})
+	} else if spilled {
+		err = spillRequest(msg)
+	} else {
+		err = enqueue(r.Context(), msg)
+	}
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println("Error asynchronous writing request to storage ", err)
+		if store != nil {
+			if err = store.Set(r.Context(), id, status.Failed, "failed to enqueue request"); err != nil {
+				log.Println("Error recording request status ", err)
+			}
+		}
+		release(r.Context(), id, originalHost)
+		releaseIdempotencyKey(r.Context(), idempotencyKey)
+		discardBody(r.Context(), reqData.BodyRef)
 		return
 	}
 	log.Println("request accepted")
-	w.WriteHeader(http.StatusAccepted)
-	return
-}
-
-// Function to write to Redis stream.
-func (mr *myRedis) write(ctx context.Context, s envInfo, reqJSON []byte, id string) (err error) {
-	strCMD := mr.client.XAdd(ctx, &redis.XAddArgs{
-		Stream: s.StreamName,
-		Values: map[string]interface{}{
-			"data": reqJSON,
-		},
-	})
-	if strCMD.Err() != nil {
-		return fmt.Errorf("failed to publish %q: %v", id, strCMD.Err())
-	}
-	return
+	accept(w, id)
+}
+
+// reserve counts a request for the service as queued, unless that takes the
+// queue past one of the depth limits. Requests are queued without being
+// counted if counting fails, which is told by counted.
+func reserve(ctx context.Context, service string) (ok, counted bool) {
+	if depths == nil {
+		return true, false
+	}
+	d, err := depths.Add(ctx, service, 1)
+	if err != nil {
+		log.Println("Error counting queued requests ", err)
+		return true, false
+	}
+	if (env.MaxQueueDepth > 0 && d.Total > env.MaxQueueDepth) ||
+		(env.MaxServiceQueueDepth > 0 && d.Service > env.MaxServiceQueueDepth) {
+		rejectedRequests.WithLabelValues(service).Inc()
+		unreserve(ctx, service)
+		return false, false
+	}
+	observeDepth(service, d)
+	return true, true
+}
+
+// markReserved records in the status of a request counted by reserve that it
+// counts towards the depth, so that it is taken off the depth once it is
+// done, and only once. Requests whose count can't be recorded aren't counted.
+func markReserved(ctx context.Context, id, service string) {
+	if store == nil {
+		unreserve(ctx, service)
+		return
+	}
+	if err := store.SetReserved(ctx, id); err != nil {
+		log.Println("Error recording queued request as counted ", err)
+		unreserve(ctx, service)
+	}
+}
+
+// count counts a request that is queued regardless of the depth limits, such
+// as a scheduled request once it is due, and records that it counts.
+func count(ctx context.Context, id, service string) {
+	if depths == nil {
+		return
+	}
+	d, err := depths.Add(ctx, service, 1)
+	if err != nil {
+		log.Println("Error counting queued requests ", err)
+		return
+	}
+	observeDepth(service, d)
+	markReserved(ctx, id, service)
+}
+
+// release takes a request off the depth if its status records that it is
+// counted, unless the consumer or another producer took it off already.
+func release(ctx context.Context, id, service string) {
+	if store == nil || depths == nil {
+		return
+	}
+	reserved, err := store.Unreserve(ctx, id)
+	if err != nil {
+		log.Println("Error taking request off the depth ", err)
+		return
+	} else if !reserved {
+		return
+	}
+	unreserve(ctx, service)
+}
+
+// unreserve takes back a request counted by reserve or count whose count
+// isn't recorded in its status.
+func unreserve(ctx context.Context, service string) {
+	if depths == nil {
+		return
+	}
+	d, err := depths.Add(ctx, service, -1)
+	if err != nil {
+		log.Println("Error counting queued requests ", err)
+		return
+	}
+	observeDepth(service, d)
+}
+
+// releaseIdempotencyKey lets the client try a request that wasn't queued
+// again with the same key.
+func releaseIdempotencyKey(ctx context.Context, key string) {
+	if key == "" {
+		return
+	}
+	if err := idempotencyKeys.Release(ctx, key); err != nil {
+		log.Println("Error releasing idempotency key ", err)
+	}
+}
+
+// accept tells the client its request with the given ID was accepted, and
+// where to find out about it if status is recorded.
+func accept(w http.ResponseWriter, id string) {
+	if store != nil {
+		w.Header().Set("Location", env.StatusBaseURL+requestsPath+id)
+	}
+	writeJSON(w, http.StatusAccepted, acceptedResponse{ID: id})
+}
+
+// validCallbackURL reports whether u is an absolute HTTP(S) URL.
+func validCallbackURL(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	return (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// Handle requests for the status of previously accepted requests.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	// Requests routed here by the async ingress are meant for the target
+	// service, which may well have its own /requests/ path.
+	if r.Header.Get(asyncOriginalHostHeader) != "" {
+		handleRequest(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if store == nil {
+		// Status is only recorded when the producer has a Redis address.
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, requestsPath)
+	if strings.HasSuffix(id, resultPath) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		handleResult(w, r, strings.TrimSuffix(id, resultPath))
+		return
+	}
+	if id == "" || strings.Contains(id, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		handleCancel(w, r, id)
+		return
+	}
+	st, err := store.Get(r.Context(), id)
+	if errors.Is(err, status.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Error reading request status ", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// Handle requests cancelling a previously accepted request. Only requests that
+// haven't been picked up yet can be cancelled. They are taken back from the
+// schedule or the queue where possible, and otherwise skipped by the consumer
+// and the schedule when they come up.
+func handleCancel(w http.ResponseWriter, r *http.Request, id string) {
+	previous, err := store.Transition(r.Context(), id, []status.State{status.Scheduled, status.Queued}, status.Cancelled, cancelledReason)
+	if errors.Is(err, status.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, status.ErrConflict) {
+		// The request is already in flight or done.
+		writeJSON(w, http.StatusConflict, previous)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Error cancelling request ", err)
+		return
+	}
+	st, err := store.Get(r.Context(), id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Error reading request status ", err)
+		return
+	}
+	withdraw(r.Context(), previous.State, st)
+	log.Println("request cancelled")
+	writeJSON(w, http.StatusOK, st)
+}
+
+// withdraw takes a cancelled request back from the schedule, or the queue if
+// it records where the request went, and takes it off the depth. Requests
+// that can't be taken back are left to whoever comes across them, which also
+// takes them off the depth, so that only one of the two does.
+func withdraw(ctx context.Context, previous status.State, st *status.Status) {
+	switch {
+	case previous == status.Scheduled && scheduled != nil:
+		entry, err := scheduled.Remove(ctx, st.ID)
+		if err != nil {
+			log.Println("Error removing cancelled request from the schedule ", err)
+			return
+		} else if entry == nil {
+			return
+		}
+		// Scheduled requests only count once they are queued, which those
+		// taken again after failing to be written to the queue are.
+		release(ctx, st.ID, entry.Service)
+	case previous == status.Queued && st.Ref != "":
+		retracter, ok := publisher.(queue.Retracter)
+		if !ok {
+			return
+		}
+		retracted, err := retracter.Retract(ctx, st.Ref)
+		if err != nil {
+			log.Println("Error taking cancelled request back from the queue ", err)
+			return
+		} else if !retracted {
+			return
+		}
+		release(ctx, st.ID, st.Service)
+	default:
+		return
+	}
+	// Bodies in the body store are kept under the request ID.
+	discardBody(ctx, st.ID)
+}
+
+// Handle requests for the response of the target service to a previously
+// accepted request, replaying its status code, kept headers and body.
+func handleResult(w http.ResponseWriter, r *http.Request, id string) {
+	if id == "" || strings.Contains(id, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	st, err := store.Get(r.Context(), id)
+	if errors.Is(err, status.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Error reading request status ", err)
+		return
+	}
+	if st.State == status.Scheduled || st.State == status.Queued || st.State == status.InFlight {
+		w.Header().Set("Retry-After", resultRetryAfter)
+		w.WriteHeader(http.StatusTooEarly)
+		return
+	}
+	result, err := store.GetResult(r.Context(), id)
+	if errors.Is(err, status.ErrNotFound) {
+		// The request finished without a response, or its result has expired.
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Error reading request result ", err)
+		return
+	}
+	for k, v := range result.Header {
+		w.Header()[k] = v
+	}
+	if result.Truncated {
+		w.Header().Set(asyncTruncatedHeader, "true")
+	}
+	w.WriteHeader(result.StatusCode)
+	if _, err := w.Write(result.Body); err != nil {
+		log.Println("Error writing response: ", err)
+	}
+}
+
+// Handle requests listing dead-lettered requests, or replaying them onto the
+// queue. Both select requests by the id, service, from and to query parameters,
+// and look at limit dead letters after the cursor given by after. Callers
+// authenticate with the admin token.
+func handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	// As with status requests, the target service may have a path of its own
+	// matching ours.
+	if r.Header.Get(asyncOriginalHostHeader) != "" {
+		handleRequest(w, r)
+		return
+	}
+	if deadLetters == nil {
+		// Dead letters are only kept when the producer has a Redis address.
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if !authorizedAdmin(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var method string
+	switch r.URL.Path {
+	case deadLettersPath:
+		method = http.MethodGet
+	case replayPath:
+		method = http.MethodPost
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	filter, err := parseFilter(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Invalid dead letter filter ", err)
+		return
+	}
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Invalid dead letter limit ", err)
+		return
+	}
+	entries, next, err := deadLetters.List(r.Context(), filter, query.Get("after"), limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Error reading dead letters ", err)
+		return
+	}
+	if method == http.MethodGet {
+		for i := range entries {
+			entries[i].Request = redactRequest(entries[i].Request)
+		}
+		writeJSON(w, http.StatusOK, deadLettersResponse{Entries: entries, Next: next})
+		return
+	}
+	replayed := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.ID == "" {
+			// Requests the consumer couldn't read are only kept for inspection.
+			continue
+		}
+		if err := replay(r.Context(), entry); err != nil {
+			log.Println("Error replaying dead letter ", err)
+			writeJSON(w, http.StatusInternalServerError, replayResponse{Replayed: replayed})
+			return
+		}
+		replayed = append(replayed, entry.ID)
+	}
+	writeJSON(w, http.StatusOK, replayResponse{Replayed: replayed, Next: next})
+}
+
+// authorizedAdmin reports whether the request carries the admin token.
+func authorizedAdmin(r *http.Request) bool {
+	if env.AdminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(env.AdminToken)) == 1
+}
+
+// parseLimit reads the number of dead letters to look at, which defaults to
+// defaultDeadLetterLimit and is at most maxDeadLetterLimit.
+func parseLimit(v string) (int64, error) {
+	if v == "" {
+		return defaultDeadLetterLimit, nil
+	}
+	limit, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid value for limit: %q", v)
+	}
+	if limit > maxDeadLetterLimit {
+		limit = maxDeadLetterLimit
+	}
+	return limit, nil
+}
+
+// parseFilter reads the dead letter selection from query parameters. Times
+// are given in RFC 3339 format.
+func parseFilter(query url.Values) (deadletter.Filter, error) {
+	filter := deadletter.Filter{
+		IDs:     query["id"],
+		Service: query.Get("service"),
+	}
+	for param, field := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if v := query.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("invalid value for %s: %w", param, err)
+			}
+			*field = t
+		}
+	}
+	return filter, nil
+}
+
+// replay writes a dead-lettered request back onto the queue, in the lane it
+// was first queued in, and removes it from the dead letters once it is
+// queued again. It is marked as replayed, so its age counts from now.
+func replay(ctx context.Context, entry deadletter.Entry) error {
+	req := requestData{}
+	if err := json.Unmarshal(entry.Request, &req); err != nil {
+		return fmt.Errorf("failed to read dead letter %s: %w", entry.ID, err)
+	}
+	data, err := prepareReplay(entry, req.Priority, now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to prepare dead letter %s: %w", entry.ID, err)
+	}
+	if store != nil {
+		if err := store.Set(ctx, entry.ID, status.Queued, ""); err != nil {
+			return err
+		}
+	}
+	// Replayed requests are queued regardless of the depth limits.
+	count(ctx, entry.ID, entry.Service)
+	if err := publish(ctx, queue.Message{ID: entry.ID, Data: data, Service: entry.Service, Priority: req.Priority}); err != nil {
+		release(ctx, entry.ID, entry.Service)
+		return err
+	}
+	return deadLetters.Remove(ctx, entry)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Error writing response: ", err)
+	}
 }
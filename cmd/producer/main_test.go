@@ -15,18 +15,33 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/go-redis/redis/v9"
+	"github.com/bradleypeabody/gouuidv6"
+	"github.com/google/go-cmp/cmp"
+
+	"knative.dev/async-component/pkg/deadletter"
+	"knative.dev/async-component/pkg/deadline"
+	"knative.dev/async-component/pkg/depth"
+	"knative.dev/async-component/pkg/idempotency"
+	"knative.dev/async-component/pkg/priority"
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/retry"
+	"knative.dev/async-component/pkg/schedule"
+	"knative.dev/async-component/pkg/status"
 )
 
-type fakeRedis struct {
-	client redis.Cmdable
+type fakeQueue struct {
+	written []byte
 }
 
 func TestRedisClientSetup(t *testing.T) {
@@ -62,7 +77,6 @@ func TestRedisClientSetup(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			env = envInfo{
-				StreamName:   "mystream",
 				RedisAddress: "rediss://redis.redis.svc.cluster.local:6379",
 				TlsCert:      test.cert,
 			}
@@ -72,12 +86,16 @@ func TestRedisClientSetup(t *testing.T) {
 }
 
 func TestHandleRequest(t *testing.T) {
+	accepted := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return accepted }
+	defer func() { now = time.Now }()
+	acceptedIn1h := accepted.Add(time.Hour)
 	testserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet && r.Method != http.MethodPost {
 			t.Errorf("Expected 'POST' OR 'GET' request, got '%s'", r.Method)
 		}
 	}))
-	setupFakeRedis()
+	setupFakeQueue()
 
 	tests := []struct {
 		name             string
@@ -85,7 +103,12 @@ func TestHandleRequest(t *testing.T) {
 		method           string
 		body             string
 		contentLengthSet bool
+		header           map[string]string
 		returncode       int
+		retry            *retry.Policy
+		timeout          time.Duration
+		expires          *time.Time
+		priority         priority.Priority
 	}{{
 		name:       "async get request",
 		method:     http.MethodGet,
@@ -106,11 +129,81 @@ func TestHandleRequest(t *testing.T) {
 		method:     http.MethodPost,
 		body:       "failure",
 		returncode: http.StatusInternalServerError,
+	}, {
+		name:   "async request with callback",
+		method: http.MethodGet,
+		header: map[string]string{
+			asyncCallbackURLHeader: "https://example.com/callback",
+			asyncCallbackSecret:    "s3cr3t",
+		},
+		returncode: http.StatusAccepted,
+	}, {
+		name:       "async request with invalid callback URL",
+		method:     http.MethodGet,
+		header:     map[string]string{asyncCallbackURLHeader: "/callback"},
+		returncode: http.StatusBadRequest,
+	}, {
+		name:   "async request with retry policy",
+		method: http.MethodGet,
+		header: map[string]string{
+			retry.MaxAttemptsHeader: "5",
+			retry.StatusCodesHeader: "503",
+		},
+		returncode: http.StatusAccepted,
+		retry:      &retry.Policy{MaxAttempts: 5, StatusCodes: []int{503}},
+	}, {
+		name:       "async request with invalid retry policy",
+		method:     http.MethodGet,
+		header:     map[string]string{retry.MaxAttemptsHeader: "many"},
+		returncode: http.StatusBadRequest,
+	}, {
+		name:   "async request with deadline",
+		method: http.MethodGet,
+		header: map[string]string{
+			deadline.TimeoutHeader:  "30s",
+			deadline.DeadlineHeader: "1h",
+		},
+		returncode: http.StatusAccepted,
+		timeout:    30 * time.Second,
+		expires:    &acceptedIn1h,
+	}, {
+		name:       "async request with invalid deadline",
+		method:     http.MethodGet,
+		header:     map[string]string{deadline.TimeoutHeader: "soon"},
+		returncode: http.StatusBadRequest,
+	}, {
+		name:   "async request with expiry before its deadline",
+		method: http.MethodGet,
+		header: map[string]string{
+			deadline.DeadlineHeader: "2h",
+			deadline.ExpiresHeader:  "Thu, 01 Dec 2022 13:00:00 GMT",
+		},
+		returncode: http.StatusAccepted,
+		expires:    &acceptedIn1h,
+	}, {
+		name:   "async request with capped priority",
+		method: http.MethodGet,
+		header: map[string]string{
+			priority.Header:    "high",
+			priority.MaxHeader: "normal",
+		},
+		returncode: http.StatusAccepted,
+		priority:   priority.Normal,
+	}, {
+		name:       "async request with low priority",
+		method:     http.MethodGet,
+		header:     map[string]string{priority.Header: "low"},
+		returncode: http.StatusAccepted,
+		priority:   priority.Low,
+	}, {
+		name:       "async request with invalid priority",
+		method:     http.MethodGet,
+		header:     map[string]string{priority.Header: "urgent"},
+		returncode: http.StatusBadRequest,
 	}}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			env = envInfo{
-				StreamName:       "mystream",
 				RedisAddress:     "address",
 				RequestSizeLimit: 25,
 			}
@@ -122,6 +215,9 @@ func TestHandleRequest(t *testing.T) {
 				}
 				request = httptest.NewRequest(http.MethodPost, testserver.URL, body)
 			}
+			for k, v := range test.header {
+				request.Header.Set(k, v)
+			}
 
 			rr := httptest.NewRecorder()
 			handleRequest(rr, request)
@@ -132,24 +228,791 @@ func TestHandleRequest(t *testing.T) {
 			if got != want {
 				t.Errorf("got %d, want %d", got, want)
 			}
+			if got == http.StatusAccepted {
+				resp := acceptedResponse{}
+				if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("error unmarshalling response: %v", err)
+				}
+				if location := rr.Header().Get("Location"); location != "/requests/"+resp.ID {
+					t.Errorf("got location %q, want %q", location, "/requests/"+resp.ID)
+				}
+				if st, _ := store.Get(context.Background(), resp.ID); st == nil || st.State != status.Queued {
+					t.Errorf("got status %v, want %q", st, status.Queued)
+				}
+				reqData := requestData{}
+				if err := json.Unmarshal(publisher.(*fakeQueue).written, &reqData); err != nil {
+					t.Fatalf("error unmarshalling request: %v", err)
+				}
+				if reqData.CallbackURL != test.header[asyncCallbackURLHeader] || reqData.CallbackSecret != test.header[asyncCallbackSecret] {
+					t.Errorf("got callback %q with secret %q, want %q with secret %q", reqData.CallbackURL, reqData.CallbackSecret,
+						test.header[asyncCallbackURLHeader], test.header[asyncCallbackSecret])
+				}
+				if _, ok := reqData.ReqHeader[asyncCallbackSecret]; ok {
+					t.Errorf("expected callback secret to be removed from the request headers")
+				}
+				if diff := cmp.Diff(test.retry, reqData.Retry); diff != "" {
+					t.Errorf("unexpected retry policy (-want, +got): %s", diff)
+				}
+				if _, ok := reqData.ReqHeader[retry.MaxAttemptsHeader]; ok {
+					t.Errorf("expected retry headers to be removed from the request headers")
+				}
+				if reqData.Timeout != test.timeout {
+					t.Errorf("got timeout %v, want %v", reqData.Timeout, test.timeout)
+				}
+				if diff := cmp.Diff(test.expires, reqData.Expires); diff != "" {
+					t.Errorf("unexpected expiry (-want, +got): %s", diff)
+				}
+				if _, ok := reqData.ReqHeader[deadline.TimeoutHeader]; ok {
+					t.Errorf("expected deadline headers to be removed from the request headers")
+				}
+				want := test.priority
+				if want == "" {
+					want = priority.Normal
+				}
+				if reqData.Priority != want {
+					t.Errorf("got priority %q, want %q", reqData.Priority, want)
+				}
+				if _, ok := reqData.ReqHeader[priority.Header]; ok {
+					t.Errorf("expected priority headers to be removed from the request headers")
+				}
+			}
 		})
 	}
 }
 
-func setupFakeRedis() {
-	// set up redis client
-	opts := &redis.UniversalOptions{
-		Addrs: []string{env.RedisAddress},
+func TestHandleRequestBinaryBody(t *testing.T) {
+	setupFakeQueue()
+	env = envInfo{RequestSizeLimit: 100}
+	body := []byte{0x1f, 0x8b, 0x08, 0x00, 0xff, 0xfe, 0x00, 0x80}
+	request := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+	request.Header.Set(asyncOriginalHostHeader, "hello.default.svc.cluster.local")
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	handleRequest(rr, request)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+
+	reqData := requestData{}
+	if err := json.Unmarshal(publisher.(*fakeQueue).written, &reqData); err != nil {
+		t.Fatalf("error unmarshalling request: %v", err)
 	}
-	theclient := redis.NewUniversalClient(opts)
-	rc = &fakeRedis{
-		client: theclient,
+	if reqData.Version != messageVersion || reqData.BodyEncoding != base64Encoding {
+		t.Errorf("got version %d with encoding %q, want %d with %q", reqData.Version, reqData.BodyEncoding, messageVersion, base64Encoding)
+	}
+	if got, _ := base64.StdEncoding.DecodeString(reqData.ReqBody); !bytes.Equal(got, body) {
+		t.Errorf("got body %v, want %v", got, body)
+	}
+	header := http.Header(reqData.ReqHeader)
+	if header.Get("Content-Type") != "application/octet-stream" || header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected content headers to be kept, got %v", header)
 	}
 }
 
-func (fr *fakeRedis) write(ctx context.Context, s envInfo, reqJSON []byte, id string) (err error) {
-	if strings.Contains(string(reqJSON), "failure") {
+func TestHandleStatus(t *testing.T) {
+	setupFakeQueue()
+	store.Set(context.Background(), "123", status.InFlight, "")
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		header     map[string]string
+		returncode int
+		state      status.State
+	}{{
+		name:       "known request",
+		method:     http.MethodGet,
+		path:       "/requests/123",
+		returncode: http.StatusOK,
+		state:      status.InFlight,
+	}, {
+		name:       "unknown request",
+		method:     http.MethodGet,
+		path:       "/requests/456",
+		returncode: http.StatusNotFound,
+	}, {
+		name:       "missing id",
+		method:     http.MethodGet,
+		path:       "/requests/",
+		returncode: http.StatusNotFound,
+	}, {
+		name:       "unsupported method",
+		method:     http.MethodPut,
+		path:       "/requests/123",
+		returncode: http.StatusMethodNotAllowed,
+	}, {
+		name:       "request for the target service",
+		method:     http.MethodGet,
+		path:       "/requests/123",
+		header:     map[string]string{asyncOriginalHostHeader: "helloworld-sleep.default.svc.cluster.local"},
+		returncode: http.StatusAccepted,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{
+				RedisAddress:     "address",
+				RequestSizeLimit: 25,
+			}
+			request := httptest.NewRequest(test.method, test.path, nil)
+			for k, v := range test.header {
+				request.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			handleStatus(rr, request)
+
+			if got, want := rr.Code, test.returncode; got != want {
+				t.Errorf("got %d, want %d", got, want)
+			}
+			if test.state != "" {
+				st := status.Status{}
+				if err := json.Unmarshal(rr.Body.Bytes(), &st); err != nil {
+					t.Fatalf("error unmarshalling response: %v", err)
+				}
+				if st.State != test.state {
+					t.Errorf("got state %q, want %q", st.State, test.state)
+				}
+			}
+		})
+	}
+}
+
+func setupFakeQueue() {
+	publisher = &fakeQueue{}
+	store = status.NewMemoryStore()
+}
+
+func (fq *fakeQueue) Publish(ctx context.Context, msg queue.Message) error {
+	reqData := requestData{}
+	if err := json.Unmarshal(msg.Data, &reqData); err != nil {
+		return err
+	}
+	if body, _ := base64.StdEncoding.DecodeString(reqData.ReqBody); strings.Contains(string(body), "failure") {
 		return errors.New("Failure writing")
 	}
-	return // no need to actually write to redis stream for our test case.
+	fq.written = msg.Data
+	return nil // no need to actually write to a queue for our test case.
+}
+
+func TestHandleCancel(t *testing.T) {
+	setupFakeQueue()
+	ctx := context.Background()
+	store.Set(ctx, "queued", status.Queued, "")
+	store.Set(ctx, "running", status.InFlight, "")
+	store.Set(ctx, "done", status.Succeeded, "")
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		returncode int
+		state      status.State
+	}{{
+		name:       "queued request",
+		method:     http.MethodDelete,
+		path:       "/requests/queued",
+		returncode: http.StatusOK,
+		state:      status.Cancelled,
+	}, {
+		name:       "request in flight",
+		method:     http.MethodDelete,
+		path:       "/requests/running",
+		returncode: http.StatusConflict,
+		state:      status.InFlight,
+	}, {
+		name:       "finished request",
+		method:     http.MethodDelete,
+		path:       "/requests/done",
+		returncode: http.StatusConflict,
+		state:      status.Succeeded,
+	}, {
+		name:       "unknown request",
+		method:     http.MethodDelete,
+		path:       "/requests/unknown",
+		returncode: http.StatusNotFound,
+	}, {
+		name:       "result",
+		method:     http.MethodDelete,
+		path:       "/requests/queued/result",
+		returncode: http.StatusMethodNotAllowed,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handleStatus(rr, httptest.NewRequest(test.method, test.path, nil))
+
+			if got, want := rr.Code, test.returncode; got != want {
+				t.Errorf("got %d, want %d", got, want)
+			}
+			if test.state != "" {
+				st := status.Status{}
+				if err := json.Unmarshal(rr.Body.Bytes(), &st); err != nil {
+					t.Fatalf("error unmarshalling response: %v", err)
+				}
+				if st.State != test.state {
+					t.Errorf("got state %q, want %q", st.State, test.state)
+				}
+			}
+		})
+	}
+
+	// Cancelling again conflicts with the cancellation.
+	rr := httptest.NewRecorder()
+	handleStatus(rr, httptest.NewRequest(http.MethodDelete, "/requests/queued", nil))
+	if got, want := rr.Code, http.StatusConflict; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+// retractingQueue takes back messages that weren't delivered yet.
+type retractingQueue struct {
+	queued    map[string]queue.Message
+	delivered map[string]bool
+}
+
+func (rq *retractingQueue) Publish(ctx context.Context, msg queue.Message) error {
+	_, err := rq.PublishRef(ctx, msg)
+	return err
+}
+
+func (rq *retractingQueue) PublishRef(ctx context.Context, msg queue.Message) (string, error) {
+	ref := "ref-" + msg.ID
+	rq.queued[ref] = msg
+	return ref, nil
+}
+
+func (rq *retractingQueue) Retract(ctx context.Context, ref string) (bool, error) {
+	if _, ok := rq.queued[ref]; !ok || rq.delivered[ref] {
+		return false, nil
+	}
+	delete(rq.queued, ref)
+	return true, nil
+}
+
+func TestCancelWithdraws(t *testing.T) {
+	setupFakeQueue()
+	q := &retractingQueue{queued: map[string]queue.Message{}, delivered: map[string]bool{}}
+	publisher = q
+	depths = depth.NewMemoryCounter()
+	scheduled = schedule.NewMemoryStore()
+	defer func() { depths, scheduled = nil, nil }()
+	ctx := context.Background()
+	const host = "hello.default.svc.cluster.local"
+	for _, id := range []string{"queued", "delivered"} {
+		store.Set(ctx, id, status.Queued, "")
+		reserve(ctx, host)
+		markReserved(ctx, id, host)
+		if err := publish(ctx, queue.Message{ID: id, Service: host}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	q.delivered["ref-delivered"] = true
+	// Scheduled requests don't count until they are queued.
+	store.Set(ctx, "scheduled", status.Scheduled, "")
+	scheduled.Add(ctx, schedule.Entry{ID: "scheduled", Due: now().Add(time.Hour), Service: host})
+
+	tests := []struct {
+		name  string
+		id    string
+		depth int64
+	}{{
+		name:  "queued request is taken back",
+		id:    "queued",
+		depth: 1,
+	}, {
+		name:  "delivered request is left to the consumer",
+		id:    "delivered",
+		depth: 1,
+	}, {
+		name:  "scheduled request is removed from the schedule",
+		id:    "scheduled",
+		depth: 1,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handleStatus(rr, httptest.NewRequest(http.MethodDelete, "/requests/"+test.id, nil))
+			if got, want := rr.Code, http.StatusOK; got != want {
+				t.Errorf("got %d, want %d", got, want)
+			}
+			all, _ := depths.All(ctx)
+			if got := all[host]; got != test.depth {
+				t.Errorf("got depth %d, want %d", got, test.depth)
+			}
+		})
+	}
+	if _, ok := q.queued["ref-queued"]; ok {
+		t.Errorf("cancelled request is still queued")
+	}
+	if _, ok := q.queued["ref-delivered"]; !ok {
+		t.Errorf("delivered request was taken back")
+	}
+	if entries, _ := scheduled.TakeDue(ctx, now().Add(2*time.Hour), 10, time.Minute); len(entries) != 0 {
+		t.Errorf("got %d scheduled requests, want none", len(entries))
+	}
+}
+
+func TestHandleStatusWithoutStore(t *testing.T) {
+	setupFakeQueue()
+	store = nil
+
+	rr := httptest.NewRecorder()
+	handleRequest(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got, want := rr.Code, http.StatusAccepted; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if location := rr.Header().Get("Location"); location != "" {
+		t.Errorf("got location %q, want none", location)
+	}
+
+	rr = httptest.NewRecorder()
+	handleStatus(rr, httptest.NewRequest(http.MethodGet, "/requests/123", nil))
+	if got, want := rr.Code, http.StatusNotImplemented; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestHandleResult(t *testing.T) {
+	setupFakeQueue()
+	ctx := context.Background()
+	store.Set(ctx, "queued", status.Queued, "")
+	store.Set(ctx, "failed", status.Failed, "no such host")
+	store.Set(ctx, "done", status.Succeeded, "")
+	store.SetResult(ctx, "done", &status.Result{
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{"Content-Type": []string{"text/plain"}},
+		Body:       []byte("created"),
+		Truncated:  true,
+	}, 0)
+
+	tests := []struct {
+		name       string
+		path       string
+		returncode int
+		header     map[string]string
+		body       string
+	}{{
+		name:       "pending request",
+		path:       "/requests/queued/result",
+		returncode: http.StatusTooEarly,
+		header:     map[string]string{"Retry-After": resultRetryAfter},
+	}, {
+		name:       "unknown request",
+		path:       "/requests/unknown/result",
+		returncode: http.StatusNotFound,
+	}, {
+		name:       "request without result",
+		path:       "/requests/failed/result",
+		returncode: http.StatusNotFound,
+	}, {
+		name:       "completed request",
+		path:       "/requests/done/result",
+		returncode: http.StatusCreated,
+		header: map[string]string{
+			"Content-Type":       "text/plain",
+			asyncTruncatedHeader: "true",
+		},
+		body: "created",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, test.path, nil)
+			rr := httptest.NewRecorder()
+			handleStatus(rr, request)
+
+			if got, want := rr.Code, test.returncode; got != want {
+				t.Errorf("got %d, want %d", got, want)
+			}
+			for k, v := range test.header {
+				if got := rr.Header().Get(k); got != v {
+					t.Errorf("got header %s %q, want %q", k, got, v)
+				}
+			}
+			if got := rr.Body.String(); got != test.body {
+				t.Errorf("got body %q, want %q", got, test.body)
+			}
+		})
+	}
+}
+
+func TestHandleDeadLetters(t *testing.T) {
+	hello := gouuidv6.NewFromTime(time.Date(2022, 11, 30, 12, 0, 0, 0, time.UTC)).String()
+	goodbye := gouuidv6.NewFromTime(time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)).String()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		returncode int
+		listed     []string
+		replayed   []string
+		next       bool
+		remaining  []string
+	}{{
+		name:       "list all",
+		method:     http.MethodGet,
+		path:       "/dead-letters/",
+		returncode: http.StatusOK,
+		listed:     []string{hello, goodbye, ""},
+		remaining:  []string{hello, goodbye, ""},
+	}, {
+		name:       "list by service",
+		method:     http.MethodGet,
+		path:       "/dead-letters/?service=goodbye.default",
+		returncode: http.StatusOK,
+		listed:     []string{goodbye},
+		remaining:  []string{hello, goodbye, ""},
+	}, {
+		name:       "list a page",
+		method:     http.MethodGet,
+		path:       "/dead-letters/?limit=2",
+		returncode: http.StatusOK,
+		listed:     []string{hello, goodbye},
+		next:       true,
+		remaining:  []string{hello, goodbye, ""},
+	}, {
+		name:       "list after a cursor",
+		method:     http.MethodGet,
+		path:       "/dead-letters/?after=1",
+		returncode: http.StatusOK,
+		listed:     []string{goodbye, ""},
+		remaining:  []string{hello, goodbye, ""},
+	}, {
+		name:       "invalid limit",
+		method:     http.MethodGet,
+		path:       "/dead-letters/?limit=none",
+		returncode: http.StatusBadRequest,
+		remaining:  []string{hello, goodbye, ""},
+	}, {
+		name:       "list without token",
+		method:     http.MethodGet,
+		path:       "/dead-letters/",
+		token:      "none",
+		returncode: http.StatusUnauthorized,
+		remaining:  []string{hello, goodbye, ""},
+	}, {
+		name:       "replay with wrong token",
+		method:     http.MethodPost,
+		path:       "/dead-letters/replay",
+		token:      "wrong",
+		returncode: http.StatusUnauthorized,
+		remaining:  []string{hello, goodbye, ""},
+	}, {
+		name:       "replay a page",
+		method:     http.MethodPost,
+		path:       "/dead-letters/replay?limit=1",
+		returncode: http.StatusOK,
+		replayed:   []string{hello},
+		next:       true,
+		remaining:  []string{goodbye, ""},
+	}, {
+		name:       "replay by id",
+		method:     http.MethodPost,
+		path:       "/dead-letters/replay?id=" + hello,
+		returncode: http.StatusOK,
+		replayed:   []string{hello},
+		remaining:  []string{goodbye, ""},
+	}, {
+		name:       "replay by time range",
+		method:     http.MethodPost,
+		path:       "/dead-letters/replay?from=2022-12-01T00:00:00Z&to=2022-12-02T00:00:00Z",
+		returncode: http.StatusOK,
+		replayed:   []string{goodbye},
+		remaining:  []string{hello, ""},
+	}, {
+		name:       "replay all keeps unreadable requests",
+		method:     http.MethodPost,
+		path:       "/dead-letters/replay",
+		returncode: http.StatusOK,
+		replayed:   []string{hello, goodbye},
+		remaining:  []string{""},
+	}, {
+		name:       "invalid time",
+		method:     http.MethodPost,
+		path:       "/dead-letters/replay?from=yesterday",
+		returncode: http.StatusBadRequest,
+		remaining:  []string{hello, goodbye, ""},
+	}, {
+		name:       "replay with get",
+		method:     http.MethodGet,
+		path:       "/dead-letters/replay",
+		returncode: http.StatusMethodNotAllowed,
+		remaining:  []string{hello, goodbye, ""},
+	}, {
+		name:       "unknown path",
+		method:     http.MethodGet,
+		path:       "/dead-letters/unknown",
+		returncode: http.StatusNotFound,
+		remaining:  []string{hello, goodbye, ""},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			setupFakeQueue()
+			env = envInfo{AdminToken: "s3cr3t"}
+			deadLetters = deadletter.NewMemoryStore()
+			deadLetters.Add(ctx, deadletter.Entry{ID: hello, Service: "hello.default.svc.cluster.local", Request: []byte(`{"id":"` + hello + `"}`)})
+			deadLetters.Add(ctx, deadletter.Entry{ID: goodbye, Service: "goodbye.default.svc.cluster.local", Request: []byte(`{"id":"` + goodbye + `"}`)})
+			deadLetters.Add(ctx, deadletter.Entry{Request: []byte(`"not json"`)})
+			defer func() { deadLetters = nil }()
+
+			req := httptest.NewRequest(test.method, test.path, nil)
+			switch test.token {
+			case "":
+				req.Header.Set("Authorization", "Bearer s3cr3t")
+			case "none":
+			default:
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			rr := httptest.NewRecorder()
+			handleDeadLetters(rr, req)
+			if got, want := rr.Code, test.returncode; got != want {
+				t.Fatalf("got %d, want %d", got, want)
+			}
+			if test.listed != nil {
+				resp := deadLettersResponse{}
+				if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("error unmarshalling response: %v", err)
+				}
+				listed := make([]string, 0, len(resp.Entries))
+				for _, entry := range resp.Entries {
+					listed = append(listed, entry.ID)
+				}
+				if diff := cmp.Diff(test.listed, listed); diff != "" {
+					t.Errorf("unexpected dead letters (-want, +got): %s", diff)
+				}
+				if got := resp.Next != ""; got != test.next {
+					t.Errorf("got next %q, want one %t", resp.Next, test.next)
+				}
+			}
+			if test.replayed != nil {
+				resp := replayResponse{}
+				if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("error unmarshalling response: %v", err)
+				}
+				if diff := cmp.Diff(test.replayed, resp.Replayed); diff != "" {
+					t.Errorf("unexpected replayed requests (-want, +got): %s", diff)
+				}
+				if got := resp.Next != ""; got != test.next {
+					t.Errorf("got next %q, want one %t", resp.Next, test.next)
+				}
+				for _, id := range test.replayed {
+					if st, _ := store.Get(ctx, id); st == nil || st.State != status.Queued {
+						t.Errorf("got status %v, want %q", st, status.Queued)
+					}
+				}
+			}
+			entries, _, _ := deadLetters.List(ctx, deadletter.Filter{}, "", 0)
+			remaining := make([]string, 0, len(entries))
+			for _, entry := range entries {
+				remaining = append(remaining, entry.ID)
+			}
+			if diff := cmp.Diff(test.remaining, remaining); diff != "" {
+				t.Errorf("unexpected remaining dead letters (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestHandleDeadLettersWithoutToken(t *testing.T) {
+	setupFakeQueue()
+	env = envInfo{}
+	deadLetters = deadletter.NewMemoryStore()
+	defer func() { deadLetters = nil }()
+
+	req := httptest.NewRequest(http.MethodGet, "/dead-letters/", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rr := httptest.NewRecorder()
+	handleDeadLetters(rr, req)
+	if got, want := rr.Code, http.StatusUnauthorized; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestHandleDeadLettersWithoutStore(t *testing.T) {
+	setupFakeQueue()
+	deadLetters = nil
+
+	rr := httptest.NewRecorder()
+	handleDeadLetters(rr, httptest.NewRequest(http.MethodGet, "/dead-letters/", nil))
+	if got, want := rr.Code, http.StatusNotImplemented; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestHandleRequestIdempotency(t *testing.T) {
+	setupFakeQueue()
+	fs := &flakyStore{Store: store}
+	store = fs
+	idempotencyKeys = idempotency.NewMemoryStore()
+	defer func() { idempotencyKeys = nil }()
+	env = envInfo{RequestSizeLimit: 100}
+
+	send := func(host, key, body string) (int, string) {
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		request.Header.Set(asyncOriginalHostHeader, host)
+		request.Header.Set(idempotencyKeyHeader, key)
+		rr := httptest.NewRecorder()
+		handleRequest(rr, request)
+		resp := acceptedResponse{}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr.Code, resp.ID
+	}
+
+	code, first := send("hello.default.svc.cluster.local", "abc", "body")
+	if code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", code, http.StatusAccepted)
+	}
+	publisher.(*fakeQueue).written = nil
+
+	tests := []struct {
+		name       string
+		host       string
+		key        string
+		body       string
+		statusDown bool
+		returncode int
+		sameID     bool
+		queued     bool
+	}{{
+		name:       "repeated request",
+		host:       "hello.default.svc.cluster.local",
+		key:        "abc",
+		body:       "body",
+		returncode: http.StatusAccepted,
+		sameID:     true,
+	}, {
+		name:       "repeated key with a different body",
+		host:       "hello.default.svc.cluster.local",
+		key:        "abc",
+		body:       "other body",
+		returncode: http.StatusUnprocessableEntity,
+	}, {
+		name:       "same key for another service",
+		host:       "goodbye.default.svc.cluster.local",
+		key:        "abc",
+		body:       "body",
+		returncode: http.StatusAccepted,
+		queued:     true,
+	}, {
+		name:       "failed request can be repeated",
+		host:       "hello.default.svc.cluster.local",
+		key:        "def",
+		body:       "failure",
+		returncode: http.StatusInternalServerError,
+	}, {
+		name:       "repeated failed request",
+		host:       "hello.default.svc.cluster.local",
+		key:        "def",
+		body:       "failure",
+		returncode: http.StatusInternalServerError,
+	}, {
+		name:       "request whose status can't be recorded",
+		host:       "hello.default.svc.cluster.local",
+		key:        "ghi",
+		body:       "body",
+		statusDown: true,
+		returncode: http.StatusInternalServerError,
+	}, {
+		name:       "repeated request whose status couldn't be recorded",
+		host:       "hello.default.svc.cluster.local",
+		key:        "ghi",
+		body:       "body",
+		returncode: http.StatusAccepted,
+		queued:     true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			publisher.(*fakeQueue).written = nil
+			fs.down = test.statusDown
+			code, id := send(test.host, test.key, test.body)
+			if code != test.returncode {
+				t.Errorf("got %d, want %d", code, test.returncode)
+			}
+			if test.sameID && id != first {
+				t.Errorf("got id %q, want %q", id, first)
+			}
+			if queued := publisher.(*fakeQueue).written != nil; queued != test.queued {
+				t.Errorf("got queued %v, want %v", queued, test.queued)
+			}
+		})
+	}
+}
+
+func TestHandleRequestQueueFull(t *testing.T) {
+	setupFakeQueue()
+	fs := &flakyStore{Store: store}
+	store = fs
+	depths = depth.NewMemoryCounter()
+	defer func() { depths = nil }()
+	env = envInfo{
+		RequestSizeLimit:     100,
+		MaxQueueDepth:        3,
+		MaxServiceQueueDepth: 2,
+		QueueFullRetryAfter:  30 * time.Second,
+	}
+
+	tests := []struct {
+		name       string
+		host       string
+		body       string
+		statusDown bool
+		returncode int
+	}{{
+		name:       "first request",
+		host:       "hello.default.svc.cluster.local",
+		returncode: http.StatusAccepted,
+	}, {
+		name:       "failed request isn't counted",
+		host:       "hello.default.svc.cluster.local",
+		body:       "failure",
+		returncode: http.StatusInternalServerError,
+	}, {
+		name:       "request whose status can't be recorded isn't counted",
+		host:       "hello.default.svc.cluster.local",
+		statusDown: true,
+		returncode: http.StatusInternalServerError,
+	}, {
+		name:       "second request",
+		host:       "hello.default.svc.cluster.local",
+		returncode: http.StatusAccepted,
+	}, {
+		name:       "service queue full",
+		host:       "hello.default.svc.cluster.local",
+		returncode: http.StatusServiceUnavailable,
+	}, {
+		name:       "other service",
+		host:       "goodbye.default.svc.cluster.local",
+		returncode: http.StatusAccepted,
+	}, {
+		name:       "queue full",
+		host:       "goodbye.default.svc.cluster.local",
+		returncode: http.StatusServiceUnavailable,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+			request.Header.Set(asyncOriginalHostHeader, test.host)
+			fs.down = test.statusDown
+			rr := httptest.NewRecorder()
+			handleRequest(rr, request)
+			if rr.Code != test.returncode {
+				t.Errorf("got %d, want %d", rr.Code, test.returncode)
+			}
+			if rr.Code == http.StatusServiceUnavailable && rr.Header().Get("Retry-After") != "30" {
+				t.Errorf("got Retry-After %q, want %q", rr.Header().Get("Retry-After"), "30")
+			}
+		})
+	}
+
+	all, err := depths.All(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]int64{"hello.default.svc.cluster.local": 2, "goodbye.default.svc.cluster.local": 1}
+	if diff := cmp.Diff(want, all); diff != "" {
+		t.Errorf("unexpected depths (-want, +got): %s", diff)
+	}
 }
@@ -0,0 +1,113 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"knative.dev/async-component/pkg/depth"
+	"knative.dev/async-component/pkg/queue"
+)
+
+var (
+	// queueDepth counts the requests queued and not finished yet.
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "async",
+		Name:      "queue_depth",
+		Help:      "Requests queued and not finished yet, by service.",
+	}, []string{"service"})
+	queueDepthTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "async",
+		Name:      "queue_depth_total",
+		Help:      "Requests queued and not finished yet, for all services.",
+	})
+	// streamLength counts the entries of the Redis stream, which includes
+	// acknowledged entries that haven't been trimmed yet.
+	streamLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "async",
+		Name:      "stream_length",
+		Help:      "Entries in the Redis stream requests are queued in.",
+	})
+	rejectedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "async",
+		Name:      "requests_rejected_total",
+		Help:      "Requests turned away because the queue was full, by service.",
+	}, []string{"service"})
+)
+
+func init() {
+	prometheus.MustRegister(queueDepth, queueDepthTotal, streamLength, rejectedRequests)
+}
+
+// observeDepth records the depth of the queue after a request for the service
+// was counted.
+func observeDepth(service string, d depth.Depth) {
+	queueDepth.WithLabelValues(service).Set(float64(d.Service))
+	queueDepthTotal.Set(float64(d.Total))
+}
+
+// watchQueue trims acknowledged entries from the stream, if there is one, and
+// refreshes the depth metrics every interval, so they follow requests being
+// finished by the consumer too.
+func watchQueue(ctx context.Context, stream *queue.Redis, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if stream != nil {
+			length, err := stream.TrimAcknowledged(ctx)
+			if err != nil {
+				log.Println("Error trimming queue ", err)
+			} else {
+				streamLength.Set(float64(length))
+			}
+		}
+		if depths != nil {
+			refreshDepth(ctx)
+		}
+	}
+}
+
+// refreshDepth sets the depth metrics to the counted depth of every service.
+func refreshDepth(ctx context.Context) {
+	all, err := depths.All(ctx)
+	if err != nil {
+		log.Println("Error reading queue depth ", err)
+		return
+	}
+	queueDepth.Reset()
+	total := int64(0)
+	for service, n := range all {
+		queueDepth.WithLabelValues(service).Set(float64(n))
+		total += n
+	}
+	queueDepthTotal.Set(float64(total))
+}
+
+// serveMetrics serves the metrics of the producer on the given port.
+func serveMetrics(port string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Fatal(http.ListenAndServe(":"+port, mux))
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"knative.dev/async-component/pkg/compression"
+)
+
+// redacted replaces values that aren't shown when listing dead letters.
+const redacted = "[redacted]"
+
+// sensitiveHeaders are the request headers whose values aren't shown when
+// listing dead letters.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+// redactRequest returns the JSON of a dead-lettered request without the
+// values of sensitive headers, its callback secret and its body. Compressed
+// requests are shown uncompressed, while encrypted requests and requests that
+// couldn't be read are shown as they are.
+func redactRequest(data json.RawMessage) json.RawMessage {
+	compressed := compressedData{}
+	if err := json.Unmarshal(data, &compressed); err == nil && compressed.Compression != "" {
+		decompressed, err := compression.Decompress(compressed.Compression, compressed.Payload)
+		if err != nil {
+			return data
+		}
+		data = decompressed
+	}
+	// The request is changed as JSON, so fields this producer doesn't know
+	// about are kept.
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return data
+	}
+	if _, ok := fields["keyID"]; ok {
+		return data
+	}
+	if raw, ok := fields["header"]; ok {
+		header := http.Header{}
+		if err := json.Unmarshal(raw, &header); err == nil {
+			for key := range header {
+				if isSensitiveHeader(key) {
+					header[key] = []string{redacted}
+				}
+			}
+			fields["header"], _ = json.Marshal(header)
+		}
+	}
+	for _, field := range []string{"body", "callbackSecret"} {
+		if raw, ok := fields[field]; ok && string(raw) != `""` {
+			fields[field], _ = json.Marshal(redacted)
+		}
+	}
+	delete(fields, "bodyEncoding")
+	redactedData, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return redactedData
+}
+
+func isSensitiveHeader(key string) bool {
+	for _, header := range sensitiveHeaders {
+		if http.CanonicalHeaderKey(key) == header {
+			return true
+		}
+	}
+	return false
+}
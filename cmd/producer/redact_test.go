@@ -0,0 +1,69 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"knative.dev/async-component/pkg/compression"
+)
+
+func TestRedactRequest(t *testing.T) {
+	plain := `{"id":"123","body":"card=4111","bodyEncoding":"base64","callbackSecret":"s3cr3t",` +
+		`"header":{"Authorization":["Bearer abc"],"Cookie":["session=1"],"Content-Type":["text/plain"]},"future":1}`
+	want := `{"body":"[redacted]","callbackSecret":"[redacted]","future":1,` +
+		`"header":{"Authorization":["[redacted]"],"Content-Type":["text/plain"],"Cookie":["[redacted]"]},"id":"123"}`
+	payload, err := compression.Compress(compression.Gzip, []byte(plain))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	compressed, _ := json.Marshal(compressedData{Version: compressedVersion, ID: "123", Compression: compression.Gzip, Payload: payload})
+
+	tests := []struct {
+		name    string
+		request string
+		want    string
+	}{{
+		name:    "plain",
+		request: plain,
+		want:    want,
+	}, {
+		name:    "compressed",
+		request: string(compressed),
+		want:    want,
+	}, {
+		name:    "body in the body store",
+		request: `{"id":"123","body":"","bodyRef":"123"}`,
+		want:    `{"body":"","bodyRef":"123","id":"123"}`,
+	}, {
+		name:    "encrypted",
+		request: `{"id":"123","keyID":"k1","payload":"c2VhbGVk"}`,
+		want:    `{"id":"123","keyID":"k1","payload":"c2VhbGVk"}`,
+	}, {
+		name:    "unreadable",
+		request: `"not json"`,
+		want:    `"not json"`,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := redactRequest(json.RawMessage(test.request))
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("unexpected request (-want, +got): %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/schedule"
+	"knative.dev/async-component/pkg/status"
+)
+
+const (
+	// scheduleBatch is the number of due requests taken from the schedule at
+	// a time.
+	scheduleBatch = 100
+	// scheduleLease is how long requests taken from the schedule are held by
+	// the producer that took them, before they are due again. Requests that
+	// couldn't be queued are tried again after it.
+	scheduleLease = time.Minute
+)
+
+// watchSchedule queues scheduled requests once they are due, looking for due
+// requests every interval until ctx is done.
+func watchSchedule(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// A round isn't cut short by shutdown, so that requests taken from
+		// the schedule are queued or put back.
+		queueDue(context.Background())
+	}
+}
+
+// queueDue queues all requests that are due, and removes them from the
+// schedule once they are queued. Requests that can't be queued are left for
+// their lease to pass. A producer that dies while queueing requests leaves
+// them to be taken again as well, so a request may be queued twice, but it is
+// never lost.
+func queueDue(ctx context.Context) {
+	for {
+		entries, err := scheduled.TakeDue(ctx, now(), scheduleBatch, scheduleLease)
+		if err != nil {
+			log.Println("Error reading scheduled requests ", err)
+		}
+		failed := false
+		for _, entry := range entries {
+			if err := queueScheduled(ctx, entry); err != nil {
+				log.Println("Error queueing scheduled request ", err)
+				failed = true
+			}
+		}
+		if err != nil || failed || len(entries) < scheduleBatch {
+			return
+		}
+	}
+}
+
+// queueScheduled writes a request that is due to the queue and removes it
+// from the schedule, or drops it if it was cancelled in the meantime. The
+// request counts towards the depth of the queue from then on, regardless of
+// the depth limits. Requests taken again after failing to be written are
+// already recorded as queued and counted.
+func queueScheduled(ctx context.Context, entry schedule.Entry) error {
+	if store != nil {
+		st, err := store.Transition(ctx, entry.ID, []status.State{status.Scheduled, status.Queued}, status.Queued, "")
+		if errors.Is(err, status.ErrConflict) {
+			log.Printf("Dropping scheduled request that is %s", st.State)
+			// Cancelling a request removes it from the schedule too, and
+			// only the one that removes it discards it.
+			removed, err := scheduled.Done(ctx, entry)
+			if removed {
+				release(ctx, entry.ID, entry.Service)
+				// Bodies in the body store are kept under the request ID.
+				discardBody(ctx, entry.ID)
+			}
+			return err
+		} else if errors.Is(err, status.ErrNotFound) {
+			// The status has expired, which doesn't stop the request.
+			st, err = nil, store.Set(ctx, entry.ID, status.Queued, "")
+		}
+		if err != nil {
+			return err
+		}
+		if st == nil || !st.Reserved {
+			count(ctx, entry.ID, entry.Service)
+		}
+	}
+	if err := publish(ctx, queue.Message{ID: entry.ID, Data: entry.Request, Service: entry.Service, Priority: entry.Priority}); err != nil {
+		return err
+	}
+	if _, err := scheduled.Done(ctx, entry); err != nil {
+		log.Println("Error removing queued request from the schedule ", err)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bradleypeabody/gouuidv6"
+	"github.com/google/go-cmp/cmp"
+
+	"knative.dev/async-component/pkg/deadline"
+	"knative.dev/async-component/pkg/depth"
+	"knative.dev/async-component/pkg/schedule"
+	"knative.dev/async-component/pkg/status"
+)
+
+func TestHandleRequestScheduled(t *testing.T) {
+	received := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return received }
+	defer func() { now = time.Now }()
+	setupFakeQueue()
+	env = envInfo{RequestSizeLimit: 100}
+
+	send := func(header map[string]string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/", nil)
+		request.Header.Set(asyncOriginalHostHeader, "hello.default.svc.cluster.local")
+		for k, v := range header {
+			request.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		handleRequest(rr, request)
+		return rr
+	}
+
+	// Requests can only be scheduled with Redis.
+	scheduled = nil
+	if rr := send(map[string]string{schedule.DelayHeader: "1h"}); rr.Code != http.StatusNotImplemented {
+		t.Errorf("got %d, want %d", rr.Code, http.StatusNotImplemented)
+	}
+
+	scheduled = schedule.NewMemoryStore()
+	defer func() { scheduled = nil }()
+	if rr := send(map[string]string{schedule.NotBeforeHeader: "tomorrow"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("got %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	rr := send(map[string]string{schedule.DelayHeader: "1h", deadline.DeadlineHeader: "10m"})
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	resp := acceptedResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("error unmarshalling response: %v", err)
+	}
+	due := received.Add(time.Hour)
+	id, err := gouuidv6.Parse(resp.ID)
+	if err != nil || !id.Time().Equal(due) {
+		t.Errorf("got ID %s for %v, want one for %v", resp.ID, id.Time(), due)
+	}
+	if st, _ := store.Get(context.Background(), resp.ID); st == nil || st.State != status.Scheduled {
+		t.Errorf("got status %v, want %q", st, status.Scheduled)
+	}
+	if publisher.(*fakeQueue).written != nil {
+		t.Errorf("expected the request to be held back")
+	}
+
+	// Nothing is queued before the request is due.
+	queueDue(context.Background())
+	if publisher.(*fakeQueue).written != nil {
+		t.Errorf("expected the request to be held back")
+	}
+
+	received = due
+	queueDue(context.Background())
+	reqData := requestData{}
+	if err := json.Unmarshal(publisher.(*fakeQueue).written, &reqData); err != nil {
+		t.Fatalf("error unmarshalling queued request: %v", err)
+	}
+	if reqData.ID != resp.ID {
+		t.Errorf("got request %q, want %q", reqData.ID, resp.ID)
+	}
+	// The deadline counts from when the request is due.
+	if want := due.Add(10 * time.Minute); reqData.Expires == nil || !reqData.Expires.Equal(want) {
+		t.Errorf("got expiry %v, want %v", reqData.Expires, want)
+	}
+	if _, ok := reqData.ReqHeader[schedule.DelayHeader]; ok {
+		t.Errorf("expected schedule headers to be removed from the request headers")
+	}
+	if st, _ := store.Get(context.Background(), resp.ID); st == nil || st.State != status.Queued {
+		t.Errorf("got status %v, want %q", st, status.Queued)
+	}
+
+	// Requests cancelled before they are due are never queued.
+	publisher.(*fakeQueue).written = nil
+	rr = send(map[string]string{schedule.DelayHeader: "1h"})
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("error unmarshalling response: %v", err)
+	}
+	rr = httptest.NewRecorder()
+	handleStatus(rr, httptest.NewRequest(http.MethodDelete, requestsPath+resp.ID, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusOK)
+	}
+	received = received.Add(time.Hour)
+	queueDue(context.Background())
+	if publisher.(*fakeQueue).written != nil {
+		t.Errorf("expected the cancelled request to be dropped")
+	}
+	if st, _ := store.Get(context.Background(), resp.ID); st == nil || st.State != status.Cancelled {
+		t.Errorf("got status %v, want %q", st, status.Cancelled)
+	}
+}
+
+func TestQueueDueRetries(t *testing.T) {
+	due := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	current := due
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+	fq := &flakyQueue{down: true}
+	publisher, store = fq, status.NewMemoryStore()
+	scheduled = schedule.NewMemoryStore()
+	depths = depth.NewMemoryCounter()
+	defer func() { scheduled, depths = nil, nil }()
+	ctx := context.Background()
+	const host = "hello.default.svc.cluster.local"
+	store.Set(ctx, "123", status.Scheduled, "")
+	scheduled.Add(ctx, schedule.Entry{ID: "123", Due: due, Service: host, Request: json.RawMessage(`{"id":"123"}`)})
+	if all, _ := depths.All(ctx); len(all) != 0 {
+		t.Errorf("got depths %v, want scheduled requests not counted", all)
+	}
+
+	// A request that can't be queued is left in the schedule, and not taken
+	// again until its lease has passed.
+	queueDue(ctx)
+	fq.down = false
+	queueDue(ctx)
+	if len(fq.written) != 0 {
+		t.Errorf("got %v queued, want nothing while the request is leased", fq.written)
+	}
+
+	current = current.Add(scheduleLease)
+	queueDue(ctx)
+	if diff := cmp.Diff([]string{"123"}, fq.written); diff != "" {
+		t.Errorf("unexpected requests queued (-want, +got): %s", diff)
+	}
+	if st, _ := store.Get(ctx, "123"); st == nil || st.State != status.Queued || !st.Reserved {
+		t.Errorf("got status %v, want %q and counted", st, status.Queued)
+	}
+	// The request is counted once it is queued, however often it is taken.
+	if all, _ := depths.All(ctx); all[host] != 1 {
+		t.Errorf("got depths %v, want the request counted once", all)
+	}
+
+	// Once queued, it is removed from the schedule.
+	current = current.Add(scheduleLease)
+	queueDue(ctx)
+	if len(fq.written) != 1 {
+		t.Errorf("got %v queued, want the request queued once", fq.written)
+	}
+}
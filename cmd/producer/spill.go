@@ -0,0 +1,178 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/spill"
+	"knative.dev/async-component/pkg/status"
+)
+
+// expiredReason is recorded with spilled requests that weren't queued in
+// time.
+const expiredReason = "expired in the spill buffer"
+
+var (
+	spilledRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "async",
+		Name:      "spilled_requests_total",
+		Help:      "Requests kept on local disk because the queue couldn't be written to.",
+	})
+	replayedSpilledRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "async",
+		Name:      "spill_replayed_total",
+		Help:      "Spilled requests written to the queue once it recovered.",
+	})
+	droppedSpilledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "async",
+		Name:      "spill_dropped_total",
+		Help:      "Requests that couldn't be kept on local disk or were kept too long, by reason.",
+	}, []string{"reason"})
+	spillLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "async",
+		Name:      "spill_length",
+		Help:      "Requests kept on local disk waiting for the queue.",
+	})
+	spillBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "async",
+		Name:      "spill_bytes",
+		Help:      "Bytes of local disk taken by spilled requests.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(spilledRequests, replayedSpilledRequests, droppedSpilledRequests, spillLength, spillBytes)
+}
+
+// enqueue writes the message to the queue. With a spill buffer, the message
+// is kept there instead if the queue can't be written to, or if requests are
+// waiting there already so that it doesn't overtake them.
+func enqueue(ctx context.Context, msg queue.Message) error {
+	if buffer == nil {
+		return publish(ctx, msg)
+	}
+	if buffer.Len() == 0 {
+		err := publish(ctx, msg)
+		if err == nil {
+			return nil
+		}
+		log.Println("Error writing request to the queue, spilling it ", err)
+	}
+	return spillRequest(msg)
+}
+
+// spillRequest keeps the message in the spill buffer until the queue can be
+// written to.
+func spillRequest(msg queue.Message) error {
+	err := buffer.Add(spill.Entry{ID: msg.ID, Data: msg.Data, Service: msg.Service, Priority: msg.Priority, Added: now()})
+	spillHealth.record(err)
+	if errors.Is(err, spill.ErrFull) {
+		droppedSpilledRequests.WithLabelValues("full").Inc()
+	} else if err == nil {
+		spilledRequests.Inc()
+	}
+	observeSpill()
+	return err
+}
+
+// watchSpill writes spilled requests to the queue every interval until ctx is
+// done.
+func watchSpill(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		replaySpilled(ctx)
+	}
+}
+
+// replaySpilled writes spilled requests to the queue in the order they were
+// spilled, until the queue can't be written to. Requests kept longer than
+// SpillMaxAge are dropped and recorded as failed, as are those cancelled in
+// the meantime.
+func replaySpilled(ctx context.Context) {
+	if buffer.Len() == 0 {
+		return
+	}
+	n, err := buffer.Replay(ctx, replaySpilledRequest)
+	if err != nil {
+		log.Printf("Error replaying spilled requests after %d of them: %v", n, err)
+	} else {
+		log.Printf("Replayed %d spilled requests", n)
+	}
+	observeSpill()
+}
+
+// replaySpilledRequest writes a spilled request to the queue, recording it as
+// queued and counted. Requests are spilled without a status when it couldn't
+// be recorded.
+func replaySpilledRequest(ctx context.Context, entry spill.Entry) error {
+	if env.SpillMaxAge > 0 && now().Sub(entry.Added) > env.SpillMaxAge {
+		log.Println("Dropping spilled request that expired")
+		if store != nil {
+			_, err := store.Transition(ctx, entry.ID, []status.State{status.Queued}, status.Failed, expiredReason)
+			if errors.Is(err, status.ErrNotFound) {
+				err = store.Set(ctx, entry.ID, status.Failed, expiredReason)
+			}
+			if err != nil && !errors.Is(err, status.ErrConflict) {
+				return err
+			}
+		}
+		droppedSpilledRequests.WithLabelValues("expired").Inc()
+		release(ctx, entry.ID, entry.Service)
+		discardBody(ctx, entry.ID)
+		return nil
+	}
+	if store != nil {
+		st, err := store.Transition(ctx, entry.ID, []status.State{status.Queued}, status.Queued, "")
+		if errors.Is(err, status.ErrConflict) {
+			log.Printf("Dropping spilled request that is %s", st.State)
+			release(ctx, entry.ID, entry.Service)
+			discardBody(ctx, entry.ID)
+			return nil
+		} else if errors.Is(err, status.ErrNotFound) {
+			st, err = nil, store.Set(ctx, entry.ID, status.Queued, "")
+		}
+		if err != nil {
+			return err
+		}
+		// Requests spilled without a status weren't counted, unlike those
+		// spilled because the queue couldn't be written to.
+		if st == nil || !st.Reserved {
+			count(ctx, entry.ID, entry.Service)
+		}
+	}
+	if err := publish(ctx, entry.Message()); err != nil {
+		return err
+	}
+	replayedSpilledRequests.Inc()
+	return nil
+}
+
+// observeSpill records the size of the spill buffer.
+func observeSpill() {
+	spillLength.Set(float64(buffer.Len()))
+	spillBytes.Set(float64(buffer.Size()))
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"knative.dev/async-component/pkg/queue"
+	"knative.dev/async-component/pkg/spill"
+	"knative.dev/async-component/pkg/status"
+)
+
+// flakyQueue fails to publish while it is down.
+type flakyQueue struct {
+	down    bool
+	written []string
+}
+
+func (fq *flakyQueue) Publish(ctx context.Context, msg queue.Message) error {
+	if fq.down {
+		return errors.New("connection refused")
+	}
+	fq.written = append(fq.written, msg.ID)
+	return nil
+}
+
+// flakyStore fails to record status while it is down.
+type flakyStore struct {
+	status.Store
+	down bool
+}
+
+func (fs *flakyStore) Set(ctx context.Context, id string, state status.State, reason string) error {
+	if fs.down {
+		return errors.New("connection refused")
+	}
+	return fs.Store.Set(ctx, id, state, reason)
+}
+
+func (fs *flakyStore) Transition(ctx context.Context, id string, from []status.State, to status.State, reason string) (*status.Status, error) {
+	if fs.down {
+		return nil, errors.New("connection refused")
+	}
+	return fs.Store.Transition(ctx, id, from, to, reason)
+}
+
+func setupSpill(t *testing.T) (*flakyQueue, *flakyStore) {
+	t.Helper()
+	var err error
+	buffer, err = spill.Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fq := &flakyQueue{}
+	fs := &flakyStore{Store: status.NewMemoryStore()}
+	publisher, store = fq, fs
+	env.RequestSizeLimit = 6000000
+	env.SpillMaxAge = time.Hour
+	env.WriteFailureWindow = time.Minute
+	t.Cleanup(func() {
+		buffer = nil
+		queueHealth = &writeHealth{name: "the queue"}
+		spillHealth = &writeHealth{name: "the spill buffer"}
+	})
+	return fq, fs
+}
+
+// postRequest sends a request to the producer and returns its ID.
+func postRequest(t *testing.T) string {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	handleRequest(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello")))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("returned %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	accepted := acceptedResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &accepted); err != nil {
+		t.Fatal(err)
+	}
+	return accepted.ID
+}
+
+func TestHandleRequestSpilled(t *testing.T) {
+	fq, fs := setupSpill(t)
+	ctx := context.Background()
+
+	// Requests are spilled while the queue is down, and while others are
+	// waiting in the spill buffer.
+	fq.down = true
+	ids := []string{postRequest(t), postRequest(t)}
+	fq.down = false
+	ids = append(ids, postRequest(t))
+	// Or while their status can't be recorded.
+	fs.down = true
+	ids = append(ids, postRequest(t))
+	if buffer.Len() != 4 || len(fq.written) != 0 {
+		t.Errorf("got %d spilled and %d queued requests, want 4 and 0", buffer.Len(), len(fq.written))
+	}
+
+	rr := httptest.NewRecorder()
+	handleReady(rr, httptest.NewRequest(http.MethodGet, readyPath, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("readiness while spilling returned %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	// Nothing is replayed while the status store is down.
+	replaySpilled(ctx)
+	if buffer.Len() != 4 {
+		t.Errorf("got %d spilled requests, want 4", buffer.Len())
+	}
+
+	fs.down = false
+	replaySpilled(ctx)
+	if diff := cmp.Diff(ids, fq.written); diff != "" {
+		t.Errorf("unexpected queued requests (-want, +got): %s", diff)
+	}
+	if buffer.Len() != 0 {
+		t.Errorf("got %d spilled requests after replaying, want 0", buffer.Len())
+	}
+	for _, id := range ids {
+		if st, err := store.Get(ctx, id); err != nil || st.State != status.Queued {
+			t.Errorf("status of %s = %v, %v, want %s", id, st, err, status.Queued)
+		}
+	}
+}
+
+func TestHandleRequestSpillFull(t *testing.T) {
+	fq, _ := setupSpill(t)
+	var err error
+	buffer, err = spill.Open(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fq.down = true
+	rr := httptest.NewRecorder()
+	handleRequest(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello")))
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("returned %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+
+	rr = httptest.NewRecorder()
+	handleReady(rr, httptest.NewRequest(http.MethodGet, readyPath, nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("readiness with a full spill buffer returned %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestReplaySpilledDropped(t *testing.T) {
+	fq, _ := setupSpill(t)
+	spilledAt := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	defer func() { now = time.Now }()
+	now = func() time.Time { return spilledAt }
+	ctx := context.Background()
+
+	for _, id := range []string{"expired", "cancelled", "queued"} {
+		store.Set(ctx, id, status.Queued, "")
+	}
+	store.Set(ctx, "cancelled", status.Cancelled, cancelledReason)
+	for _, id := range []string{"expired", "cancelled", "queued"} {
+		if err := spillRequest(queue.Message{ID: id, Data: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+		if id == "expired" {
+			now = func() time.Time { return spilledAt.Add(time.Hour) }
+		}
+	}
+	now = func() time.Time { return spilledAt.Add(time.Hour + time.Second) }
+
+	replaySpilled(ctx)
+	if diff := cmp.Diff([]string{"queued"}, fq.written); diff != "" {
+		t.Errorf("unexpected queued requests (-want, +got): %s", diff)
+	}
+	for id, want := range map[string]status.State{
+		"expired":   status.Failed,
+		"cancelled": status.Cancelled,
+		"queued":    status.Queued,
+	} {
+		if st, err := store.Get(ctx, id); err != nil || st.State != want {
+			t.Errorf("status of %s = %v, %v, want %s", id, st, err, want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package claimcheck keeps request bodies that are too big for the queue in an
+// object store, so only a reference to them is queued.
+package claimcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Supported body store backends.
+const (
+	BackendS3   = "s3"
+	BackendFile = "file"
+)
+
+// ErrNotFound is returned when no body is kept under a key.
+var ErrNotFound = errors.New("body not found")
+
+// Store keeps request bodies under keys, which are request IDs.
+type Store interface {
+	// Put writes body under key. A size of -1 reads body until it ends.
+	Put(ctx context.Context, key string, body io.Reader, size int64) error
+	// Get returns the body kept under key, which the caller has to close.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the body kept under key, if there is one.
+	Delete(ctx context.Context, key string) error
+}
+
+// Config selects and configures the body store.
+type Config struct {
+	// Backend is where bodies are kept. Bodies always go on the queue if it
+	// is empty.
+	Backend string `envconfig:"CLAIM_CHECK_BACKEND"`
+	// Threshold is the size in bytes above which bodies are kept in the
+	// store instead of on the queue.
+	Threshold int64 `envconfig:"CLAIM_CHECK_THRESHOLD" default:"1048576"`
+	// SizeLimit caps the size of bodies kept in the store, and takes the
+	// place of REQUEST_SIZE_LIMIT in the producer.
+	SizeLimit int64 `envconfig:"CLAIM_CHECK_SIZE_LIMIT" default:"1073741824"`
+
+	// S3Endpoint is the host, and optionally port, of an S3 compatible
+	// object store. Without an access key, credentials are taken from the
+	// AWS environment variables or the instance metadata.
+	S3Endpoint  string `envconfig:"CLAIM_CHECK_S3_ENDPOINT" default:"s3.amazonaws.com"`
+	S3Bucket    string `envconfig:"CLAIM_CHECK_S3_BUCKET"`
+	S3Prefix    string `envconfig:"CLAIM_CHECK_S3_PREFIX" default:"async/"`
+	S3Region    string `envconfig:"CLAIM_CHECK_S3_REGION"`
+	S3AccessKey string `envconfig:"CLAIM_CHECK_S3_ACCESS_KEY"`
+	S3SecretKey string `envconfig:"CLAIM_CHECK_S3_SECRET_KEY"`
+	// S3Insecure talks to the object store over plain HTTP, as a MinIO
+	// running next to the component might.
+	S3Insecure bool `envconfig:"CLAIM_CHECK_S3_INSECURE"`
+
+	Dir string `envconfig:"CLAIM_CHECK_DIR" default:"/var/run/async/bodies"`
+}
+
+// New creates a Store for the configured backend, or returns nil if no
+// backend is configured.
+func New(cfg Config) (Store, error) {
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case BackendS3:
+		s, err := NewS3(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case BackendFile:
+		f, err := NewFile(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown claim check backend %q", cfg.Backend)
+}
+
+// validKey reports whether key can be used as a file or object name as is.
+func validKey(key string) bool {
+	return key != "" && key != "." && key != ".." && !strings.ContainsAny(key, `/\`)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package claimcheck
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    bool
+		wantErr bool
+	}{{
+		name: "disabled",
+	}, {
+		name: "file",
+		cfg:  Config{Backend: BackendFile, Dir: t.TempDir()},
+		want: true,
+	}, {
+		name:    "s3 without bucket",
+		cfg:     Config{Backend: BackendS3, S3Endpoint: "localhost:9000"},
+		wantErr: true,
+	}, {
+		name: "s3",
+		cfg:  Config{Backend: BackendS3, S3Endpoint: "localhost:9000", S3Bucket: "bodies", S3AccessKey: "key", S3SecretKey: "secret"},
+		want: true,
+	}, {
+		name:    "unknown backend",
+		cfg:     Config{Backend: "ftp"},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, err := New(test.cfg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if got := store != nil; got != test.want {
+				t.Errorf("got store %v, want one %v", store, test.want)
+			}
+		})
+	}
+}
+
+func TestFile(t *testing.T) {
+	store, err := NewFile(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	body := []byte{0x1f, 0x8b, 0x00, 0xff}
+
+	if _, err := store.Get(ctx, "123"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+	if err := store.Put(ctx, "123", bytes.NewReader(body), -1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r, err := store.Get(ctx, "123")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, body) {
+		t.Errorf("got body %v (%v), want %v", got, err, body)
+	}
+
+	if err := store.Delete(ctx, "123"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := store.Get(ctx, "123"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v after delete, want %v", err, ErrNotFound)
+	}
+	if err := store.Delete(ctx, "123"); err != nil {
+		t.Errorf("got %v deleting a missing body, want none", err)
+	}
+
+	for _, key := range []string{"", "..", "../123", `a\b`} {
+		if err := store.Put(ctx, key, bytes.NewReader(body), -1); err == nil {
+			t.Errorf("expected key %q to be rejected", key)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package claimcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// File keeps bodies as files in a directory. It stands in for an object store
+// when the producer and consumer share a volume.
+type File struct {
+	dir string
+}
+
+// NewFile creates a File store keeping bodies in dir, which is created if it
+// doesn't exist.
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create body directory %q: %w", dir, err)
+	}
+	return &File{dir: dir}, nil
+}
+
+func (f *File) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", fmt.Errorf("invalid body key %q", key)
+	}
+	return filepath.Join(f.dir, key), nil
+}
+
+// Put writes body to a file named after key. The file only appears once it
+// is complete.
+func (f *File) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(f.dir, "."+key+"-")
+	if err != nil {
+		return fmt.Errorf("failed to write body %q: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write body %q: %w", key, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write body %q: %w", key, err)
+	}
+	return nil
+}
+
+// Get opens the file kept under key.
+func (f *File) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read body %q: %w", key, err)
+	}
+	return file, nil
+}
+
+// Delete removes the file kept under key.
+func (f *File) Delete(ctx context.Context, key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete body %q: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package claimcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// partSize is the size of the parts bodies of unknown size are uploaded in,
+// which are buffered in memory. It allows for bodies of up to 160GiB.
+const partSize = 16 << 20
+
+// S3 keeps bodies as objects in a bucket of an S3 compatible object store,
+// such as AWS S3 or MinIO.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 creates an S3 store for the configured bucket.
+func NewS3(cfg Config) (*S3, error) {
+	if cfg.S3Bucket == "" {
+		return nil, errors.New("s3 claim check backend needs a bucket")
+	}
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.IAM{},
+	})
+	if cfg.S3AccessKey != "" {
+		creds = credentials.NewStaticV4(cfg.S3AccessKey, cfg.S3SecretKey, "")
+	}
+	client, err := minio.New(cfg.S3Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !cfg.S3Insecure,
+		Region: cfg.S3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create object store client: %w", err)
+	}
+	return &S3{
+		client: client,
+		bucket: cfg.S3Bucket,
+		prefix: cfg.S3Prefix,
+	}, nil
+}
+
+func (s *S3) object(key string) (string, error) {
+	if !validKey(key) {
+		return "", fmt.Errorf("invalid body key %q", key)
+	}
+	return s.prefix + key, nil
+}
+
+// Put uploads body as the object for key. Bodies of unknown size are
+// uploaded in parts.
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	object, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, s.bucket, object, body, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    partSize,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write body %q: %w", key, err)
+	}
+	return nil
+}
+
+// Get streams the object for key.
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := s.object(key)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, object, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body %q: %w", key, err)
+	}
+	// Objects are only requested once they are read from, so look them up
+	// first to tell missing ones apart.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to read body %q: %w", key, err)
+	}
+	return obj, nil
+}
+
+// Delete removes the object for key.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	object, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	if err := s.client.RemoveObject(ctx, s.bucket, object, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to delete body %q: %w", key, err)
+	}
+	return nil
+}
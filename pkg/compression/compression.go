@@ -0,0 +1,86 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package compression compresses queued requests with the algorithms both the
+// producer and the consumer know.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported compression algorithms.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// The zstd encoder and decoder are safe to share when used for whole
+// buffers at once.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Valid reports whether algorithm is supported.
+func Valid(algorithm string) bool {
+	return algorithm == Gzip || algorithm == Zstd
+}
+
+// Compress compresses data with the given algorithm.
+func Compress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to compress with gzip: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("failed to compress with gzip: %w", err)
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", algorithm)
+}
+
+// Decompress decompresses data compressed with the given algorithm.
+func Decompress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress with gzip: %w", err)
+		}
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress with gzip: %w", err)
+		}
+		return b, nil
+	case Zstd:
+		b, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress with zstd: %w", err)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", algorithm)
+}
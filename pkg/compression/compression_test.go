@@ -0,0 +1,57 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"header":{"Content-Type":["application/json"]},"body":"hello"}`), 50)
+	for _, algorithm := range []string{Gzip, Zstd} {
+		t.Run(algorithm, func(t *testing.T) {
+			if !Valid(algorithm) {
+				t.Errorf("expected %q to be valid", algorithm)
+			}
+			compressed, err := Compress(algorithm, data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(compressed) >= len(data) {
+				t.Errorf("got %d bytes compressed, want fewer than %d", len(compressed), len(data))
+			}
+			got, err := Decompress(algorithm, compressed)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("got %q after decompressing, want %q", got, data)
+			}
+			if _, err := Decompress(algorithm, data); err == nil {
+				t.Errorf("expected uncompressed data to be rejected")
+			}
+		})
+	}
+
+	if Valid("lz4") {
+		t.Errorf("expected lz4 to be invalid")
+	}
+	if _, err := Compress("lz4", data); err == nil {
+		t.Errorf("expected unknown compression to be rejected")
+	}
+	if _, err := Decompress("lz4", data); err == nil {
+		t.Errorf("expected unknown compression to be rejected")
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package deadletter keeps requests that failed for good, so they can be
+// inspected and replayed onto the queue.
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bradleypeabody/gouuidv6"
+	"github.com/go-redis/redis/v9"
+)
+
+const dataField = "data"
+
+// Attempt is a single try of delivering a request to the target service.
+type Attempt struct {
+	Time time.Time `json:"time"`
+	// StatusCode is the response code of the target, if it responded.
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Entry is a dead-lettered request.
+type Entry struct {
+	// Key identifies the entry in the store. It is set when listing entries.
+	Key string `json:"key,omitempty"`
+	// ID is the request ID, empty if the request could not be read.
+	ID string `json:"id,omitempty"`
+	// Service is the host the request was meant for.
+	Service string `json:"service,omitempty"`
+	Reason  string `json:"reason"`
+	// StatusCode is the last response code of the target, if it responded.
+	StatusCode int       `json:"statusCode,omitempty"`
+	Attempts   []Attempt `json:"attempts,omitempty"`
+	Failed     time.Time `json:"failed"`
+	// Request is the request as it was read from the queue.
+	Request json.RawMessage `json:"request"`
+}
+
+// Filter selects entries by request ID, service, and the time the request
+// was accepted, which is taken from its UUIDv6 ID. Empty fields match all
+// entries.
+type Filter struct {
+	IDs []string
+	// Service matches the host of the request, or its first labels, such as
+	// "name" or "name.namespace".
+	Service string
+	// From and To select requests accepted at or after From and before To.
+	From, To time.Time
+}
+
+// Matches reports whether the entry is selected by the filter.
+func (f Filter) Matches(e Entry) bool {
+	if len(f.IDs) > 0 && !contains(f.IDs, e.ID) {
+		return false
+	}
+	if f.Service != "" && e.Service != f.Service && !strings.HasPrefix(e.Service, f.Service+".") {
+		return false
+	}
+	if f.From.IsZero() && f.To.IsZero() {
+		return true
+	}
+	id, err := gouuidv6.Parse(e.ID)
+	if err != nil {
+		return false
+	}
+	accepted := id.Time()
+	if !f.From.IsZero() && accepted.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !accepted.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Store keeps dead-lettered requests.
+type Store interface {
+	// Add appends the entry, and returns the oldest entries if they were
+	// dropped to make room for it.
+	Add(ctx context.Context, entry Entry) ([]Entry, error)
+	// List returns the entries selected by the filter, oldest first, looking
+	// at no more than count entries after the one with the key after, or from
+	// the first entry if it is empty. It returns the key to list the next
+	// entries after, which is empty once there are none. A count of zero or
+	// less looks at all entries.
+	List(ctx context.Context, filter Filter, after string, count int64) ([]Entry, string, error)
+	Remove(ctx context.Context, entries ...Entry) error
+}
+
+// RedisStore keeps dead-lettered requests in a Redis stream.
+type RedisStore struct {
+	client redis.Cmdable
+	stream string
+	maxLen int64
+}
+
+// NewRedisStore creates a Store writing to the given stream. Once the stream
+// holds maxLen entries the oldest are dropped. A maxLen of zero keeps all
+// entries.
+func NewRedisStore(client redis.Cmdable, stream string, maxLen int64) *RedisStore {
+	return &RedisStore{
+		client: client,
+		stream: stream,
+		maxLen: maxLen,
+	}
+}
+
+// addScript appends an entry to the stream and trims it to the length given
+// after the entry, returning the entries it trimmed.
+var addScript = redis.NewScript(`
+redis.call('XADD', KEYS[1], '*', 'data', ARGV[1])
+local maxLen = tonumber(ARGV[2])
+if maxLen <= 0 then
+	return {}
+end
+local excess = redis.call('XLEN', KEYS[1]) - maxLen
+if excess <= 0 then
+	return {}
+end
+local trimmed = redis.call('XRANGE', KEYS[1], '-', '+', 'COUNT', excess)
+redis.call('XTRIM', KEYS[1], 'MAXLEN', maxLen)
+return trimmed
+`)
+
+// Add appends the entry to the stream. The oldest entries are trimmed one by
+// one, so that they can be returned.
+func (s *RedisStore) Add(ctx context.Context, entry Entry) ([]Entry, error) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal dead letter %q: %w", entry.ID, err)
+	}
+	reply, err := addScript.Run(ctx, s.client, []string{s.stream}, b, s.maxLen).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write dead letter %q: %w", entry.ID, err)
+	}
+	trimmed := make([]Entry, 0, len(reply))
+	for _, msg := range reply {
+		// Every message is its ID followed by its fields and values.
+		fields, _ := msg.([]interface{})
+		if len(fields) != 2 {
+			continue
+		}
+		key, _ := fields[0].(string)
+		values, _ := fields[1].([]interface{})
+		for i := 0; i+1 < len(values); i += 2 {
+			if values[i] != dataField {
+				continue
+			}
+			data, _ := values[i+1].(string)
+			e := Entry{}
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				return trimmed, fmt.Errorf("failed to unmarshal dead letter %q: %w", key, err)
+			}
+			e.Key = key
+			trimmed = append(trimmed, e)
+		}
+	}
+	return trimmed, nil
+}
+
+// List returns the entries selected by the filter, oldest first, reading
+// count entries of the stream at a time.
+func (s *RedisStore) List(ctx context.Context, filter Filter, after string, count int64) ([]Entry, string, error) {
+	start := "-"
+	if after != "" {
+		start = "(" + after
+	}
+	var msgs []redis.XMessage
+	var err error
+	if count > 0 {
+		msgs, err = s.client.XRangeN(ctx, s.stream, start, "+", count).Result()
+	} else {
+		msgs, err = s.client.XRange(ctx, s.stream, start, "+").Result()
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read dead letters: %w", err)
+	}
+	entries := make([]Entry, 0)
+	for _, msg := range msgs {
+		data, _ := msg.Values[dataField].(string)
+		entry := Entry{}
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, "", fmt.Errorf("failed to unmarshal dead letter %q: %w", msg.ID, err)
+		}
+		entry.Key = msg.ID
+		if filter.Matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if count <= 0 || int64(len(msgs)) < count {
+		return entries, "", nil
+	}
+	return entries, msgs[len(msgs)-1].ID, nil
+}
+
+// Remove deletes the entries from the stream.
+func (s *RedisStore) Remove(ctx context.Context, entries ...Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	if err := s.client.XDel(ctx, s.stream, keys...).Err(); err != nil {
+		return fmt.Errorf("failed to remove dead letters: %w", err)
+	}
+	return nil
+}
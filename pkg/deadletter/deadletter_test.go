@@ -0,0 +1,174 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bradleypeabody/gouuidv6"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+var (
+	yesterday = time.Date(2022, 11, 30, 12, 0, 0, 0, time.UTC)
+	today     = yesterday.Add(24 * time.Hour)
+)
+
+var testEntries = []Entry{{
+	ID:      gouuidv6.NewFromTime(yesterday).String(),
+	Service: "hello.default.svc.cluster.local",
+	Reason:  "target responded with status 503 after 3 attempts",
+	Attempts: []Attempt{
+		{Time: yesterday, StatusCode: 503},
+		{Time: yesterday.Add(time.Second), StatusCode: 503},
+		{Time: yesterday.Add(3 * time.Second), StatusCode: 503},
+	},
+	StatusCode: 503,
+	Failed:     yesterday.Add(3 * time.Second),
+	Request:    json.RawMessage(`{"id":"1"}`),
+}, {
+	ID:       gouuidv6.NewFromTime(today).String(),
+	Service:  "goodbye.default.svc.cluster.local",
+	Reason:   "no such host",
+	Attempts: []Attempt{{Time: today, Error: "no such host"}},
+	Failed:   today,
+	Request:  json.RawMessage(`{"id":"2"}`),
+}}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{{
+		name: "everything",
+		want: []string{testEntries[0].ID, testEntries[1].ID},
+	}, {
+		name:   "by id",
+		filter: Filter{IDs: []string{testEntries[1].ID, "unknown"}},
+		want:   []string{testEntries[1].ID},
+	}, {
+		name:   "by service name",
+		filter: Filter{Service: "hello"},
+		want:   []string{testEntries[0].ID},
+	}, {
+		name:   "by service name and namespace",
+		filter: Filter{Service: "goodbye.default"},
+		want:   []string{testEntries[1].ID},
+	}, {
+		name:   "by service name prefix",
+		filter: Filter{Service: "hell"},
+	}, {
+		name:   "from",
+		filter: Filter{From: today},
+		want:   []string{testEntries[1].ID},
+	}, {
+		name:   "to",
+		filter: Filter{To: today},
+		want:   []string{testEntries[0].ID},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := make([]string, 0)
+			for _, entry := range testEntries {
+				if test.filter.Matches(entry) {
+					got = append(got, entry.ID)
+				}
+			}
+			if diff := cmp.Diff(test.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("unexpected entries (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestStores(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	stores := map[string]Store{
+		"redis":  NewRedisStore(client, "dead-letters", 100),
+		"memory": NewMemoryStore(),
+	}
+	ctx := context.Background()
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, entry := range testEntries {
+				if trimmed, err := store.Add(ctx, entry); err != nil || len(trimmed) != 0 {
+					t.Fatalf("got %v, %v, want nothing trimmed", trimmed, err)
+				}
+			}
+			got, _, err := store.List(ctx, Filter{}, "", 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(testEntries, got, cmpopts.IgnoreFields(Entry{}, "Key")); diff != "" {
+				t.Errorf("unexpected entries (-want, +got): %s", diff)
+			}
+
+			page, next, err := store.List(ctx, Filter{}, "", 1)
+			if err != nil || len(page) != 1 || page[0].ID != testEntries[0].ID || next != page[0].Key {
+				t.Fatalf("got %v, %q, %v, want only %q and its key", page, next, err, testEntries[0].ID)
+			}
+			if err := store.Remove(ctx, got[0]); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// Listing goes on after removed entries.
+			page, _, err = store.List(ctx, Filter{}, next, 1)
+			if err != nil || len(page) != 1 || page[0].ID != testEntries[1].ID {
+				t.Fatalf("got %v, %v, want only %q", page, err, testEntries[1].ID)
+			}
+			if page, next, err = store.List(ctx, Filter{}, page[0].Key, 1); err != nil || len(page) != 0 || next != "" {
+				t.Errorf("got %v, %q, %v, want no more entries", page, next, err)
+			}
+			got, _, err = store.List(ctx, Filter{}, "", 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != 1 || got[0].ID != testEntries[1].ID {
+				t.Errorf("got %v, want only %q", got, testEntries[1].ID)
+			}
+		})
+	}
+}
+
+func TestRedisStoreTrims(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	store := NewRedisStore(client, "dead-letters", 1)
+	ctx := context.Background()
+
+	if trimmed, err := store.Add(ctx, testEntries[0]); err != nil || len(trimmed) != 0 {
+		t.Fatalf("got %v, %v, want nothing trimmed", trimmed, err)
+	}
+	trimmed, err := store.Add(ctx, testEntries[1])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(testEntries[:1], trimmed, cmpopts.IgnoreFields(Entry{}, "Key")); diff != "" {
+		t.Errorf("unexpected trimmed entries (-want, +got): %s", diff)
+	}
+	got, _, err := store.List(ctx, Filter{}, "", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(testEntries[1:], got, cmpopts.IgnoreFields(Entry{}, "Key")); diff != "" {
+		t.Errorf("unexpected entries (-want, +got): %s", diff)
+	}
+}
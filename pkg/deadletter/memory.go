@@ -0,0 +1,99 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deadletter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// MemoryStore keeps dead-lettered requests in memory. It is meant for tests
+// and single process setups, and never drops anything.
+type MemoryStore struct {
+	mu      sync.Mutex
+	next    int
+	entries []Entry
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Add appends the entry to the store.
+func (s *MemoryStore) Add(ctx context.Context, entry Entry) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	entry.Key = strconv.Itoa(s.next)
+	s.entries = append(s.entries, entry)
+	return nil, nil
+}
+
+// List returns the entries selected by the filter, oldest first.
+func (s *MemoryStore) List(ctx context.Context, filter Filter, after string, count int64) ([]Entry, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Keys are increasing numbers, so entries after a removed one are found
+	// as well.
+	start := 0
+	if after != "" {
+		key, err := strconv.Atoi(after)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid dead letter key %q: %w", after, err)
+		}
+		for start < len(s.entries) && s.key(start) <= key {
+			start++
+		}
+	}
+	entries := make([]Entry, 0)
+	end := len(s.entries)
+	if count > 0 && int64(end-start) > count {
+		end = start + int(count)
+	}
+	for _, entry := range s.entries[start:end] {
+		if filter.Matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if end == len(s.entries) {
+		return entries, "", nil
+	}
+	return entries, s.entries[end-1].Key, nil
+}
+
+func (s *MemoryStore) key(i int) int {
+	key, _ := strconv.Atoi(s.entries[i].Key)
+	return key
+}
+
+// Remove deletes the entries from the store.
+func (s *MemoryStore) Remove(ctx context.Context, entries ...Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		removed[entry.Key] = true
+	}
+	kept := s.entries[:0]
+	for _, entry := range s.entries {
+		if !removed[entry.Key] {
+			kept = append(kept, entry)
+		}
+	}
+	s.entries = kept
+	return nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package deadline bounds how long the consumer works on a request.
+package deadline
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Headers setting the limits of a request. They are sent by clients, and the
+// async ingress caps them with the service headers, taken from the
+// annotations of a service.
+const (
+	TimeoutHeader  = "Async-Timeout"
+	DeadlineHeader = "Async-Deadline"
+	ExpiresHeader  = "Async-Expires"
+
+	ServiceTimeoutHeader  = "Async-Service-Timeout"
+	ServiceDeadlineHeader = "Async-Service-Deadline"
+)
+
+// Headers lists all headers read by FromHeaders.
+var Headers = []string{TimeoutHeader, DeadlineHeader, ExpiresHeader, ServiceTimeoutHeader, ServiceDeadlineHeader}
+
+// Limits bound the time spent on a request. Zero values leave it unbounded.
+type Limits struct {
+	// Timeout bounds every attempt of delivering the request.
+	Timeout time.Duration
+	// Deadline bounds the time from accepting the request to its last
+	// attempt. Requests not delivered by then expire.
+	Deadline time.Duration
+	// Expires is when the request expires if it hasn't been delivered.
+	Expires time.Time
+}
+
+// Expiry returns when a request accepted at the given time expires, which is
+// the earlier of its deadline and Expires, or false if it never does.
+func (l Limits) Expiry(accepted time.Time) (time.Time, bool) {
+	expiry := l.Expires
+	if l.Deadline > 0 {
+		if d := accepted.Add(l.Deadline); expiry.IsZero() || d.Before(expiry) {
+			expiry = d
+		}
+	}
+	return expiry, !expiry.IsZero()
+}
+
+// Cap returns the limits, with the timeout and deadline lowered to those of
+// max if they are unbounded or longer.
+func (l Limits) Cap(max Limits) Limits {
+	if max.Timeout > 0 && (l.Timeout <= 0 || l.Timeout > max.Timeout) {
+		l.Timeout = max.Timeout
+	}
+	if max.Deadline > 0 && (l.Deadline <= 0 || l.Deadline > max.Deadline) {
+		l.Deadline = max.Deadline
+	}
+	return l
+}
+
+// FromHeaders reads the limits set by the deadline headers, capped at those
+// of the service headers. Timeouts and deadlines are given as Go durations
+// such as "30s" or "1h", the expiry as an HTTP date or in RFC 3339 format.
+func FromHeaders(h http.Header) (Limits, error) {
+	limits, service := Limits{}, Limits{}
+	for header, field := range map[string]*time.Duration{
+		TimeoutHeader:         &limits.Timeout,
+		DeadlineHeader:        &limits.Deadline,
+		ServiceTimeoutHeader:  &service.Timeout,
+		ServiceDeadlineHeader: &service.Deadline,
+	} {
+		if v := h.Get(header); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return Limits{}, fmt.Errorf("invalid value for %s: %q", header, v)
+			}
+			*field = d
+		}
+	}
+	limits = limits.Cap(service)
+	if v := h.Get(ExpiresHeader); v != "" {
+		t, err := http.ParseTime(v)
+		if err != nil {
+			if t, err = time.Parse(time.RFC3339, v); err != nil {
+				return Limits{}, fmt.Errorf("invalid value for %s: %q", ExpiresHeader, v)
+			}
+		}
+		limits.Expires = t.UTC()
+	}
+	return limits, nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deadline
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFromHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		want    Limits
+		wantErr bool
+	}{{
+		name:   "no headers",
+		header: http.Header{},
+	}, {
+		name: "all headers",
+		header: http.Header{
+			TimeoutHeader:  []string{"30s"},
+			DeadlineHeader: []string{"1h"},
+		},
+		want: Limits{Timeout: 30 * time.Second, Deadline: time.Hour},
+	}, {
+		name: "service headers",
+		header: http.Header{
+			ServiceTimeoutHeader:  []string{"30s"},
+			ServiceDeadlineHeader: []string{"1h"},
+		},
+		want: Limits{Timeout: 30 * time.Second, Deadline: time.Hour},
+	}, {
+		name: "service caps longer limits",
+		header: http.Header{
+			TimeoutHeader:         []string{"5m"},
+			DeadlineHeader:        []string{"10m"},
+			ServiceTimeoutHeader:  []string{"30s"},
+			ServiceDeadlineHeader: []string{"1h"},
+		},
+		want: Limits{Timeout: 30 * time.Second, Deadline: 10 * time.Minute},
+	}, {
+		name:    "invalid service timeout",
+		header:  http.Header{ServiceTimeoutHeader: []string{"soon"}},
+		wantErr: true,
+	}, {
+		name:   "expires as HTTP date",
+		header: http.Header{ExpiresHeader: []string{"Thu, 01 Dec 2022 12:00:00 GMT"}},
+		want:   Limits{Expires: time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)},
+	}, {
+		name:   "expires in RFC 3339 format",
+		header: http.Header{ExpiresHeader: []string{"2022-12-01T13:00:00+01:00"}},
+		want:   Limits{Expires: time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)},
+	}, {
+		name:    "invalid expires",
+		header:  http.Header{ExpiresHeader: []string{"tomorrow"}},
+		wantErr: true,
+	}, {
+		name:    "invalid timeout",
+		header:  http.Header{TimeoutHeader: []string{"30"}},
+		wantErr: true,
+	}, {
+		name:    "negative deadline",
+		header:  http.Header{DeadlineHeader: []string{"-1h"}},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := FromHeaders(test.header)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("unexpected limits (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	accepted := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		limits Limits
+		want   time.Time
+	}{{
+		name: "never",
+	}, {
+		name:   "deadline",
+		limits: Limits{Deadline: time.Hour},
+		want:   accepted.Add(time.Hour),
+	}, {
+		name:   "expires",
+		limits: Limits{Expires: accepted.Add(time.Minute)},
+		want:   accepted.Add(time.Minute),
+	}, {
+		name:   "earlier of both",
+		limits: Limits{Deadline: time.Minute, Expires: accepted.Add(time.Hour)},
+		want:   accepted.Add(time.Minute),
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := test.limits.Expiry(accepted)
+			if !got.Equal(test.want) || ok == test.want.IsZero() {
+				t.Errorf("got %v, %v, want %v", got, ok, test.want)
+			}
+		})
+	}
+}
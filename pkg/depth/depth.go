@@ -0,0 +1,101 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package depth counts the requests queued for every service, so the producer
+// can turn requests away while the consumer falls behind.
+package depth
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Depth is the number of requests that were queued and haven't finished yet.
+type Depth struct {
+	// Service counts the requests for a single service.
+	Service int64
+	// Total counts the requests for all services.
+	Total int64
+}
+
+// Counter keeps the depth of the queue.
+type Counter interface {
+	// Add changes the depth of the service's queue by n, which is negative
+	// for finished requests, and returns the depth after the change. Depths
+	// never drop below zero.
+	Add(ctx context.Context, service string, n int64) (Depth, error)
+	// All returns the depth of every service with requests queued.
+	All(ctx context.Context) (map[string]int64, error)
+}
+
+// addScript changes the count of a service and sums up the counts of all
+// services in one go, so the total always matches them. Services without
+// requests left are removed.
+var addScript = redis.NewScript(`
+local n = redis.call('HINCRBY', KEYS[1], ARGV[1], ARGV[2])
+if n <= 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	n = 0
+end
+local total = 0
+for _, v in ipairs(redis.call('HVALS', KEYS[1])) do
+	total = total + tonumber(v)
+end
+return {n, total}
+`)
+
+// RedisCounter keeps the depth of every service in a Redis hash.
+type RedisCounter struct {
+	client redis.Cmdable
+	key    string
+}
+
+// NewRedisCounter creates a Counter keeping depths in the hash under key.
+func NewRedisCounter(client redis.Cmdable, key string) *RedisCounter {
+	return &RedisCounter{
+		client: client,
+		key:    key,
+	}
+}
+
+// Add changes the depth of the service's queue by n.
+func (c *RedisCounter) Add(ctx context.Context, service string, n int64) (Depth, error) {
+	counts, err := addScript.Run(ctx, c.client, []string{c.key}, service, n).Int64Slice()
+	if err != nil {
+		return Depth{}, fmt.Errorf("failed to count requests for %q: %w", service, err)
+	}
+	if len(counts) != 2 {
+		return Depth{}, fmt.Errorf("failed to count requests for %q: unexpected reply %v", service, counts)
+	}
+	return Depth{Service: counts[0], Total: counts[1]}, nil
+}
+
+// All returns the depth of every service with requests queued.
+func (c *RedisCounter) All(ctx context.Context) (map[string]int64, error) {
+	values, err := c.client.HGetAll(ctx, c.key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request counts: %w", err)
+	}
+	depths := make(map[string]int64, len(values))
+	for service, v := range values {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request count for %q: %w", service, err)
+		}
+		depths[service] = n
+	}
+	return depths, nil
+}
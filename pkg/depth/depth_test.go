@@ -0,0 +1,66 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package depth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCounters(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	counters := map[string]Counter{
+		"redis":  NewRedisCounter(client, "depth"),
+		"memory": NewMemoryCounter(),
+	}
+	ctx := context.Background()
+	for name, counter := range counters {
+		t.Run(name, func(t *testing.T) {
+			steps := []struct {
+				service string
+				n       int64
+				want    Depth
+			}{
+				{service: "hello", n: 1, want: Depth{Service: 1, Total: 1}},
+				{service: "hello", n: 1, want: Depth{Service: 2, Total: 2}},
+				{service: "goodbye", n: 1, want: Depth{Service: 1, Total: 3}},
+				{service: "hello", n: -1, want: Depth{Service: 1, Total: 2}},
+				// A request finishing twice doesn't make the depth negative.
+				{service: "goodbye", n: -1, want: Depth{Service: 0, Total: 1}},
+				{service: "goodbye", n: -1, want: Depth{Service: 0, Total: 1}},
+			}
+			for _, step := range steps {
+				got, err := counter.Add(ctx, step.service, step.n)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got != step.want {
+					t.Errorf("adding %d to %s: got %+v, want %+v", step.n, step.service, got, step.want)
+				}
+			}
+			all, err := counter.All(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(map[string]int64{"hello": 1}, all); diff != "" {
+				t.Errorf("unexpected depths (-want, +got): %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package depth
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryCounter keeps the depth of every service in memory. It is meant for
+// tests and single process setups.
+type MemoryCounter struct {
+	mu     sync.Mutex
+	depths map[string]int64
+}
+
+// NewMemoryCounter creates a MemoryCounter with all queues empty.
+func NewMemoryCounter() *MemoryCounter {
+	return &MemoryCounter{
+		depths: make(map[string]int64),
+	}
+}
+
+// Add changes the depth of the service's queue by n.
+func (c *MemoryCounter) Add(ctx context.Context, service string, n int64) (Depth, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.depths[service] += n
+	if c.depths[service] <= 0 {
+		delete(c.depths, service)
+	}
+	d := Depth{Service: c.depths[service]}
+	for _, n := range c.depths {
+		d.Total += n
+	}
+	return d, nil
+}
+
+// All returns the depth of every service with requests queued.
+func (c *MemoryCounter) All(ctx context.Context) (map[string]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	depths := make(map[string]int64, len(c.depths))
+	for service, n := range c.depths {
+		depths[service] = n
+	}
+	return depths, nil
+}
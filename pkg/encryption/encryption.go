@@ -0,0 +1,239 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package encryption seals queued requests with envelope encryption: every
+// request is encrypted with a key of its own, which is in turn encrypted with
+// one of the keys of a keyring and kept next to it.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dataKeySize is the size of the keys requests are encrypted with, which
+// makes them AES-256 keys.
+const dataKeySize = 32
+
+// Sealed is an encrypted request.
+type Sealed struct {
+	// KeyID is the ID of the keyring key DataKey is encrypted with.
+	KeyID string
+	// DataKey is the encrypted key Payload is encrypted with.
+	DataKey []byte
+	Payload []byte
+}
+
+// now is swapped in tests.
+var now = time.Now
+
+// Keyring holds the keys requests are sealed with by ID. New requests are
+// sealed with the active key, while all keys open requests. Keys loaded from
+// a directory are read again once the reload interval has passed, so that
+// keys added to a mounted Secret are used without a restart.
+type Keyring struct {
+	mu     sync.Mutex
+	keys   map[string]cipher.AEAD
+	active string
+
+	dir            string
+	reloadInterval time.Duration
+	checked        time.Time
+}
+
+// NewKeyring creates a Keyring from AES keys of 16, 24 or 32 bytes. The
+// active key is only needed to seal requests.
+func NewKeyring(keys map[string][]byte, active string) (*Keyring, error) {
+	aeads, err := newAEADs(keys, active)
+	if err != nil {
+		return nil, err
+	}
+	return &Keyring{keys: aeads, active: active}, nil
+}
+
+// newAEADs creates the ciphers of the keys, and checks the active key is
+// among them.
+func newAEADs(keys map[string][]byte, active string) (map[string]cipher.AEAD, error) {
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for id, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		aeads[id] = aead
+	}
+	if _, ok := aeads[active]; active != "" && !ok {
+		return nil, fmt.Errorf("active key %q not found", active)
+	}
+	return aeads, nil
+}
+
+// LoadKeyring reads keys from the files of dir, as a Kubernetes Secret
+// mounted there has them. Every file holds a base64 encoded key, and is named
+// after its ID. The keys are read again every reloadInterval, unless it is
+// zero.
+func LoadKeyring(dir, active string, reloadInterval time.Duration) (*Keyring, error) {
+	keys, err := readKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	k, err := NewKeyring(keys, active)
+	if err != nil {
+		return nil, err
+	}
+	k.dir = dir
+	k.reloadInterval = reloadInterval
+	k.checked = now()
+	return k, nil
+}
+
+// readKeys reads the keys from the files of dir.
+func readKeys(dir string) (map[string][]byte, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys: %w", err)
+	}
+	keys := make(map[string][]byte, len(files))
+	for _, f := range files {
+		// Secret volumes keep their data in hidden directories, which the
+		// files are linked to.
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %q: %w", f.Name(), err)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", f.Name(), err)
+		}
+		keys[f.Name()] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %q", dir)
+	}
+	return keys, nil
+}
+
+// current returns the keys, after reading them again if the reload interval
+// has passed. The previous keys are kept if they can't be read, or the active
+// key is missing from them.
+func (k *Keyring) current() map[string]cipher.AEAD {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.dir == "" || k.reloadInterval <= 0 || now().Sub(k.checked) < k.reloadInterval {
+		return k.keys
+	}
+	k.checked = now()
+	keys, err := readKeys(k.dir)
+	if err == nil {
+		var aeads map[string]cipher.AEAD
+		if aeads, err = newAEADs(keys, k.active); err == nil {
+			k.keys = aeads
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to reload encryption keys: %v", err)
+	}
+	return k.keys
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts plaintext with a new data key, which is encrypted with the
+// active key. additionalData, such as the request ID, has to be given to Open
+// too, so sealed requests can't be passed off as others.
+func (k *Keyring) Seal(plaintext, additionalData []byte) (*Sealed, error) {
+	kek, ok := k.current()[k.active]
+	if !ok {
+		return nil, errors.New("no active key to seal with")
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := seal(aead, plaintext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(kek, dataKey, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealed{KeyID: k.active, DataKey: wrapped, Payload: payload}, nil
+}
+
+// Open decrypts a sealed request with the key it names.
+func (k *Keyring) Open(s *Sealed, additionalData []byte) ([]byte, error) {
+	kek, ok := k.current()[s.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", s.KeyID)
+	}
+	dataKey, err := open(kek, s.DataKey, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+	plaintext, err := open(aead, s.Payload, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+	return plaintext, nil
+}
+
+// seal encrypts plaintext with a random nonce, which the result starts with.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
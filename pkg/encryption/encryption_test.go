@@ -0,0 +1,156 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyring(t *testing.T) {
+	old := bytes.Repeat([]byte{1}, 32)
+	current := bytes.Repeat([]byte{2}, 16)
+	plaintext := []byte(`{"header":{"Authorization":["Bearer secret"]}}`)
+
+	before, err := NewKeyring(map[string][]byte{"old": old}, "old")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sealed, err := before.Seal(plaintext, []byte("123"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sealed.KeyID != "old" || bytes.Contains(sealed.Payload, []byte("secret")) {
+		t.Errorf("got key %q and payload %q, want key old and the payload encrypted", sealed.KeyID, sealed.Payload)
+	}
+
+	// Requests sealed before rotating are still opened afterwards.
+	after, err := NewKeyring(map[string][]byte{"old": old, "current": current}, "current")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := after.Open(sealed, []byte("123"))
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("got %q (%v), want %q", got, err, plaintext)
+	}
+	resealed, err := after.Seal(plaintext, []byte("123"))
+	if err != nil || resealed.KeyID != "current" {
+		t.Errorf("got key %v (%v), want current", resealed, err)
+	}
+
+	if _, err := after.Open(sealed, []byte("456")); err == nil {
+		t.Errorf("expected sealed request to be tied to its ID")
+	}
+	tampered := *sealed
+	tampered.Payload = append([]byte{}, sealed.Payload...)
+	tampered.Payload[len(tampered.Payload)-1] ^= 1
+	if _, err := after.Open(&tampered, []byte("123")); err == nil {
+		t.Errorf("expected tampered payload to be rejected")
+	}
+	rotated, _ := NewKeyring(map[string][]byte{"current": current}, "current")
+	if _, err := rotated.Open(sealed, []byte("123")); err == nil {
+		t.Errorf("expected request sealed with a removed key to be rejected")
+	}
+
+	if _, err := NewKeyring(map[string][]byte{"short": []byte("short")}, ""); err == nil {
+		t.Errorf("expected invalid key to be rejected")
+	}
+	if _, err := NewKeyring(map[string][]byte{"old": old}, "missing"); err == nil {
+		t.Errorf("expected missing active key to be rejected")
+	}
+	openOnly, _ := NewKeyring(map[string][]byte{"old": old}, "")
+	if _, err := openOnly.Seal(plaintext, nil); err == nil {
+		t.Errorf("expected sealing without active key to fail")
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{3}, 32)
+	if err := ioutil.WriteFile(filepath.Join(dir, "2023-01"), []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Files of secret volumes are links into hidden directories.
+	if err := os.Mkdir(filepath.Join(dir, "..data"), 0o700); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	k, err := LoadKeyring(dir, "2023-01", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sealed, err := k.Seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, err := k.Open(sealed, nil); err != nil || string(got) != "hello" {
+		t.Errorf("got %q (%v), want hello", got, err)
+	}
+
+	if _, err := LoadKeyring(t.TempDir(), "", 0); err == nil {
+		t.Errorf("expected empty directory to be rejected")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken"), []byte("not base64!"), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := LoadKeyring(dir, "", 0); err == nil {
+		t.Errorf("expected invalid key to be rejected")
+	}
+}
+
+func TestKeyringReload(t *testing.T) {
+	dir := t.TempDir()
+	writeKey := func(id string, key []byte) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(dir, id), []byte(base64.StdEncoding.EncodeToString(key)), 0o600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+
+	writeKey("2023-01", bytes.Repeat([]byte{1}, 32))
+	k, err := LoadKeyring(dir, "", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	producer, _ := NewKeyring(map[string][]byte{"2023-02": bytes.Repeat([]byte{2}, 32)}, "2023-02")
+	sealed, err := producer.Seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A key added to the Secret is only read once the interval has passed.
+	writeKey("2023-02", bytes.Repeat([]byte{2}, 32))
+	if _, err := k.Open(sealed, nil); err == nil {
+		t.Errorf("expected key to be read only after the reload interval")
+	}
+	now = func() time.Time { return start.Add(time.Minute) }
+	if got, err := k.Open(sealed, nil); err != nil || string(got) != "hello" {
+		t.Errorf("got %q (%v), want hello", got, err)
+	}
+
+	// Keys that can't be read leave the previous ones in place.
+	writeKey("broken", []byte("short"))
+	now = func() time.Time { return start.Add(2 * time.Minute) }
+	if got, err := k.Open(sealed, nil); err != nil || string(got) != "hello" {
+		t.Errorf("got %q (%v) with a broken key, want hello", got, err)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package idempotency remembers which request an Idempotency-Key was first
+// used for, so the producer doesn't queue repeated requests twice.
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Record is the request an Idempotency-Key was first used for.
+type Record struct {
+	ID string `json:"id"`
+	// BodyHash is the hex encoded SHA-256 hash of the request body.
+	BodyHash string `json:"bodyHash"`
+}
+
+// HashBody returns the hash of a request body to store in a Record.
+func HashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Store keeps idempotency records.
+type Store interface {
+	// Claim records rec under key unless a record already exists, which is
+	// returned instead. It returns nil if rec was recorded.
+	Claim(ctx context.Context, key string, rec Record) (*Record, error)
+	// Release removes the record under key, so the key can be used again.
+	Release(ctx context.Context, key string) error
+}
+
+// RedisStore keeps idempotency records in Redis keys that expire after ttl.
+type RedisStore struct {
+	client redis.Cmdable
+	prefix string
+	ttl    time.Duration
+}
+
+// NewRedisStore creates a Store that keeps records under keys starting with
+// prefix. A ttl of zero keeps records forever.
+func NewRedisStore(client redis.Cmdable, prefix string, ttl time.Duration) *RedisStore {
+	return &RedisStore{
+		client: client,
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
+
+// Claim records rec under key unless a record already exists.
+func (s *RedisStore) Claim(ctx context.Context, key string, rec Record) (*Record, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+	// The existing record may expire between both commands, in which case
+	// we try again.
+	for i := 0; i < 2; i++ {
+		ok, err := s.client.SetNX(ctx, s.prefix+key, b, s.ttl).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to record idempotency key: %w", err)
+		}
+		if ok {
+			return nil, nil
+		}
+		existing, err := s.client.Get(ctx, s.prefix+key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read idempotency key: %w", err)
+		}
+		found := &Record{}
+		if err := json.Unmarshal(existing, found); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal idempotency record: %w", err)
+		}
+		return found, nil
+	}
+	return nil, errors.New("failed to record idempotency key: record keeps expiring")
+}
+
+// Release removes the record under key.
+func (s *RedisStore) Release(ctx context.Context, key string) error {
+	if err := s.client.Del(ctx, s.prefix+key).Err(); err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
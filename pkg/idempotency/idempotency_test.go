@@ -0,0 +1,60 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package idempotency
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStores(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	stores := map[string]Store{
+		"redis":  NewRedisStore(client, "idempotency:", time.Hour),
+		"memory": NewMemoryStore(),
+	}
+	ctx := context.Background()
+	first := Record{ID: "1", BodyHash: HashBody([]byte("hello"))}
+	second := Record{ID: "2", BodyHash: HashBody([]byte("hello"))}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			if got, err := store.Claim(ctx, "key", first); err != nil || got != nil {
+				t.Fatalf("got %v, %v, want the key to be claimed", got, err)
+			}
+			got, err := store.Claim(ctx, "key", second)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(&first, got); diff != "" {
+				t.Errorf("unexpected record (-want, +got): %s", diff)
+			}
+			if err := store.Release(ctx, "key"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got, err := store.Claim(ctx, "key", second); err != nil || got != nil {
+				t.Errorf("got %v, %v, want the released key to be claimed", got, err)
+			}
+		})
+	}
+
+	if ttl := mr.TTL("idempotency:key"); ttl != time.Hour {
+		t.Errorf("got ttl %v, want %v", ttl, time.Hour)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package priority sorts asynchronous requests into lanes, which the consumer
+// drains from the highest down.
+package priority
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Headers setting the priority of a request. Clients ask for a priority with
+// Header, and the async ingress caps it with MaxHeader, taken from the
+// annotations of a service.
+const (
+	Header    = "Async-Priority"
+	MaxHeader = "Async-Max-Priority"
+)
+
+// Headers lists all headers read by FromHeaders.
+var Headers = []string{Header, MaxHeader}
+
+// Priority is the lane a request is queued in.
+type Priority string
+
+// Supported priorities.
+const (
+	High   Priority = "high"
+	Normal Priority = "normal"
+	Low    Priority = "low"
+)
+
+// Lanes lists all priorities, from the highest to the lowest.
+var Lanes = []Priority{High, Normal, Low}
+
+// Parse reads a priority, which is normal if v is empty.
+func Parse(v string) (Priority, error) {
+	if v == "" {
+		return Normal, nil
+	}
+	p := Priority(strings.ToLower(strings.TrimSpace(v)))
+	for _, lane := range Lanes {
+		if p == lane {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown priority %q", v)
+}
+
+// rank orders priorities, with the highest ranked first.
+func (p Priority) rank() int {
+	for i, lane := range Lanes {
+		if p == lane {
+			return i
+		}
+	}
+	return len(Lanes)
+}
+
+// Cap returns the priority, lowered to max if it is higher.
+func (p Priority) Cap(max Priority) Priority {
+	if p.rank() < max.rank() {
+		return max
+	}
+	return p
+}
+
+// FromHeaders reads the priority asked for by the priority headers, capped
+// at the maximum priority if one is set.
+func FromHeaders(h http.Header) (Priority, error) {
+	p, err := Parse(h.Get(Header))
+	if err != nil {
+		return "", fmt.Errorf("invalid value for %s: %w", Header, err)
+	}
+	if v := h.Get(MaxHeader); v != "" {
+		max, err := Parse(v)
+		if err != nil {
+			return "", fmt.Errorf("invalid value for %s: %w", MaxHeader, err)
+		}
+		p = p.Cap(max)
+	}
+	return p, nil
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package priority
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFromHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		want    Priority
+		wantErr bool
+	}{{
+		name:   "no headers",
+		header: http.Header{},
+		want:   Normal,
+	}, {
+		name:   "requested priority",
+		header: http.Header{Header: []string{"High"}},
+		want:   High,
+	}, {
+		name:   "capped priority",
+		header: http.Header{Header: []string{"high"}, MaxHeader: []string{"normal"}},
+		want:   Normal,
+	}, {
+		name:   "priority below the cap",
+		header: http.Header{Header: []string{"low"}, MaxHeader: []string{"normal"}},
+		want:   Low,
+	}, {
+		name:   "default priority capped",
+		header: http.Header{MaxHeader: []string{"low"}},
+		want:   Low,
+	}, {
+		name:    "invalid priority",
+		header:  http.Header{Header: []string{"urgent"}},
+		wantErr: true,
+	}, {
+		name:    "invalid cap",
+		header:  http.Header{MaxHeader: []string{"1"}},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := FromHeaders(test.header)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
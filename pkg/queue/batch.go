@@ -0,0 +1,171 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errBatchFailed is returned for messages of a batch the backend returned
+// fewer errors for than it was given.
+var errBatchFailed = errors.New("batch write failed")
+
+// BatchPublisher is implemented by backends that can write several messages in
+// one go, such as in a single round trip.
+type BatchPublisher interface {
+	Publisher
+	// PublishBatch writes the messages and returns the error of every one of
+	// them, in the same order.
+	PublishBatch(ctx context.Context, msgs []Message) []error
+}
+
+// refBatchPublisher is implemented by BatchPublishers that can take back the
+// messages they write, and return their refs for a batch.
+type refBatchPublisher interface {
+	Retracter
+	PublishBatchRef(ctx context.Context, msgs []Message) ([]string, []error)
+}
+
+// Batcher is a Publisher that coalesces messages published concurrently into
+// batches. A batch is written once it holds maxSize messages, or linger after
+// its first message arrived, and is followed by the next one. Publish returns
+// once the batch holding its message was written.
+type Batcher struct {
+	pub      BatchPublisher
+	maxSize  int
+	linger   time.Duration
+	requests chan *batchRequest
+	done     chan struct{}
+}
+
+type batchRequest struct {
+	ctx    context.Context
+	msg    Message
+	result chan batchResult
+}
+
+type batchResult struct {
+	ref string
+	err error
+}
+
+// NewBatcher creates a Batcher writing batches of up to maxSize messages to
+// pub, and starts writing them.
+func NewBatcher(pub BatchPublisher, maxSize int, linger time.Duration) *Batcher {
+	b := &Batcher{
+		pub:      pub,
+		maxSize:  maxSize,
+		linger:   linger,
+		requests: make(chan *batchRequest),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Publish adds the message to the next batch and waits until it is written.
+// Once the message is part of a batch, Publish waits for the batch even if ctx
+// is done, so the outcome it returns is the outcome of the write.
+func (b *Batcher) Publish(ctx context.Context, msg Message) error {
+	_, err := b.PublishRef(ctx, msg)
+	return err
+}
+
+// PublishRef publishes the message like Publish does, and returns its ref if
+// the backend hands out refs.
+func (b *Batcher) PublishRef(ctx context.Context, msg Message) (string, error) {
+	req := &batchRequest{ctx: ctx, msg: msg, result: make(chan batchResult, 1)}
+	select {
+	case b.requests <- req:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	result := <-req.result
+	return result.ref, result.err
+}
+
+// Retract takes back the message with the given ref, if the backend can.
+func (b *Batcher) Retract(ctx context.Context, ref string) (bool, error) {
+	if r, ok := b.pub.(Retracter); ok {
+		return r.Retract(ctx, ref)
+	}
+	return false, nil
+}
+
+// Close writes the last batch and stops the Batcher. Publish must not be
+// called after Close.
+func (b *Batcher) Close() {
+	close(b.requests)
+	<-b.done
+}
+
+func (b *Batcher) run() {
+	defer close(b.done)
+	for first := range b.requests {
+		batch := []*batchRequest{first}
+		timer := time.NewTimer(b.linger)
+	collect:
+		for len(batch) < b.maxSize {
+			select {
+			case req, ok := <-b.requests:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, req)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		b.write(batch)
+	}
+}
+
+// write writes the messages of the batch whose callers are still waiting, and
+// hands every caller its outcome.
+func (b *Batcher) write(batch []*batchRequest) {
+	msgs := make([]Message, 0, len(batch))
+	waiting := make([]*batchRequest, 0, len(batch))
+	for _, req := range batch {
+		if err := req.ctx.Err(); err != nil {
+			req.result <- batchResult{err: err}
+			continue
+		}
+		msgs = append(msgs, req.msg)
+		waiting = append(waiting, req)
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	// The batch isn't cut short when one of its callers gives up.
+	var refs []string
+	var errs []error
+	if pub, ok := b.pub.(refBatchPublisher); ok {
+		refs, errs = pub.PublishBatchRef(context.Background(), msgs)
+	} else {
+		errs = b.pub.PublishBatch(context.Background(), msgs)
+	}
+	for i, req := range waiting {
+		result := batchResult{err: errBatchFailed}
+		if i < len(errs) {
+			result.err = errs[i]
+		}
+		if i < len(refs) {
+			result.ref = refs[i]
+		}
+		req.result <- result
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// EventType is the CloudEvents type of queued requests.
+const EventType = "dev.knative.async.request"
+
+// CloudEvents sends messages as CloudEvents to a sink, such as a Knative
+// Broker, which delivers them to the consumer.
+type CloudEvents struct {
+	client     cloudevents.Client
+	target     string
+	source     string
+	extensions map[string]interface{}
+}
+
+// ceOverrides is the format of the K_CE_OVERRIDES variable set by a SinkBinding.
+type ceOverrides struct {
+	Extensions map[string]interface{} `json:"extensions"`
+}
+
+// NewCloudEvents creates a publisher sending to the sink injected by a
+// SinkBinding, or to the configured broker URL if there is none.
+func NewCloudEvents(cfg Config) (*CloudEvents, error) {
+	target := cfg.Sink
+	if target == "" {
+		target = cfg.BrokerURL
+	}
+	if target == "" {
+		return nil, errors.New("no sink or broker URL configured")
+	}
+	overrides := ceOverrides{}
+	if cfg.CEOverrides != "" {
+		if err := json.Unmarshal([]byte(cfg.CEOverrides), &overrides); err != nil {
+			return nil, fmt.Errorf("failed to parse CloudEvents overrides: %w", err)
+		}
+	}
+	client, err := cloudevents.NewDefaultClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CloudEvents client: %w", err)
+	}
+	return &CloudEvents{
+		client:     client,
+		target:     target,
+		source:     cfg.EventSource,
+		extensions: overrides.Extensions,
+	}, nil
+}
+
+// Publish sends the message as a CloudEvent with the request ID as event ID
+// and the request as data.
+func (c *CloudEvents) Publish(ctx context.Context, msg Message) error {
+	event := cloudevents.NewEvent()
+	event.SetID(msg.ID)
+	event.SetType(EventType)
+	event.SetSource(c.source)
+	for name, value := range c.extensions {
+		event.SetExtension(name, value)
+	}
+	if err := event.SetData(cloudevents.ApplicationJSON, json.RawMessage(msg.Data)); err != nil {
+		return fmt.Errorf("failed to set data of %q: %w", msg.ID, err)
+	}
+	result := c.client.Send(cloudevents.ContextWithTarget(ctx, c.target), event)
+	if !cloudevents.IsACK(result) {
+		return fmt.Errorf("failed to publish %q: %w", msg.ID, result)
+	}
+	return nil
+}
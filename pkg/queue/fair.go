@@ -0,0 +1,64 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import "sort"
+
+// fairScheduler orders streams by weighted fair queuing. Every message served
+// from a stream moves its virtual finish time on by the inverse of its weight,
+// and the stream that would start the earliest is served first, so streams
+// are served in proportion to their weights while they all have messages.
+// A stream that was idle starts at the current virtual time, so it can't save
+// up turns while it has nothing to serve.
+type fairScheduler struct {
+	weights map[string]int
+	finish  map[string]float64
+	virtual float64
+}
+
+func newFairScheduler(weights map[string]int) *fairScheduler {
+	return &fairScheduler{
+		weights: weights,
+		finish:  make(map[string]float64),
+	}
+}
+
+// start returns the virtual time the next message of the stream starts at.
+func (s *fairScheduler) start(stream string) float64 {
+	if f := s.finish[stream]; f > s.virtual {
+		return f
+	}
+	return s.virtual
+}
+
+// order returns the streams in the order they should be served in. Streams
+// starting at the same time are ordered by name.
+func (s *fairScheduler) order(streams []string) []string {
+	ordered := append([]string(nil), streams...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return s.start(ordered[i]) < s.start(ordered[j])
+	})
+	return ordered
+}
+
+// served records that a message of the stream was served.
+func (s *fairScheduler) served(stream string) {
+	weight := s.weights[stream]
+	if weight <= 0 {
+		weight = 1
+	}
+	start := s.start(stream)
+	s.virtual = start
+	s.finish[stream] = start + 1/float64(weight)
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	offsetSuffix = ".offset"
+	// pollInterval is how long the subscriber waits before looking for new
+	// entries once it has read the whole file.
+	pollInterval = 250 * time.Millisecond
+)
+
+// File keeps messages in an append-only file, one JSON entry per line, and
+// the read position of its single subscriber in a file next to it. It lets
+// the producer and consumer share a volume instead of a broker. Messages the
+// handler fails on are handled again until it succeeds before any later
+// message.
+type File struct {
+	path string
+	mu   sync.Mutex
+}
+
+type fileEntry struct {
+	ID   string `json:"id"`
+	Data []byte `json:"data"`
+}
+
+// NewFile creates a file backed queue at path.
+func NewFile(path string) *File {
+	return &File{
+		path: path,
+	}
+}
+
+// Publish appends the message to the file and syncs it to disk.
+func (f *File) Publish(ctx context.Context, msg Message) error {
+	line, err := json.Marshal(fileEntry{ID: msg.ID, Data: msg.Data})
+	if err != nil {
+		return fmt.Errorf("failed to marshal %q: %w", msg.ID, err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to publish %q: %w", msg.ID, err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to publish %q: %w", msg.ID, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to publish %q: %w", msg.ID, err)
+	}
+	return nil
+}
+
+// PublishBatch appends the messages to the file with a single write, and
+// syncs it to disk once.
+func (f *File) PublishBatch(ctx context.Context, msgs []Message) []error {
+	errs := make([]error, len(msgs))
+	var buf bytes.Buffer
+	for i, msg := range msgs {
+		line, err := json.Marshal(fileEntry{ID: msg.ID, Data: msg.Data})
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to marshal %q: %w", msg.ID, err)
+			continue
+		}
+		buf.Write(append(line, '\n'))
+	}
+	if buf.Len() == 0 {
+		return errs
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := func() error {
+		file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := file.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		return file.Sync()
+	}()
+	if err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = fmt.Errorf("failed to publish %q: %w", msgs[i].ID, err)
+			}
+		}
+	}
+	return errs
+}
+
+// Check opens the file for appending without writing to it.
+func (f *File) Check(ctx context.Context) error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open queue file: %w", err)
+	}
+	return file.Close()
+}
+
+// Subscribe reads entries from the last recorded position on, recording the
+// position after every entry handled, and waits for new ones at the end of
+// the file.
+func (f *File) Subscribe(ctx context.Context, handler Handler) error {
+	offset, err := f.readOffset()
+	if err != nil {
+		return err
+	}
+	for ctx.Err() == nil {
+		read, err := f.readFrom(ctx, offset, handler)
+		offset += read
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(pollInterval):
+		}
+	}
+	return ctx.Err()
+}
+
+// readFrom handles all complete entries after offset and returns the number
+// of bytes consumed.
+func (f *File) readFrom(ctx context.Context, offset int64, handler Handler) (int64, error) {
+	file, err := os.Open(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to open queue file: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek queue file: %w", err)
+	}
+	var read int64
+	reader := bufio.NewReader(file)
+	for ctx.Err() == nil {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// A partial line is still being written, pick it up next time.
+			return read, nil
+		} else if err != nil {
+			return read, fmt.Errorf("failed to read queue file: %w", err)
+		}
+		entry := fileEntry{}
+		// Entries that can't be read never will be, so they are skipped.
+		if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+			log.Println("Error unmarshalling queue entry ", err)
+		} else if err := handleInOrder(ctx, handler, Message{ID: entry.ID, Data: entry.Data}); err != nil {
+			return read, nil
+		}
+		read += int64(len(line))
+		if err := f.writeOffset(offset + read); err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (f *File) readOffset() (int64, error) {
+	b, err := ioutil.ReadFile(f.path + offsetSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read queue offset: %w", err)
+	}
+	offset, err := strconv.ParseInt(string(bytes.TrimSpace(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse queue offset: %w", err)
+	}
+	return offset, nil
+}
+
+// writeOffset records the read position, replacing the previous one
+// atomically so a crash never leaves a partial offset behind.
+func (f *File) writeOffset(offset int64) error {
+	tmp := f.path + offsetSuffix + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0o600); err != nil {
+		return fmt.Errorf("failed to write queue offset: %w", err)
+	}
+	if err := os.Rename(tmp, f.path+offsetSuffix); err != nil {
+		return fmt.Errorf("failed to write queue offset: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaBatchTimeout is how long the writer waits for more messages before
+// writing a batch. Its default of a second would hold back every request
+// published on its own.
+const kafkaBatchTimeout = time.Millisecond
+
+// Kafka reads and writes messages on a Kafka topic. Offsets are committed in
+// order, so messages the handler fails on are handled again until it succeeds
+// before any later message of their partition.
+type Kafka struct {
+	writer *kafka.Writer
+	cfg    Config
+}
+
+// NewKafka creates a Kafka queue for the configured brokers and topic.
+func NewKafka(cfg Config) (*Kafka, error) {
+	if len(cfg.KafkaBrokers) == 0 {
+		return nil, errors.New("no Kafka brokers configured")
+	}
+	return &Kafka{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.KafkaBrokers...),
+			Topic:        cfg.KafkaTopic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			// Messages are batched by the producer already.
+			BatchTimeout: kafkaBatchTimeout,
+		},
+		cfg: cfg,
+	}, nil
+}
+
+// Publish writes the message to the topic, keyed by the request ID.
+func (k *Kafka) Publish(ctx context.Context, msg Message) error {
+	err := k.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(msg.ID),
+		Value: msg.Data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %q: %w", msg.ID, err)
+	}
+	return nil
+}
+
+// PublishBatch writes the messages to the topic with a single call to the
+// writer, which sends them to the brokers in batches per partition.
+func (k *Kafka) PublishBatch(ctx context.Context, msgs []Message) []error {
+	errs := make([]error, len(msgs))
+	kmsgs := make([]kafka.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		kmsgs = append(kmsgs, kafka.Message{
+			Key:   []byte(msg.ID),
+			Value: msg.Data,
+		})
+	}
+	err := k.writer.WriteMessages(ctx, kmsgs...)
+	if err == nil {
+		return errs
+	}
+	// The writer tells which messages failed if only some of them did.
+	var writeErrs kafka.WriteErrors
+	for i, msg := range msgs {
+		msgErr := err
+		if errors.As(err, &writeErrs) && len(writeErrs) == len(msgs) {
+			msgErr = writeErrs[i]
+		}
+		if msgErr != nil {
+			errs[i] = fmt.Errorf("failed to publish %q: %w", msg.ID, msgErr)
+		}
+	}
+	return errs
+}
+
+// Check asks the brokers for the metadata of the topic, which fails if they
+// can't be reached or don't know the topic.
+func (k *Kafka) Check(ctx context.Context) error {
+	client := &kafka.Client{Addr: k.writer.Addr}
+	res, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{k.cfg.KafkaTopic}})
+	if err != nil {
+		return fmt.Errorf("failed to reach Kafka: %w", err)
+	}
+	for _, topic := range res.Topics {
+		if topic.Error != nil {
+			return fmt.Errorf("failed to look up topic %q: %w", topic.Name, topic.Error)
+		}
+	}
+	return nil
+}
+
+// Subscribe reads the topic as a member of the configured consumer group,
+// committing every message once the handler succeeded on it.
+func (k *Kafka) Subscribe(ctx context.Context, handler Handler) error {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: k.cfg.KafkaBrokers,
+		GroupID: k.cfg.KafkaGroupID,
+		Topic:   k.cfg.KafkaTopic,
+	})
+	defer reader.Close()
+	for {
+		m, err := reader.FetchMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to fetch from %q: %w", k.cfg.KafkaTopic, err)
+		}
+		// Committing the offset of a message commits all messages before it
+		// as well, so the handler is retried rather than moving on.
+		if err := handleInOrder(ctx, handler, Message{ID: string(m.Key), Data: m.Value}); err != nil {
+			return err
+		}
+		if err := reader.CommitMessages(ctx, m); err != nil {
+			return fmt.Errorf("failed to commit offset of %q: %w", string(m.Key), err)
+		}
+	}
+}
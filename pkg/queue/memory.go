@@ -0,0 +1,64 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"log"
+)
+
+// memorySize is the number of messages the shared in-memory queue holds
+// before publishing blocks.
+const memorySize = 1000
+
+// defaultMemory is shared by the memory backend's publisher and subscriber,
+// so both ends see the same messages within a process.
+var defaultMemory = NewMemory(memorySize)
+
+// Memory is an in-process queue, meant for tests and local development.
+// Messages the handler fails on are not delivered again.
+type Memory struct {
+	messages chan Message
+}
+
+// NewMemory creates an in-memory queue holding up to size messages.
+func NewMemory(size int) *Memory {
+	return &Memory{
+		messages: make(chan Message, size),
+	}
+}
+
+// Publish adds the message to the queue, waiting for room if it is full.
+func (m *Memory) Publish(ctx context.Context, msg Message) error {
+	select {
+	case m.messages <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Subscribe hands every queued message to handler until ctx is done.
+func (m *Memory) Subscribe(ctx context.Context, handler Handler) error {
+	for {
+		select {
+		case msg := <-m.messages:
+			if err := handler(ctx, msg); err != nil {
+				log.Println("Error handling message ", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// fetchWait is how long a pull from JetStream waits for new messages.
+const fetchWait = 5 * time.Second
+
+// NATS reads and writes messages on a NATS JetStream stream. Messages the
+// handler fails on are redelivered up to NATSMaxDeliver times.
+type NATS struct {
+	js  nats.JetStreamContext
+	cfg Config
+}
+
+// NewNATS connects to NATS and creates the configured stream if needed.
+func NewNATS(cfg Config) (*NATS, error) {
+	nc, err := nats.Connect(cfg.NATSURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
+	}
+	if _, err := js.StreamInfo(cfg.NATSStream); errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     cfg.NATSStream,
+			Subjects: []string{cfg.NATSSubject},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stream %q: %w", cfg.NATSStream, err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to look up stream %q: %w", cfg.NATSStream, err)
+	}
+	return &NATS{
+		js:  js,
+		cfg: cfg,
+	}, nil
+}
+
+// Publish adds the message to the stream. The request ID is used as the
+// message ID, so JetStream drops duplicates.
+func (n *NATS) Publish(ctx context.Context, msg Message) error {
+	_, err := n.js.PublishMsg(&nats.Msg{
+		Subject: n.cfg.NATSSubject,
+		Data:    msg.Data,
+	}, nats.MsgId(msg.ID), nats.Context(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to publish %q: %w", msg.ID, err)
+	}
+	return nil
+}
+
+// Check looks up the stream, which fails if NATS or JetStream can't be reached.
+func (n *NATS) Check(ctx context.Context) error {
+	if _, err := n.js.StreamInfo(n.cfg.NATSStream, nats.Context(ctx)); err != nil {
+		return fmt.Errorf("failed to look up stream %q: %w", n.cfg.NATSStream, err)
+	}
+	return nil
+}
+
+// Subscribe pulls messages with a durable consumer, acknowledging those the
+// handler succeeds on and asking for redelivery of the others.
+func (n *NATS) Subscribe(ctx context.Context, handler Handler) error {
+	sub, err := n.js.PullSubscribe(n.cfg.NATSSubject, n.cfg.NATSDurable,
+		nats.ManualAck(), nats.MaxDeliver(n.cfg.NATSMaxDeliver))
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %q: %w", n.cfg.NATSSubject, err)
+	}
+	defer sub.Unsubscribe()
+	for ctx.Err() == nil {
+		msgs, err := sub.Fetch(1, nats.MaxWait(fetchWait))
+		if errors.Is(err, nats.ErrTimeout) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to fetch from %q: %w", n.cfg.NATSSubject, err)
+		}
+		for _, m := range msgs {
+			if err := handler(ctx, Message{ID: m.Header.Get(nats.MsgIdHdr), Data: m.Data}); err != nil {
+				log.Println("Error handling message ", err)
+				m.Nak()
+				continue
+			}
+			m.Ack()
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,264 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package queue abstracts the transport between the producer, which writes
+// asynchronous requests, and the consumer, which delivers them.
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+
+	"knative.dev/async-component/pkg/priority"
+)
+
+// Supported queue backends.
+const (
+	BackendRedis  = "redis"
+	BackendNATS   = "nats"
+	BackendKafka  = "kafka"
+	BackendMemory = "memory"
+	BackendFile   = "file"
+	// BackendCloudEvents sends requests to a Knative Broker or other sink.
+	BackendCloudEvents = "cloudevents"
+)
+
+// ErrPushOnly is returned by NewSubscriber for backends that push messages to
+// the consumer as CloudEvents instead of having it pull them.
+var ErrPushOnly = errors.New("queue backend delivers messages as CloudEvents")
+
+// Message is a single queued request.
+type Message struct {
+	// ID is the ID of the request.
+	ID string
+	// Data is the JSON encoded request.
+	Data []byte
+	// Service is the host of the service the request is meant for.
+	Service string
+	// Priority is the lane the request is queued in, by backends that have
+	// lanes.
+	Priority priority.Priority
+	// Exhausted is set by backends on messages that were delivered as often
+	// as configured already. The handler is to give up on them rather than
+	// handle them again.
+	Exhausted bool
+}
+
+// Handler processes a message read from a queue.
+type Handler func(ctx context.Context, msg Message) error
+
+// The wait between handling a message again after the handler failed on it
+// doubles from handlerRetryInitial up to handlerRetryMax.
+var (
+	handlerRetryInitial = 100 * time.Millisecond
+	handlerRetryMax     = 30 * time.Second
+)
+
+// handleInOrder calls the handler until it succeeds on the message, and only
+// gives up once ctx is done. It is used by backends that read messages in
+// order, which can't move past a message without losing it.
+func handleInOrder(ctx context.Context, handler Handler, msg Message) error {
+	wait := handlerRetryInitial
+	for {
+		err := handler(ctx, msg)
+		if err == nil {
+			return nil
+		}
+		log.Println("Error handling message ", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > handlerRetryMax {
+			wait = handlerRetryMax
+		}
+	}
+}
+
+// Publisher writes messages to a queue.
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+// Retracter is implemented by backends that can take back messages that
+// weren't delivered yet. PublishRef writes a message like Publish does, and
+// returns a ref to it to hand to Retract, which may be empty if the message
+// can't be taken back.
+type Retracter interface {
+	PublishRef(ctx context.Context, msg Message) (string, error)
+	// Retract removes the message with the given ref unless it was already
+	// delivered, and reports whether it did.
+	Retract(ctx context.Context, ref string) (bool, error)
+}
+
+// Checker is implemented by backends that can tell whether messages can be
+// written to them.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// Subscriber reads messages from a queue.
+type Subscriber interface {
+	// Subscribe calls handler for every message until ctx is done or reading
+	// from the queue fails. Whether a message the handler returned an error
+	// for is delivered again depends on the backend.
+	Subscribe(ctx context.Context, handler Handler) error
+}
+
+// Config selects and configures the queue backend.
+type Config struct {
+	Backend string `envconfig:"QUEUE_BACKEND" default:"redis"`
+
+	StreamName string `envconfig:"REDIS_STREAM_NAME"`
+	// RedisGroup makes the consumer read the stream itself as a member of
+	// this consumer group, instead of a RedisStreamSource pushing requests to
+	// it. RedisConsumer names the consumer within the group, and defaults to
+	// the host name.
+	RedisGroup    string `envconfig:"REDIS_CONSUMER_GROUP"`
+	RedisConsumer string `envconfig:"REDIS_CONSUMER_NAME"`
+	// RedisGroupStart is the stream ID a new consumer group starts reading
+	// after. "$" skips entries already in the stream, "0" reads them all.
+	RedisGroupStart string `envconfig:"REDIS_CONSUMER_GROUP_START" default:"$"`
+	// RedisVisibilityTimeout is how long a message may stay unacknowledged
+	// before another consumer claims it. It is extended while the message is
+	// being handled.
+	RedisVisibilityTimeout time.Duration `envconfig:"REDIS_VISIBILITY_TIMEOUT" default:"1m"`
+	// RedisMaxDeliver is how often a message is delivered before it is
+	// handed to the consumer as exhausted.
+	RedisMaxDeliver int64 `envconfig:"REDIS_MAX_DELIVER" default:"5"`
+	// RedisStreamFormat gives every service a stream of its own instead of
+	// StreamName, named by replacing {namespace} and {service} with those of
+	// the Knative Service. The streams are recorded in the RedisStreamSet set
+	// and need a consumer group, which reads them from the start.
+	RedisStreamFormat string `envconfig:"REDIS_STREAM_FORMAT"`
+	RedisStreamSet    string `envconfig:"REDIS_STREAM_SET" default:"async-streams"`
+	// RedisStreamWeights are the weights of services, given as
+	// namespace/service:weight, which the consumer group serves their streams
+	// in proportion to. Services default to a weight of 1.
+	RedisStreamWeights map[string]int `envconfig:"REDIS_STREAM_WEIGHTS"`
+	// RedisPriorityLanes splits every stream into a lane per priority, which
+	// need a consumer group. The group drains the high lane first, then the
+	// normal one, but serves the low lane first for RedisLowPriorityShare
+	// percent of the messages.
+	RedisPriorityLanes    bool `envconfig:"REDIS_PRIORITY_LANES"`
+	RedisLowPriorityShare int  `envconfig:"REDIS_LOW_PRIORITY_SHARE" default:"10"`
+	// RedisReadCount is the most messages the consumer group reads or claims
+	// from a stream at once.
+	RedisReadCount int `envconfig:"REDIS_READ_COUNT" default:"10"`
+	// RedisStreamSetInterval is how often the consumer group reads the
+	// RedisStreamSet set again, to find the streams of new services.
+	RedisStreamSetInterval time.Duration `envconfig:"REDIS_STREAM_SET_INTERVAL" default:"10s"`
+
+	NATSURL     string `envconfig:"NATS_URL" default:"nats://127.0.0.1:4222"`
+	NATSStream  string `envconfig:"NATS_STREAM" default:"ASYNC"`
+	NATSSubject string `envconfig:"NATS_SUBJECT" default:"async.requests"`
+	NATSDurable string `envconfig:"NATS_DURABLE" default:"async-consumer"`
+	// NATSMaxDeliver is how often a message the consumer failed on is
+	// delivered before NATS gives up on it.
+	NATSMaxDeliver int `envconfig:"NATS_MAX_DELIVER" default:"5"`
+
+	KafkaBrokers []string `envconfig:"KAFKA_BROKERS"`
+	KafkaTopic   string   `envconfig:"KAFKA_TOPIC" default:"async-requests"`
+	KafkaGroupID string   `envconfig:"KAFKA_GROUP_ID" default:"async-consumer"`
+
+	FilePath string `envconfig:"QUEUE_FILE_PATH" default:"/var/run/async/queue.log"`
+
+	// BatchSize is the most messages written at once to backends that are
+	// BatchPublishers, with a batch waiting up to BatchLinger for more
+	// messages. Messages are written one by one if it is below 2.
+	BatchSize   int           `envconfig:"QUEUE_BATCH_SIZE" default:"100"`
+	BatchLinger time.Duration `envconfig:"QUEUE_BATCH_LINGER" default:"1ms"`
+
+	// Sink and CEOverrides are injected by a SinkBinding. BrokerURL is used
+	// when there is no SinkBinding.
+	Sink        string `envconfig:"K_SINK"`
+	CEOverrides string `envconfig:"K_CE_OVERRIDES"`
+	BrokerURL   string `envconfig:"BROKER_URL"`
+	EventSource string `envconfig:"EVENT_SOURCE" default:"async-producer"`
+}
+
+// NewPublisher creates a Publisher for the configured backend. The Redis
+// backend writes with the given client, which is ignored by all others.
+func NewPublisher(cfg Config, client redis.Cmdable) (Publisher, error) {
+	switch cfg.Backend {
+	case BackendRedis:
+		if client == nil {
+			return nil, errors.New("redis queue backend needs a Redis address")
+		}
+		if err := checkRedisGroup(cfg); err != nil {
+			return nil, err
+		}
+		return NewRedisStreams(client, cfg), nil
+	case BackendNATS:
+		return NewNATS(cfg)
+	case BackendKafka:
+		return NewKafka(cfg)
+	case BackendMemory:
+		return defaultMemory, nil
+	case BackendFile:
+		return NewFile(cfg.FilePath), nil
+	case BackendCloudEvents:
+		return NewCloudEvents(cfg)
+	}
+	return nil, fmt.Errorf("unknown queue backend %q", cfg.Backend)
+}
+
+// checkRedisGroup returns an error if the Redis streams are configured in a
+// way only a consumer group can read, but no group is configured. The producer
+// needs the group too, so both agree on the streams.
+func checkRedisGroup(cfg Config) error {
+	if cfg.RedisGroup == "" && cfg.RedisStreamFormat != "" {
+		return errors.New("redis streams per service need a consumer group")
+	}
+	if cfg.RedisGroup == "" && cfg.RedisPriorityLanes {
+		return errors.New("redis priority lanes need a consumer group")
+	}
+	return nil
+}
+
+// NewSubscriber creates a Subscriber for the configured backend, or returns
+// ErrPushOnly if the backend pushes messages to the consumer instead. The
+// Redis backend reads with the given client if a consumer group is
+// configured, and pushes otherwise.
+func NewSubscriber(cfg Config, client redis.Cmdable) (Subscriber, error) {
+	switch cfg.Backend {
+	case BackendRedis:
+		if err := checkRedisGroup(cfg); err != nil {
+			return nil, err
+		}
+		if cfg.RedisGroup == "" {
+			return nil, ErrPushOnly
+		}
+		if client == nil {
+			return nil, errors.New("redis consumer group needs a Redis address")
+		}
+		return NewRedisGroup(client, cfg)
+	case BackendCloudEvents:
+		return nil, ErrPushOnly
+	case BackendNATS:
+		return NewNATS(cfg)
+	case BackendKafka:
+		return NewKafka(cfg)
+	case BackendMemory:
+		return defaultMemory, nil
+	case BackendFile:
+		return NewFile(cfg.FilePath), nil
+	}
+	return nil, fmt.Errorf("unknown queue backend %q", cfg.Backend)
+}
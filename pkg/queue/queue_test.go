@@ -0,0 +1,875 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"knative.dev/async-component/pkg/priority"
+)
+
+var testMessages = []Message{
+	{ID: "1", Data: []byte(`{"id":"1"}`)},
+	{ID: "2", Data: []byte(`{"id":"2","body":"line\nbreak"}`)},
+	{ID: "3", Data: []byte(`{"id":"3"}`)},
+}
+
+// roundTrip publishes the test messages and collects them from sub.
+func roundTrip(t *testing.T, pub Publisher, sub Subscriber) []Message {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, msg := range testMessages {
+		if err := pub.Publish(ctx, msg); err != nil {
+			t.Fatalf("unexpected error publishing: %v", err)
+		}
+	}
+	got := make([]Message, 0, len(testMessages))
+	err := sub.Subscribe(ctx, func(ctx context.Context, msg Message) error {
+		got = append(got, msg)
+		if len(got) == len(testMessages) {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	return got
+}
+
+func TestMemory(t *testing.T) {
+	q := NewMemory(len(testMessages))
+	if diff := cmp.Diff(testMessages, roundTrip(t, q, q)); diff != "" {
+		t.Errorf("unexpected messages (-want, +got): %s", diff)
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	if diff := cmp.Diff(testMessages, roundTrip(t, NewFile(path), NewFile(path))); diff != "" {
+		t.Errorf("unexpected messages (-want, +got): %s", diff)
+	}
+
+	// A new subscriber picks up where the last one stopped.
+	q := NewFile(path)
+	if err := q.Publish(context.Background(), Message{ID: "4", Data: []byte(`{"id":"4"}`)}); err != nil {
+		t.Fatalf("unexpected error publishing: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	q.Subscribe(ctx, func(ctx context.Context, msg Message) error {
+		if msg.ID != "4" {
+			t.Errorf("got message %q, want %q", msg.ID, "4")
+		}
+		cancel()
+		return nil
+	})
+
+	if err := q.Check(context.Background()); err != nil {
+		t.Errorf("unexpected error checking: %v", err)
+	}
+	missing := NewFile(filepath.Join(t.TempDir(), "missing", "queue.log"))
+	if err := missing.Check(context.Background()); err == nil {
+		t.Errorf("expected an error checking a file in a missing directory")
+	}
+}
+
+func TestFileRetriesFailedMessages(t *testing.T) {
+	handlerRetryInitial = time.Millisecond
+	defer func() { handlerRetryInitial = 100 * time.Millisecond }()
+	path := filepath.Join(t.TempDir(), "queue.log")
+	q := NewFile(path)
+	for _, msg := range testMessages {
+		if err := q.Publish(context.Background(), msg); err != nil {
+			t.Fatalf("unexpected error publishing: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	handled := []string{}
+	q.Subscribe(ctx, func(ctx context.Context, msg Message) error {
+		handled = append(handled, msg.ID)
+		if msg.ID == "2" && len(handled) < 4 {
+			return errors.New("status store unavailable")
+		}
+		if msg.ID == "3" {
+			cancel()
+		}
+		return nil
+	})
+	// Later messages wait until the failed one is handled.
+	if diff := cmp.Diff([]string{"1", "2", "2", "2", "3"}, handled); diff != "" {
+		t.Errorf("unexpected messages handled (-want, +got): %s", diff)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if offset, err := q.readOffset(); err != nil || offset != info.Size() {
+		t.Errorf("got offset %d, %v, want %d", offset, err, info.Size())
+	}
+}
+
+func TestRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	q := NewRedis(client, "mystream")
+	for _, msg := range testMessages {
+		if err := q.Publish(context.Background(), msg); err != nil {
+			t.Fatalf("unexpected error publishing: %v", err)
+		}
+	}
+	entries, err := client.XRange(context.Background(), "mystream", "-", "+").Result()
+	if err != nil {
+		t.Fatalf("unexpected error reading stream: %v", err)
+	}
+	if len(entries) != len(testMessages) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(testMessages))
+	}
+	for i, entry := range entries {
+		if got, want := entry.Values["data"], string(testMessages[i].Data); got != want {
+			t.Errorf("got data %q, want %q", got, want)
+		}
+	}
+
+	if err := q.Check(context.Background()); err != nil {
+		t.Errorf("unexpected error checking: %v", err)
+	}
+
+	mr.Close()
+	if err := q.Publish(context.Background(), testMessages[0]); err == nil {
+		t.Errorf("expected an error publishing to a closed server")
+	}
+	if err := q.Check(context.Background()); err == nil {
+		t.Errorf("expected an error checking a closed server")
+	}
+}
+
+func TestRedisGroup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	cfg := Config{
+		StreamName:             "mystream",
+		RedisGroup:             "async",
+		RedisConsumer:          "consumer-1",
+		RedisGroupStart:        "0",
+		RedisVisibilityTimeout: time.Minute,
+		RedisMaxDeliver:        2,
+	}
+	sub, err := NewRedisGroup(client, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(testMessages, roundTrip(t, NewRedis(client, "mystream"), sub)); diff != "" {
+		t.Errorf("unexpected messages (-want, +got): %s", diff)
+	}
+	pending, err := client.XPending(context.Background(), "mystream", "async").Result()
+	if err != nil {
+		t.Fatalf("unexpected error reading pending messages: %v", err)
+	}
+	if pending.Count != 0 {
+		t.Errorf("got %d pending messages, want none", pending.Count)
+	}
+}
+
+func TestRedisGroupReclaim(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	cfg := Config{
+		StreamName:             "mystream",
+		RedisGroup:             "async",
+		RedisGroupStart:        "0",
+		RedisVisibilityTimeout: 50 * time.Millisecond,
+		RedisMaxDeliver:        2,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := NewRedis(client, "mystream").Publish(ctx, testMessages[0]); err != nil {
+		t.Fatalf("unexpected error publishing: %v", err)
+	}
+
+	// The first consumer dies while handling the message.
+	cfg.RedisConsumer = "consumer-1"
+	first, err := NewRedisGroup(client, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	firstCtx, firstCancel := context.WithCancel(ctx)
+	first.Subscribe(firstCtx, func(context.Context, Message) error {
+		firstCancel()
+		return errors.New("consumer died")
+	})
+
+	// The second consumer claims it after the visibility timeout, fails on it
+	// too, and gives up on it once it has been delivered too often.
+	cfg.RedisConsumer = "consumer-2"
+	second, err := NewRedisGroup(client, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	deliveries, exhausted := 0, 0
+	go func() {
+		for ctx.Err() == nil {
+			pending, err := client.XPending(ctx, "mystream", "async").Result()
+			if err == nil && pending.Count == 0 {
+				cancel()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	second.Subscribe(ctx, func(_ context.Context, msg Message) error {
+		deliveries++
+		if msg.ID != testMessages[0].ID {
+			t.Errorf("got message %q, want %q", msg.ID, testMessages[0].ID)
+		}
+		if msg.Exhausted {
+			exhausted++
+			return nil
+		}
+		return errors.New("target failed")
+	})
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Fatalf("message was not given up on")
+	}
+	if deliveries != 2 || exhausted != 1 {
+		t.Errorf("got %d deliveries to the second consumer, %d exhausted, want 2 with the last exhausted", deliveries, exhausted)
+	}
+}
+
+// commandCounter counts the commands a Redis client sends by name.
+type commandCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *commandCounter) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (c *commandCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		c.mu.Lock()
+		c.counts[cmd.Name()]++
+		c.mu.Unlock()
+		return next(ctx, cmd)
+	}
+}
+
+func (c *commandCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (c *commandCounter) count(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[name]
+}
+
+func TestRedisGroupReadsInBatches(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	cfg := Config{
+		RedisStreamFormat:      "async:{namespace}:{service}",
+		RedisStreamSet:         "async-streams",
+		RedisGroup:             "async",
+		RedisConsumer:          "consumer-1",
+		RedisVisibilityTimeout: time.Minute,
+		RedisMaxDeliver:        5,
+		RedisReadCount:         5,
+		RedisStreamSetInterval: time.Hour,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pub := NewRedisStreams(client, cfg)
+	for i := 0; i < 20; i++ {
+		host := []string{"hello.default.svc.cluster.local", "goodbye.default.svc.cluster.local"}[i%2]
+		if err := pub.Publish(ctx, Message{ID: fmt.Sprint(i), Data: []byte(host), Service: host}); err != nil {
+			t.Fatalf("unexpected error publishing: %v", err)
+		}
+	}
+
+	// The set of streams is read once, pending messages are looked for once
+	// on every stream, and new ones are read five at a time.
+	counter := &commandCounter{counts: make(map[string]int)}
+	client.AddHook(counter)
+	sub, err := NewRedisGroup(client, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handled := 0
+	sub.Subscribe(ctx, func(context.Context, Message) error {
+		handled++
+		if handled == 20 {
+			cancel()
+		}
+		return nil
+	})
+	if handled != 20 {
+		t.Fatalf("got %d messages handled, want 20", handled)
+	}
+	if got := counter.count("smembers"); got != 1 {
+		t.Errorf("got %d reads of the stream set, want 1", got)
+	}
+	if got := counter.count("xautoclaim"); got != 2 {
+		t.Errorf("got %d claims, want 2", got)
+	}
+	if got := counter.count("xreadgroup"); got != 4 {
+		t.Errorf("got %d reads, want 4", got)
+	}
+}
+
+func TestRedisRetract(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+	q := NewRedisStreams(client, Config{StreamName: "mystream", RedisGroup: "async"})
+
+	// Nothing is taken back before the consumer group exists, as it may still
+	// read every entry.
+	ref, err := q.PublishRef(ctx, testMessages[0])
+	if err != nil {
+		t.Fatalf("unexpected error publishing: %v", err)
+	}
+	if retracted, err := q.Retract(ctx, ref); err != nil || retracted {
+		t.Errorf("got %v, %v retracting before the group exists, want false", retracted, err)
+	}
+
+	if err := client.XGroupCreate(ctx, "mystream", "async", "0").Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    "async",
+		Consumer: "consumer",
+		Streams:  []string{"mystream", ">"},
+		Count:    1,
+	}).Err(); err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	batcher := NewBatcher(q, 2, time.Millisecond)
+	defer batcher.Close()
+	unread, err := batcher.PublishRef(ctx, testMessages[1])
+	if err != nil {
+		t.Fatalf("unexpected error publishing: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ref  string
+		want bool
+	}{{
+		name: "delivered",
+		ref:  ref,
+	}, {
+		name: "not delivered",
+		ref:  unread,
+		want: true,
+	}, {
+		name: "already retracted",
+		ref:  unread,
+	}, {
+		name: "unknown stream",
+		ref:  "otherstream 1-0",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := batcher.Retract(ctx, test.ref)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("got retracted %v, want %v", got, test.want)
+			}
+		})
+	}
+	if n := client.XLen(ctx, "mystream").Val(); n != 1 {
+		t.Errorf("got %d entries, want 1", n)
+	}
+}
+
+func TestRedisTrimAcknowledged(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+	q, err := NewRedisGroup(client, Config{StreamName: "mystream", RedisGroup: "async", RedisConsumer: "consumer-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if length, err := q.TrimAcknowledged(ctx); err != nil || length != 0 {
+		t.Errorf("got %d, %v, want an empty stream", length, err)
+	}
+	for _, msg := range testMessages {
+		if err := q.Publish(ctx, msg); err != nil {
+			t.Fatalf("unexpected error publishing: %v", err)
+		}
+	}
+	// Without the group nothing is known to be acknowledged.
+	if length, err := q.TrimAcknowledged(ctx); err != nil || length != 3 {
+		t.Errorf("got %d, %v, want 3 entries", length, err)
+	}
+
+	// Read all entries, but only acknowledge the first and the last.
+	if err := client.XGroupCreate(ctx, "mystream", "async", "0").Err(); err != nil {
+		t.Fatalf("unexpected error creating group: %v", err)
+	}
+	streams, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    "async",
+		Consumer: "consumer-1",
+		Streams:  []string{"mystream", ">"},
+	}).Result()
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	entries := streams[0].Messages
+	q.ack("mystream", entries[0].ID)
+	q.ack("mystream", entries[2].ID)
+	if length, err := q.TrimAcknowledged(ctx); err != nil || length != 2 {
+		t.Errorf("got %d, %v, want the pending entry and the one after it", length, err)
+	}
+
+	q.ack("mystream", entries[1].ID)
+	if length, err := q.TrimAcknowledged(ctx); err != nil || length != 1 {
+		t.Errorf("got %d, %v, want only the last delivered entry", length, err)
+	}
+}
+
+func TestRedisTrimAcknowledgedAnyGroup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+	// The producer doesn't know the group of a RedisStreamSource.
+	q := NewRedisStreams(client, Config{StreamName: "mystream"})
+	for _, msg := range testMessages {
+		if err := q.Publish(ctx, msg); err != nil {
+			t.Fatalf("unexpected error publishing: %v", err)
+		}
+	}
+	if length, err := q.TrimAcknowledged(ctx); err != nil || length != 3 {
+		t.Errorf("got %d, %v, want 3 entries without a group", length, err)
+	}
+
+	// Every group has to be done with an entry before it is removed.
+	for _, group := range []string{"source-a", "source-b"} {
+		if err := client.XGroupCreate(ctx, "mystream", group, "0").Err(); err != nil {
+			t.Fatalf("unexpected error creating group: %v", err)
+		}
+	}
+	read := func(group string, count int64) {
+		streams, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: "consumer-1",
+			Streams:  []string{"mystream", ">"},
+			Count:    count,
+		}).Result()
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		for _, entry := range streams[0].Messages {
+			client.XAck(ctx, "mystream", group, entry.ID)
+		}
+	}
+	read("source-a", 3)
+	read("source-b", 1)
+	if length, err := q.TrimAcknowledged(ctx); err != nil || length != 3 {
+		t.Errorf("got %d, %v, want the entries the second group didn't read", length, err)
+	}
+	read("source-b", 1)
+	if length, err := q.TrimAcknowledged(ctx); err != nil || length != 2 {
+		t.Errorf("got %d, %v, want the entries from the last one the second group read", length, err)
+	}
+}
+
+func TestLessID(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"1-0", "2-0", true},
+		{"2-0", "1-0", false},
+		{"9-5", "10-0", true},
+		{"10-2", "10-10", true},
+		{"10-2", "10-2", false},
+	}
+	for _, test := range tests {
+		if got := lessID(test.a, test.b); got != test.want {
+			t.Errorf("lessID(%q, %q) = %t, want %t", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestRedisStreamsPerService(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	cfg := Config{
+		RedisStreamFormat:      "async:{namespace}:{service}",
+		RedisStreamSet:         "async-streams",
+		RedisStreamWeights:     map[string]int{"default/busy": 2},
+		RedisGroup:             "async",
+		RedisConsumer:          "consumer-1",
+		RedisGroupStart:        "$",
+		RedisVisibilityTimeout: time.Minute,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A burst of requests for one service is followed by a few for others.
+	pub := NewRedisStreams(client, cfg)
+	hosts := []string{}
+	for i := 0; i < 6; i++ {
+		hosts = append(hosts, "busy.default.svc.cluster.local")
+	}
+	hosts = append(hosts, "quiet.default.svc.cluster.local", "quiet.default.svc.cluster.local", "other.prod.example.com")
+	for i, host := range hosts {
+		msg := Message{ID: fmt.Sprint(i), Data: []byte(host), Service: host}
+		if err := pub.Publish(ctx, msg); err != nil {
+			t.Fatalf("unexpected error publishing: %v", err)
+		}
+	}
+	streams, err := client.SMembers(ctx, "async-streams").Result()
+	if err != nil {
+		t.Fatalf("unexpected error listing streams: %v", err)
+	}
+	want := []string{"async:default:busy", "async:default:quiet", "async:prod:other"}
+	if diff := cmp.Diff(want, streams, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("unexpected streams (-want, +got): %s", diff)
+	}
+
+	// The busy service gets twice the turns of the others, and the streams
+	// are read although they were written before the group was created.
+	sub, err := NewRedisGroup(client, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := []string{}
+	sub.Subscribe(ctx, func(_ context.Context, msg Message) error {
+		namespace, service := ServiceOf(string(msg.Data))
+		got = append(got, namespace+"/"+service)
+		if len(got) == len(hosts) {
+			cancel()
+		}
+		return nil
+	})
+	wantOrder := []string{
+		"default/busy", "default/quiet", "prod/other",
+		"default/busy", "default/busy", "default/quiet",
+		"default/busy", "default/busy", "default/busy",
+	}
+	if diff := cmp.Diff(wantOrder, got); diff != "" {
+		t.Errorf("unexpected order (-want, +got): %s", diff)
+	}
+}
+
+func TestRedisPriorityLanes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	cfg := Config{
+		StreamName:             "mystream",
+		RedisPriorityLanes:     true,
+		RedisLowPriorityShare:  25,
+		RedisGroup:             "async",
+		RedisConsumer:          "consumer-1",
+		RedisGroupStart:        "0",
+		RedisVisibilityTimeout: time.Minute,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Backfills were queued before a burst of interactive requests.
+	pub := NewRedisStreams(client, cfg)
+	lanes := []priority.Priority{}
+	for i := 0; i < 4; i++ {
+		lanes = append(lanes, priority.Low)
+	}
+	lanes = append(lanes, priority.Normal)
+	for i := 0; i < 6; i++ {
+		lanes = append(lanes, priority.High)
+	}
+	for i, lane := range lanes {
+		msg := Message{ID: fmt.Sprint(i), Data: []byte(lane), Priority: lane}
+		if err := pub.Publish(ctx, msg); err != nil {
+			t.Fatalf("unexpected error publishing: %v", err)
+		}
+	}
+	if n := client.XLen(ctx, "mystream:high").Val(); n != 6 {
+		t.Errorf("got %d requests in the high lane, want 6", n)
+	}
+
+	// High priority requests go first, but every fourth request is a low
+	// priority one while there are any.
+	sub, err := NewRedisGroup(client, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := []string{}
+	sub.Subscribe(ctx, func(_ context.Context, msg Message) error {
+		got = append(got, string(msg.Data))
+		if len(got) == len(lanes) {
+			cancel()
+		}
+		return nil
+	})
+	want := []string{
+		"high", "high", "high", "low",
+		"high", "high", "high", "low",
+		"normal", "low", "low",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected order (-want, +got): %s", diff)
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	for _, backend := range []string{BackendRedis, BackendCloudEvents} {
+		if _, err := NewSubscriber(Config{Backend: backend}, nil); !errors.Is(err, ErrPushOnly) {
+			t.Errorf("got error %v, want %v for %s", err, ErrPushOnly, backend)
+		}
+	}
+	if _, err := NewPublisher(Config{Backend: "carrier-pigeon"}, nil); err == nil {
+		t.Errorf("expected an error for an unknown backend")
+	}
+	if _, err := NewSubscriber(Config{Backend: "carrier-pigeon"}, nil); err == nil {
+		t.Errorf("expected an error for an unknown backend")
+	}
+	if _, err := NewSubscriber(Config{Backend: BackendRedis, RedisGroup: "async"}, nil); err == nil {
+		t.Errorf("expected an error for a Redis consumer group without a client")
+	}
+	if _, err := NewSubscriber(Config{Backend: BackendRedis, RedisStreamFormat: "{service}"}, nil); err == nil || errors.Is(err, ErrPushOnly) {
+		t.Errorf("expected an error for streams per service without a consumer group")
+	}
+	if _, err := NewSubscriber(Config{Backend: BackendRedis, RedisPriorityLanes: true}, nil); err == nil || errors.Is(err, ErrPushOnly) {
+		t.Errorf("expected an error for priority lanes without a consumer group")
+	}
+	if _, err := NewPublisher(Config{Backend: BackendRedis, RedisStreamFormat: "{service}"}, redis.NewClient(&redis.Options{})); err == nil {
+		t.Errorf("expected an error for streams per service without a consumer group")
+	}
+	if _, err := NewPublisher(Config{Backend: BackendRedis, RedisPriorityLanes: true}, redis.NewClient(&redis.Options{})); err == nil {
+		t.Errorf("expected an error for priority lanes without a consumer group")
+	}
+	if _, err := NewPublisher(Config{Backend: BackendKafka}, nil); err == nil {
+		t.Errorf("expected an error for Kafka without brokers")
+	}
+	if _, err := NewPublisher(Config{Backend: BackendMemory}, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCloudEvents(t *testing.T) {
+	received := make(chan cloudevents.Event, 1)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event, err := binding.ToEvent(r.Context(), cehttp.NewMessageFromHttpRequest(r))
+		if err != nil {
+			t.Errorf("error reading event: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- *event
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer sink.Close()
+
+	if _, err := NewCloudEvents(Config{}); err == nil {
+		t.Errorf("expected an error without a sink")
+	}
+
+	q, err := NewCloudEvents(Config{
+		Sink:        sink.URL,
+		BrokerURL:   "http://broker.invalid",
+		CEOverrides: `{"extensions":{"team":"async"}}`,
+		EventSource: "async-producer",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := q.Publish(context.Background(), testMessages[0]); err != nil {
+		t.Fatalf("unexpected error publishing: %v", err)
+	}
+	event := <-received
+	if event.ID() != "1" || event.Type() != EventType || event.Source() != "async-producer" {
+		t.Errorf("unexpected event %v", event)
+	}
+	if got := event.Extensions()["team"]; got != "async" {
+		t.Errorf("got extension %v, want %q", got, "async")
+	}
+	if diff := cmp.Diff(testMessages[0].Data, event.Data()); diff != "" {
+		t.Errorf("unexpected data (-want, +got): %s", diff)
+	}
+
+	sink.Close()
+	if err := q.Publish(context.Background(), testMessages[0]); err == nil {
+		t.Errorf("expected an error publishing to a closed sink")
+	}
+}
+
+// batchRecorder records the batches written to it, failing messages with the
+// ID "bad".
+type batchRecorder struct {
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (br *batchRecorder) Publish(ctx context.Context, msg Message) error {
+	return br.PublishBatch(ctx, []Message{msg})[0]
+}
+
+func (br *batchRecorder) PublishBatch(ctx context.Context, msgs []Message) []error {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	ids := make([]string, 0, len(msgs))
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		ids = append(ids, msg.ID)
+		if msg.ID == "bad" {
+			errs[i] = errors.New("bad message")
+		}
+	}
+	br.batches = append(br.batches, ids)
+	return errs
+}
+
+func TestBatcher(t *testing.T) {
+	br := &batchRecorder{}
+	b := NewBatcher(br, 4, 50*time.Millisecond)
+	ctx := context.Background()
+
+	// Concurrent messages share batches, and every caller gets the outcome
+	// of its own message.
+	ids := []string{"0", "1", "2", "3", "bad", "5", "6", "7", "8", "9"}
+	errs := make([]error, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			errs[i] = b.Publish(ctx, Message{ID: id})
+		}(i, id)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if (err != nil) != (ids[i] == "bad") {
+			t.Errorf("Publish(%s) error = %v", ids[i], err)
+		}
+	}
+	written := 0
+	for _, batch := range br.batches {
+		if len(batch) > 4 {
+			t.Errorf("got a batch of %d messages, want at most 4", len(batch))
+		}
+		written += len(batch)
+	}
+	if written != len(ids) || len(br.batches) > 5 {
+		t.Errorf("got batches %v, want %d messages in few batches", br.batches, len(ids))
+	}
+
+	// A caller that gave up before its message was taken isn't written.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.Publish(cancelled, Message{ID: "cancelled"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Publish() error = %v, want %v", err, context.Canceled)
+	}
+
+	b.Close()
+	for _, batch := range br.batches {
+		for _, id := range batch {
+			if id == "cancelled" {
+				t.Errorf("cancelled message was written")
+			}
+		}
+	}
+}
+
+func TestRedisPublishBatch(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+	q := NewRedisStreams(client, Config{
+		RedisStreamFormat:  "async:{namespace}:{service}",
+		RedisStreamSet:     "async-streams",
+		RedisPriorityLanes: true,
+	})
+	msgs := []Message{
+		{ID: "1", Data: []byte("a"), Service: "hello.default.svc.cluster.local"},
+		{ID: "2", Data: []byte("b"), Service: "hello.default.svc.cluster.local", Priority: priority.High},
+		{ID: "3", Data: []byte("c"), Service: "other.prod.example.com"},
+	}
+	for _, err := range q.PublishBatch(ctx, msgs) {
+		if err != nil {
+			t.Errorf("unexpected error publishing: %v", err)
+		}
+	}
+	streams, err := client.SMembers(ctx, "async-streams").Result()
+	if err != nil {
+		t.Fatalf("unexpected error listing streams: %v", err)
+	}
+	want := []string{"async:default:hello", "async:prod:other"}
+	if diff := cmp.Diff(want, streams, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("unexpected streams (-want, +got): %s", diff)
+	}
+	for stream, id := range map[string]string{
+		"async:default:hello":      "1",
+		"async:default:hello:high": "2",
+		"async:prod:other":         "3",
+	} {
+		entries, err := client.XRange(ctx, stream, "-", "+").Result()
+		if err != nil || len(entries) != 1 || entries[0].Values["id"] != id {
+			t.Errorf("got entries %v, %v in %s, want message %s", entries, err, stream, id)
+		}
+	}
+
+	mr.Close()
+	for _, err := range q.PublishBatch(ctx, msgs) {
+		if err == nil {
+			t.Errorf("expected an error publishing to a closed server")
+		}
+	}
+}
+
+func TestFilePublishBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	q := NewFile(path)
+	for _, err := range q.PublishBatch(context.Background(), testMessages) {
+		if err != nil {
+			t.Fatalf("unexpected error publishing: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got := make([]Message, 0, len(testMessages))
+	q.Subscribe(ctx, func(ctx context.Context, msg Message) error {
+		got = append(got, msg)
+		if len(got) == len(testMessages) {
+			cancel()
+		}
+		return nil
+	})
+	if diff := cmp.Diff(testMessages, got); diff != "" {
+		t.Errorf("unexpected messages (-want, +got): %s", diff)
+	}
+}
@@ -0,0 +1,711 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+
+	"knative.dev/async-component/pkg/priority"
+)
+
+const (
+	dataField = "data"
+	idField   = "id"
+	// readBlock is how long a read from the consumer group waits for new
+	// messages, unless the visibility timeout is shorter.
+	readBlock = 5 * time.Second
+)
+
+// Redis writes messages to a Redis stream. They are either delivered to the
+// consumer as CloudEvents by a RedisStreamSource, or read by the consumer
+// itself as a member of a consumer group.
+//
+// Messages can also be written to a stream per service, which are recorded in
+// a set and read by the consumer group with weighted fair queuing, so a burst
+// of requests for one service doesn't hold up all others. Either way, every
+// stream can be split into lanes by priority.
+type Redis struct {
+	client redis.Cmdable
+	stream string
+	// format names the stream of every service, see Config.RedisStreamFormat.
+	format string
+	set    string
+	lanes  bool
+
+	group             string
+	consumer          string
+	start             string
+	visibilityTimeout time.Duration
+	maxDeliver        int64
+	lowShare          int
+	readCount         int64
+	setInterval       time.Duration
+	// weights are the weights of streams by name, and groups the streams the
+	// consumer group is known to exist on.
+	weights map[string]int
+	groups  map[string]bool
+	// known are the streams last read from the set, at listed, and claimed
+	// is when pending messages were last claimed.
+	known   []string
+	listed  time.Time
+	claimed time.Time
+}
+
+// NewRedis creates a Redis publisher writing to the given stream.
+func NewRedis(client redis.Cmdable, stream string) *Redis {
+	return &Redis{
+		client: client,
+		stream: stream,
+	}
+}
+
+// NewRedisStreams creates a Redis publisher writing to the configured stream,
+// or to the stream of every service if a stream format is configured.
+func NewRedisStreams(client redis.Cmdable, cfg Config) *Redis {
+	r := NewRedis(client, cfg.StreamName)
+	r.format = cfg.RedisStreamFormat
+	r.set = cfg.RedisStreamSet
+	r.lanes = cfg.RedisPriorityLanes
+	r.group = cfg.RedisGroup
+	return r
+}
+
+// NewRedisGroup creates a Redis subscriber reading the configured streams with
+// the configured consumer group. The consumer is named after the host, which
+// is the pod name, unless a name is configured.
+func NewRedisGroup(client redis.Cmdable, cfg Config) (*Redis, error) {
+	consumer := cfg.RedisConsumer
+	if consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to name consumer: %w", err)
+		}
+		consumer = hostname
+	}
+	r := NewRedisStreams(client, cfg)
+	r.consumer = consumer
+	r.start = cfg.RedisGroupStart
+	r.visibilityTimeout = cfg.RedisVisibilityTimeout
+	r.maxDeliver = cfg.RedisMaxDeliver
+	r.lowShare = cfg.RedisLowPriorityShare
+	r.readCount = int64(cfg.RedisReadCount)
+	if r.readCount < 1 {
+		r.readCount = 1
+	}
+	r.setInterval = cfg.RedisStreamSetInterval
+	r.weights = make(map[string]int, len(cfg.RedisStreamWeights))
+	for name, weight := range cfg.RedisStreamWeights {
+		namespace, service := name, ""
+		if i := strings.Index(name, "/"); i >= 0 {
+			namespace, service = name[:i], name[i+1:]
+		}
+		for _, lane := range priority.Lanes {
+			r.weights[laneStream(r.streamName(namespace, service), lane)] = weight
+		}
+	}
+	r.groups = make(map[string]bool)
+	return r, nil
+}
+
+// ServiceOf splits the host of a Knative Service, such as
+// hello.default.svc.cluster.local, into its namespace and name.
+func ServiceOf(host string) (namespace, service string) {
+	labels := strings.SplitN(host, ".", 3)
+	if len(labels) < 2 {
+		return "", labels[0]
+	}
+	return labels[1], labels[0]
+}
+
+// streamName returns the name of the stream of a service.
+func (r *Redis) streamName(namespace, service string) string {
+	return strings.NewReplacer("{namespace}", namespace, "{service}", service).Replace(r.format)
+}
+
+// streamFor returns the stream messages for the service at host go to.
+func (r *Redis) streamFor(host string) string {
+	if r.format == "" {
+		return r.stream
+	}
+	return r.streamName(ServiceOf(host))
+}
+
+// laneStream returns the stream of a lane of the given stream. Requests of
+// normal priority stay in the stream itself.
+func laneStream(stream string, p priority.Priority) string {
+	if p == priority.Normal || p == "" {
+		return stream
+	}
+	return stream + ":" + string(p)
+}
+
+// withLanes returns the streams of every lane of the given streams, from the
+// highest lane down, if requests are queued by priority.
+func (r *Redis) withLanes(streams []string) []string {
+	if !r.lanes {
+		return streams
+	}
+	all := make([]string, 0, len(priority.Lanes)*len(streams))
+	for _, lane := range priority.Lanes {
+		for _, stream := range streams {
+			all = append(all, laneStream(stream, lane))
+		}
+	}
+	return all
+}
+
+// streams returns the names of all streams messages are written to, not
+// counting their lanes.
+func (r *Redis) streams(ctx context.Context) ([]string, error) {
+	if r.format == "" {
+		return []string{r.stream}, nil
+	}
+	streams, err := r.client.SMembers(ctx, r.set).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list streams in %q: %w", r.set, err)
+	}
+	sort.Strings(streams)
+	return streams, nil
+}
+
+// knownStreams returns the streams messages are written to like streams does,
+// but only reads the set again once the configured interval has passed, or
+// while it is empty.
+func (r *Redis) knownStreams(ctx context.Context) ([]string, error) {
+	if len(r.known) > 0 && time.Since(r.listed) < r.setInterval {
+		return r.known, nil
+	}
+	streams, err := r.streams(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.known, r.listed = streams, time.Now()
+	return streams, nil
+}
+
+// retractScript deletes an entry from a stream only if the consumer group
+// hasn't read it yet, so that it is either taken back or delivered, but never
+// both. Entries of streams the group doesn't exist on yet are left alone, as
+// the group may start reading from before them.
+var retractScript = redis.NewScript(`
+local function after(a, b)
+	local am, as = string.match(a, '^(%d+)-(%d+)$')
+	local bm, bs = string.match(b, '^(%d+)-(%d+)$')
+	if not am or not bm then
+		return false
+	end
+	am, as, bm, bs = tonumber(am), tonumber(as), tonumber(bm), tonumber(bs)
+	return am > bm or (am == bm and as > bs)
+end
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+for _, group in ipairs(redis.call('XINFO', 'GROUPS', KEYS[1])) do
+	local name, last
+	for i = 1, #group, 2 do
+		if group[i] == 'name' then
+			name = group[i + 1]
+		elseif group[i] == 'last-delivered-id' then
+			last = group[i + 1]
+		end
+	end
+	if name == ARGV[1] then
+		if last and after(ARGV[2], last) then
+			return redis.call('XDEL', KEYS[1], ARGV[2])
+		end
+		return 0
+	end
+end
+return 0
+`)
+
+// Retract deletes the entry with the given ref, unless the consumer group has
+// read it already. Messages can't be taken back from a RedisStreamSource, as
+// its consumer group isn't known.
+func (r *Redis) Retract(ctx context.Context, ref string) (bool, error) {
+	i := strings.LastIndex(ref, " ")
+	if r.group == "" || i < 0 {
+		return false, nil
+	}
+	stream, id := ref[:i], ref[i+1:]
+	deleted, err := retractScript.Run(ctx, r.client, []string{stream}, r.group, id).Int64()
+	if err != nil {
+		return false, fmt.Errorf("failed to retract %s from %q: %w", id, stream, err)
+	}
+	return deleted > 0, nil
+}
+
+// Check pings Redis.
+func (r *Redis) Check(ctx context.Context) error {
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("failed to reach Redis: %w", err)
+	}
+	return nil
+}
+
+// Publish adds the message to the stream of its service, recording the
+// stream if there is one per service, and to the lane of its priority. The
+// data comes first, as the RedisStreamSource sends the fields of an entry in
+// order.
+func (r *Redis) Publish(ctx context.Context, msg Message) error {
+	_, err := r.PublishRef(ctx, msg)
+	return err
+}
+
+// PublishRef adds the message like Publish does, and returns its stream and
+// entry ID as its ref.
+func (r *Redis) PublishRef(ctx context.Context, msg Message) (string, error) {
+	stream := r.streamFor(msg.Service)
+	if r.format != "" {
+		if err := r.client.SAdd(ctx, r.set, stream).Err(); err != nil {
+			return "", fmt.Errorf("failed to record stream %q: %w", stream, err)
+		}
+	}
+	if r.lanes {
+		stream = laneStream(stream, msg.Priority)
+	}
+	strCMD := r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		Values: []interface{}{dataField, msg.Data, idField, msg.ID},
+	})
+	if strCMD.Err() != nil {
+		return "", fmt.Errorf("failed to publish %q: %v", msg.ID, strCMD.Err())
+	}
+	return entryRef(stream, strCMD.Val()), nil
+}
+
+// entryRef returns the ref of the entry with the given ID in stream. Stream
+// names may hold spaces, entry IDs don't.
+func entryRef(stream, id string) string {
+	return stream + " " + id
+}
+
+// PublishBatch adds the messages like Publish does, in a single pipeline.
+// Streams per service are recorded beforehand, so that no message is added to
+// a stream the consumer doesn't know about.
+func (r *Redis) PublishBatch(ctx context.Context, msgs []Message) []error {
+	_, errs := r.PublishBatchRef(ctx, msgs)
+	return errs
+}
+
+// PublishBatchRef adds the messages like PublishBatch does, and returns their
+// refs like PublishRef does.
+func (r *Redis) PublishBatchRef(ctx context.Context, msgs []Message) ([]string, []error) {
+	refs := make([]string, len(msgs))
+	errs := make([]error, len(msgs))
+	streams := make([]string, len(msgs))
+	recorded := make(map[string]bool)
+	members := make([]interface{}, 0)
+	for i, msg := range msgs {
+		stream := r.streamFor(msg.Service)
+		if r.format != "" && !recorded[stream] {
+			recorded[stream] = true
+			members = append(members, stream)
+		}
+		if r.lanes {
+			stream = laneStream(stream, msg.Priority)
+		}
+		streams[i] = stream
+	}
+	if len(members) > 0 {
+		if err := r.client.SAdd(ctx, r.set, members...).Err(); err != nil {
+			for i := range errs {
+				errs[i] = fmt.Errorf("failed to record streams of %q: %w", msgs[i].ID, err)
+			}
+			return refs, errs
+		}
+	}
+	cmds := make([]*redis.StringCmd, len(msgs))
+	// The errors of the commands are looked at one by one.
+	_, _ = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, msg := range msgs {
+			cmds[i] = pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: streams[i],
+				Values: []interface{}{dataField, msg.Data, idField, msg.ID},
+			})
+		}
+		return nil
+	})
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			errs[i] = fmt.Errorf("failed to publish %q: %w", msgs[i].ID, err)
+			continue
+		}
+		refs[i] = entryRef(streams[i], cmd.Val())
+	}
+	return refs, errs
+}
+
+// streamMessage is a message read from one of the streams.
+type streamMessage struct {
+	redis.XMessage
+	stream    string
+	exhausted bool
+}
+
+// Subscribe reads messages with the consumer group, creating it on every
+// stream as needed. Messages are acknowledged once the handler succeeds on
+// them. Messages left unacknowledged for the visibility timeout, because the
+// handler failed or its consumer died, are claimed and handled again, up to
+// the configured number of deliveries. After that they are handed to the
+// handler once more as exhausted, and stay pending until it succeeds on them.
+// Pending messages are looked for every half of the visibility timeout.
+func (r *Redis) Subscribe(ctx context.Context, handler Handler) error {
+	sched := newFairScheduler(r.weights)
+	served := 0
+	for ctx.Err() == nil {
+		streams, err := r.knownStreams(ctx)
+		if err == nil {
+			err = r.createGroups(ctx, r.withLanes(streams))
+		}
+		var msgs []streamMessage
+		if err == nil && time.Since(r.claimed) >= r.visibilityTimeout/2 {
+			msgs, err = r.claim(ctx, r.withLanes(streams))
+		}
+		if err == nil && len(msgs) == 0 {
+			msgs, err = r.read(ctx, r.order(sched, streams, served))
+		}
+		if ctx.Err() != nil {
+			break
+		} else if err != nil {
+			return err
+		}
+		if len(streams) == 0 {
+			// Nothing was published yet.
+			select {
+			case <-ctx.Done():
+			case <-time.After(r.readBlock()):
+			}
+			continue
+		}
+		// Messages wait their turn while the ones read before them are
+		// handled, so they are all kept claimed until then.
+		stop := r.keepClaimed(ctx, msgs)
+		for _, msg := range msgs {
+			served++
+			sched.served(msg.stream)
+			r.handle(ctx, handler, msg)
+		}
+		stop()
+	}
+	return ctx.Err()
+}
+
+// order returns the streams in the order they are read from, given the number
+// of messages served so far. Lanes are read from the highest down, except
+// that the low lane goes first often enough to get its share of the messages
+// while it has any. Within a lane, streams are read by weighted fair queuing.
+func (r *Redis) order(sched *fairScheduler, streams []string, served int) []string {
+	if !r.lanes {
+		return sched.order(streams)
+	}
+	lanes := priority.Lanes
+	if r.lowShare > 0 {
+		every := 100 / r.lowShare
+		if every < 1 {
+			every = 1
+		}
+		if served%every == every-1 {
+			lanes = []priority.Priority{priority.Low, priority.High, priority.Normal}
+		}
+	}
+	ordered := make([]string, 0, len(lanes)*len(streams))
+	for _, lane := range lanes {
+		laneStreams := make([]string, 0, len(streams))
+		for _, stream := range streams {
+			laneStreams = append(laneStreams, laneStream(stream, lane))
+		}
+		ordered = append(ordered, sched.order(laneStreams)...)
+	}
+	return ordered
+}
+
+// createGroups creates the consumer group on streams it isn't known to exist
+// on yet.
+func (r *Redis) createGroups(ctx context.Context, streams []string) error {
+	for _, stream := range streams {
+		if r.groups[stream] {
+			continue
+		}
+		// Streams of services are recorded once something is written to
+		// them, so their groups read them from the start.
+		start := r.start
+		if r.format != "" {
+			start = "0"
+		}
+		err := r.client.XGroupCreateMkStream(ctx, stream, r.group, start).Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return fmt.Errorf("failed to create consumer group %q on %q: %w", r.group, stream, err)
+		}
+		r.groups[stream] = true
+	}
+	return nil
+}
+
+// claim takes over the messages that have been pending for longer than the
+// visibility timeout on all of the streams, up to the read count on each.
+// Messages delivered too often are marked as exhausted, for the handler to
+// give up on. Claiming starts over right away if a stream may have more.
+func (r *Redis) claim(ctx context.Context, streams []string) ([]streamMessage, error) {
+	r.claimed = time.Now()
+	claimed := make([]streamMessage, 0)
+	for _, stream := range streams {
+		msgs, _, err := r.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    r.group,
+			Consumer: r.consumer,
+			MinIdle:  r.visibilityTimeout,
+			Start:    "0",
+			Count:    r.readCount,
+		}).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim from %q: %w", stream, err)
+		} else if len(msgs) == 0 {
+			continue
+		} else if int64(len(msgs)) == r.readCount {
+			r.claimed = time.Time{}
+		}
+		deliveries := make(map[string]int64, len(msgs))
+		if r.maxDeliver > 0 {
+			pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: stream,
+				Group:  r.group,
+				Start:  msgs[0].ID,
+				End:    msgs[len(msgs)-1].ID,
+				Count:  int64(len(msgs)),
+			}).Result()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read deliveries of %q: %w", stream, err)
+			}
+			for _, p := range pending {
+				deliveries[p.ID] = p.RetryCount
+			}
+		}
+		for _, msg := range msgs {
+			exhausted := r.maxDeliver > 0 && deliveries[msg.ID] > r.maxDeliver
+			if exhausted {
+				log.Printf("Giving up on message %s after %d deliveries", msg.ID, r.maxDeliver)
+			}
+			claimed = append(claimed, streamMessage{XMessage: msg, stream: stream, exhausted: exhausted})
+		}
+	}
+	return claimed, nil
+}
+
+// read returns the next new messages for the consumer group from the first of
+// the streams, in the given order, that has any. If none has, it waits for
+// new messages on any of them, which may return some of every stream.
+func (r *Redis) read(ctx context.Context, streams []string) ([]streamMessage, error) {
+	if len(streams) == 0 {
+		return nil, nil
+	}
+	if len(streams) > 1 {
+		for _, stream := range streams {
+			msgs, err := r.readGroup(ctx, []string{stream}, -1)
+			if len(msgs) > 0 || err != nil {
+				return msgs, err
+			}
+		}
+	}
+	return r.readGroup(ctx, streams, r.readBlock())
+}
+
+// readGroup reads up to the read count of new messages from each of the
+// streams, blocking for up to block if there are none, or not at all if block
+// is negative.
+func (r *Redis) readGroup(ctx context.Context, streams []string, block time.Duration) ([]streamMessage, error) {
+	args := make([]string, 0, 2*len(streams))
+	args = append(args, streams...)
+	for range streams {
+		args = append(args, ">")
+	}
+	res, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    r.group,
+		Consumer: r.consumer,
+		Streams:  args,
+		Count:    r.readCount,
+		Block:    block,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read from %v: %w", streams, err)
+	}
+	msgs := make([]streamMessage, 0, len(res))
+	for _, stream := range res {
+		for _, msg := range stream.Messages {
+			msgs = append(msgs, streamMessage{XMessage: msg, stream: stream.Stream})
+		}
+	}
+	return msgs, nil
+}
+
+// readBlock is how long a read waits for new messages.
+func (r *Redis) readBlock() time.Duration {
+	if r.visibilityTimeout > 0 && r.visibilityTimeout < readBlock {
+		return r.visibilityTimeout
+	}
+	return readBlock
+}
+
+// handle passes a message to the handler, acknowledging it if the handler
+// succeeds.
+func (r *Redis) handle(ctx context.Context, handler Handler, msg streamMessage) {
+	data, _ := msg.Values[dataField].(string)
+	id, _ := msg.Values[idField].(string)
+	err := handler(ctx, Message{ID: id, Data: []byte(data), Exhausted: msg.exhausted})
+	if err != nil {
+		// The message stays pending and is claimed again once the
+		// visibility timeout has passed.
+		log.Println("Error handling message ", err)
+		return
+	}
+	r.ack(msg.stream, msg.ID)
+}
+
+// keepClaimed resets the idle time of pending messages every half of the
+// visibility timeout, so other consumers don't claim them while they are
+// being handled. Messages that were acknowledged meanwhile are left alone by
+// Redis. The returned function stops doing so.
+func (r *Redis) keepClaimed(ctx context.Context, msgs []streamMessage) func() {
+	if r.visibilityTimeout <= 0 || len(msgs) == 0 {
+		return func() {}
+	}
+	ids := make(map[string][]string)
+	for _, msg := range msgs {
+		ids[msg.stream] = append(ids[msg.stream], msg.ID)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(r.visibilityTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for stream, ids := range ids {
+					err := r.client.XClaimJustID(ctx, &redis.XClaimArgs{
+						Stream:   stream,
+						Group:    r.group,
+						Consumer: r.consumer,
+						Messages: ids,
+					}).Err()
+					if err != nil && ctx.Err() == nil {
+						log.Println("Error renewing claim of messages ", err)
+					}
+				}
+			}
+		}
+	}()
+	return cancel
+}
+
+// TrimAcknowledged removes the entries all consumers of the group are done
+// with from every stream, and returns the length of the streams afterwards.
+// Without a configured group, such as when a RedisStreamSource reads the
+// stream, entries are removed once every group of the stream is done with
+// them.
+func (r *Redis) TrimAcknowledged(ctx context.Context) (int64, error) {
+	streams, err := r.streams(ctx)
+	if err != nil {
+		return 0, err
+	}
+	total := int64(0)
+	for _, stream := range r.withLanes(streams) {
+		length, err := r.trim(ctx, stream)
+		total += length
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// trim removes acknowledged entries from a stream and returns its length.
+// Entries before the oldest pending one of a group, or before the last one
+// delivered to it if none are pending, have been acknowledged by it. Nothing
+// is removed until the group, or any group if none is configured, exists.
+func (r *Redis) trim(ctx context.Context, stream string) (int64, error) {
+	length, err := r.client.XLen(ctx, stream).Result()
+	if err != nil || length == 0 {
+		return length, err
+	}
+	groups, err := r.client.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		return length, fmt.Errorf("failed to read consumer groups of %q: %w", stream, err)
+	}
+	minID := ""
+	for _, group := range groups {
+		if r.group != "" && group.Name != r.group {
+			continue
+		}
+		acked := group.LastDeliveredID
+		pending, err := r.client.XPending(ctx, stream, group.Name).Result()
+		if err != nil {
+			return length, fmt.Errorf("failed to read pending messages of %q: %w", stream, err)
+		}
+		if pending.Count > 0 {
+			acked = pending.Lower
+		}
+		if minID == "" || lessID(acked, minID) {
+			minID = acked
+		}
+	}
+	if minID == "" {
+		return length, nil
+	}
+	trimmed, err := r.client.XTrimMinID(ctx, stream, minID).Result()
+	if err != nil {
+		return length, fmt.Errorf("failed to trim %q: %w", stream, err)
+	}
+	return length - trimmed, nil
+}
+
+// lessID reports whether the stream entry ID a comes before b.
+func lessID(a, b string) bool {
+	aMs, aSeq := splitID(a)
+	bMs, bSeq := splitID(b)
+	return aMs < bMs || (aMs == bMs && aSeq < bSeq)
+}
+
+// splitID splits a stream entry ID into its time and sequence number.
+func splitID(id string) (ms, seq uint64) {
+	i := strings.Index(id, "-")
+	if i < 0 {
+		ms, _ = strconv.ParseUint(id, 10, 64)
+		return ms, 0
+	}
+	ms, _ = strconv.ParseUint(id[:i], 10, 64)
+	seq, _ = strconv.ParseUint(id[i+1:], 10, 64)
+	return ms, seq
+}
+
+// ack acknowledges a message. It is done even while shutting down, so a
+// message that was handled isn't handled again.
+func (r *Redis) ack(stream, id string) {
+	if err := r.client.XAck(context.Background(), stream, r.group, id).Err(); err != nil {
+		log.Println("Error acknowledging message ", err)
+	}
+}
@@ -3,6 +3,7 @@ package ingress
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"strings"
 
@@ -18,6 +19,9 @@ import (
 	netclientset "knative.dev/networking/pkg/client/clientset/versioned"
 	networkinglisters "knative.dev/networking/pkg/client/listers/networking/v1alpha1"
 
+	"knative.dev/async-component/pkg/deadline"
+	"knative.dev/async-component/pkg/priority"
+	"knative.dev/async-component/pkg/retry"
 	"knative.dev/pkg/kmeta"
 	"knative.dev/pkg/logging"
 	network "knative.dev/pkg/network"
@@ -50,6 +54,36 @@ const (
 	ingressKourier          = "kourier.ingress.networking.knative.dev"
 )
 
+// Annotations overriding the retry policy of the consumer for a service.
+const (
+	RetryMaxAttemptsAnnotationKey = "async.knative.dev/retry-max-attempts"
+	RetryStatusCodesAnnotationKey = "async.knative.dev/retry-status-codes"
+	RetryBackoffAnnotationKey     = "async.knative.dev/retry-backoff"
+	RetryMaxBackoffAnnotationKey  = "async.knative.dev/retry-max-backoff"
+)
+
+// Annotations bounding the time the consumer spends on requests to a service.
+const (
+	TimeoutAnnotationKey  = "async.knative.dev/timeout"
+	DeadlineAnnotationKey = "async.knative.dev/deadline"
+)
+
+// MaxPriorityAnnotationKey caps the priority callers of a service may ask for.
+const MaxPriorityAnnotationKey = "async.knative.dev/max-priority"
+
+// annotationHeaders maps annotations configuring the asynchronous handling of
+// a service to the headers passing them on to the producer. They are apart
+// from the headers clients send, which the producer caps with them.
+var annotationHeaders = map[string]string{
+	RetryMaxAttemptsAnnotationKey: retry.ServiceMaxAttemptsHeader,
+	RetryStatusCodesAnnotationKey: retry.ServiceStatusCodesHeader,
+	RetryBackoffAnnotationKey:     retry.ServiceBackoffHeader,
+	RetryMaxBackoffAnnotationKey:  retry.ServiceMaxBackoffHeader,
+	TimeoutAnnotationKey:          deadline.ServiceTimeoutHeader,
+	DeadlineAnnotationKey:         deadline.ServiceDeadlineHeader,
+	MaxPriorityAnnotationKey:      priority.MaxHeader,
+}
+
 type loadBalancerDomain struct {
 	Private, Public string
 }
@@ -75,6 +109,11 @@ func (r *Reconciler) ReconcileKind(ctx context.Context, ing *v1alpha1.Ingress) r
 		logger.Errorf("error validating ingress annotations: %w", err)
 		return err
 	}
+	err = validateHeaderAnnotations(ing.Annotations)
+	if err != nil {
+		logger.Errorf("error validating ingress annotations: %w", err)
+		return err
+	}
 
 	markIngressReady(ing)
 	desired := makeNewIngress(ing, ingressClass)
@@ -138,9 +177,7 @@ func makeNewIngress(ingress *v1alpha1.Ingress, ingressClass string) *v1alpha1.In
 			for _, path := range rule.HTTP.Paths {
 				defaultPath := path
 				defaultPath.Splits = splits
-				defaultPath.AppendHeaders = map[string]string{
-					asyncOriginalHostHeader: network.GetServiceHostname(ingress.Name, ingress.Namespace),
-				}
+				defaultPath.AppendHeaders = makeAsyncHeaders(ingress)
 				defaultPath.RewriteHost = network.GetServiceHostname(producerServiceName, system.Namespace())
 				if path.Headers == nil {
 					path.Headers = map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferSyncValue}}
@@ -153,12 +190,10 @@ func makeNewIngress(ingress *v1alpha1.Ingress, ingressClass string) *v1alpha1.In
 			}
 		} else {
 			newPaths = append(newPaths, v1alpha1.HTTPIngressPath{
-				Headers: map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferAsyncValue}},
-				Splits:  splits,
-				AppendHeaders: map[string]string{
-					asyncOriginalHostHeader: network.GetServiceHostname(ingress.Name, ingress.Namespace),
-				},
-				RewriteHost: network.GetServiceHostname(producerServiceName, system.Namespace()),
+				Headers:       map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferAsyncValue}},
+				Splits:        splits,
+				AppendHeaders: makeAsyncHeaders(ingress),
+				RewriteHost:   network.GetServiceHostname(producerServiceName, system.Namespace()),
 			})
 			newPaths = append(newPaths, newRule.HTTP.Paths...)
 			newRule.HTTP.Paths = newPaths
@@ -183,6 +218,20 @@ func makeNewIngress(ingress *v1alpha1.Ingress, ingressClass string) *v1alpha1.In
 	}
 }
 
+// makeAsyncHeaders returns the headers appended to requests routed to the
+// producer, telling it where the request was meant to go and how to handle it.
+func makeAsyncHeaders(ingress *v1alpha1.Ingress) map[string]string {
+	headers := map[string]string{
+		asyncOriginalHostHeader: network.GetServiceHostname(ingress.Name, ingress.Namespace),
+	}
+	for annotation, header := range annotationHeaders {
+		if value := ingress.Annotations[annotation]; value != "" {
+			headers[header] = value
+		}
+	}
+	return headers
+}
+
 func markIngressReady(ingress *v1alpha1.Ingress) {
 	privateDomain := domainForLocalGateway(ingress.Name, true)
 	publicDomain := domainForLocalGateway(ingress.Name, false)
@@ -282,3 +331,22 @@ func validateAsyncModeAnnotation(annotations map[string]string) error {
 	}
 	return nil
 }
+
+func validateHeaderAnnotations(annotations map[string]string) error {
+	headers := http.Header{}
+	for annotation, header := range annotationHeaders {
+		if value := annotations[annotation]; value != "" {
+			headers.Set(header, value)
+		}
+	}
+	if _, err := retry.FromHeaders(headers); err != nil {
+		return fmt.Errorf("Invalid retry annotations: %w", err)
+	}
+	if _, err := deadline.FromHeaders(headers); err != nil {
+		return fmt.Errorf("Invalid deadline annotations: %w", err)
+	}
+	if _, err := priority.FromHeaders(headers); err != nil {
+		return fmt.Errorf("Invalid priority annotations: %w", err)
+	}
+	return nil
+}
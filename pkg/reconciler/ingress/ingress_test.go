@@ -124,6 +124,33 @@ var ingInvalidModeAnnotation = ingress(defaultNamespace, testingName, statusRead
 		AsyncModeAnnotationKey:               "invalid.mode.annotation.value",
 	}),
 )
+var ingWithRetryAnnotations = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		RetryMaxAttemptsAnnotationKey:        "5",
+		RetryStatusCodesAnnotationKey:        "500,503",
+		TimeoutAnnotationKey:                 "30s",
+		MaxPriorityAnnotationKey:             "normal",
+	}),
+)
+var ingInvalidRetryAnnotation = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		RetryBackoffAnnotationKey:            "soon",
+	}),
+)
+var ingInvalidDeadlineAnnotation = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		DeadlineAnnotationKey:                "tomorrow",
+	}),
+)
+var ingInvalidPriorityAnnotation = ingress(defaultNamespace, testingName, statusReady,
+	withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		MaxPriorityAnnotationKey:             "urgent",
+	}),
+)
 
 var alwaysAsyncPaths = []netv1alpha1.HTTPIngressPath{{
 	Headers: map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferSyncValue}},
@@ -177,9 +204,40 @@ var conditionalAsyncPaths = []netv1alpha1.HTTPIngressPath{{
 		}},
 	}},
 }
+var retryAsyncPaths = []netv1alpha1.HTTPIngressPath{{
+	RewriteHost: network.GetServiceHostname(producerServiceName, knativeTesting),
+	Headers:     map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferAsyncValue}},
+	Splits: []netv1alpha1.IngressBackendSplit{{
+		IngressBackend: v1alpha1.IngressBackend{
+			ServiceName:      testingName + asyncSuffix,
+			ServiceNamespace: defaultNamespace,
+			ServicePort:      intstr.FromInt(80),
+		},
+		Percent: int(100),
+	}},
+	AppendHeaders: map[string]string{
+		asyncOriginalHostHeader:            network.GetServiceHostname(testingName, defaultNamespace),
+		"Async-Service-Retry-Max-Attempts": "5",
+		"Async-Service-Retry-Status-Codes": "500,503",
+		"Async-Service-Timeout":            "30s",
+		"Async-Max-Priority":               "normal",
+	}},
+	{Splits: []netv1alpha1.IngressBackendSplit{{
+		Percent: 100,
+		AppendHeaders: map[string]string{
+			networkpkg.OriginalHostHeader: testHost,
+		},
+		IngressBackend: netv1alpha1.IngressBackend{
+			ServiceNamespace: defaultNamespace,
+			ServiceName:      serviceName,
+			ServicePort:      intstr.FromInt(80),
+		}},
+	}},
+}
 var createdIng = ingressWithPaths(defaultNamespace, testingName, statusUnknown, conditionalAsyncPaths)
 var createdIngWithAsyncAlways = ingressWithPaths(defaultNamespace, testingAlwaysAsyncName, statusUnknown, alwaysAsyncPaths)
 var createdIngWithIstio = ingressWithIstio(defaultNamespace, testingName, statusUnknown, conditionalAsyncPaths)
+var createdIngWithRetry = ingressWithPaths(defaultNamespace, testingName, statusUnknown, retryAsyncPaths)
 var createdUnknownLBIng = ingressWithUnknownLB(defaultNamespace, testingName, statusUnknown, conditionalAsyncPaths)
 
 func TestReconcile(t *testing.T) {
@@ -239,6 +297,42 @@ func TestReconcile(t *testing.T) {
 		WantErr: true,
 		WantEvents: []string{
 			Eventf(corev1.EventTypeWarning, "InternalError", "Invalid value for key async.knative.dev/mode: "),
+		}}, {
+		Name: "create new ingress with retry and timeout annotations",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithRetryAnnotations,
+		},
+		WantCreates: []runtime.Object{
+			createdIngWithRetry,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "create new ingress with invalid retry annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingInvalidRetryAnnotation,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", `Invalid retry annotations: invalid value for Async-Service-Retry-Backoff: "soon"`),
+		}}, {
+		Name: "create new ingress with invalid deadline annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingInvalidDeadlineAnnotation,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", `Invalid deadline annotations: invalid value for Async-Service-Deadline: "tomorrow"`),
+		}}, {
+		Name: "create new ingress with invalid priority annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingInvalidPriorityAnnotation,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", `Invalid priority annotations: invalid value for Async-Max-Priority: unknown priority "urgent"`),
 		}},
 	}
 
@@ -0,0 +1,220 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Config holds the options of the connection to Redis beyond its address.
+// Credentials and certificates are meant to come from a Secret, either as
+// environment variables or as files it is mounted as. The files are read again
+// every ReloadInterval, so that a rotated Secret is used without a restart.
+type Config struct {
+	// Username and Password authenticate as an ACL user, or with the
+	// default user if Username is empty. PasswordFile is read in place of
+	// Password if set.
+	Username     string `envconfig:"REDIS_USERNAME"`
+	Password     string `envconfig:"REDIS_PASSWORD"`
+	PasswordFile string `envconfig:"REDIS_PASSWORD_FILE"`
+	DB           int    `envconfig:"REDIS_DB"`
+	// SentinelMaster names the master monitored by the Sentinels at the
+	// address, which then lists them separated by commas. SentinelUsername
+	// and SentinelPassword authenticate with the Sentinels, which take the
+	// password of PasswordFile as it is at startup if SentinelPassword is
+	// empty.
+	SentinelMaster   string `envconfig:"REDIS_SENTINEL_MASTER"`
+	SentinelUsername string `envconfig:"REDIS_SENTINEL_USERNAME"`
+	SentinelPassword string `envconfig:"REDIS_SENTINEL_PASSWORD"`
+	// Cluster connects to a Redis Cluster, with the address listing some of
+	// its nodes separated by commas.
+	Cluster bool `envconfig:"REDIS_CLUSTER"`
+	// TLS connects with TLS even without a root CA, trusting the system's
+	// roots. ClientCert and ClientKey are a PEM encoded certificate and key
+	// the client authenticates with. TLSCertFile holds a root CA, which is
+	// used in place of the one given to New, and ClientCertFile and
+	// ClientKeyFile a client certificate and key.
+	TLS            bool   `envconfig:"REDIS_TLS"`
+	TLSServerName  string `envconfig:"REDIS_TLS_SERVER_NAME"`
+	ClientCert     string `envconfig:"REDIS_CLIENT_CERT"`
+	ClientKey      string `envconfig:"REDIS_CLIENT_KEY"`
+	TLSCertFile    string `envconfig:"TLS_CERT_FILE"`
+	ClientCertFile string `envconfig:"REDIS_CLIENT_CERT_FILE"`
+	ClientKeyFile  string `envconfig:"REDIS_CLIENT_KEY_FILE"`
+	// ReloadInterval is how long the files are used before they are read
+	// again, and how long connections are kept when they are used.
+	ReloadInterval time.Duration `envconfig:"REDIS_RELOAD_INTERVAL" default:"30s"`
+}
+
+// New creates a Redis client for the given address. If tlsCert holds a PEM
+// encoded root CA the connection uses TLS, as it does when a client
+// certificate is given or cfg asks for TLS. A single address may be given as
+// a redis:// or rediss:// URL, which is parsed for its options; it must be a
+// URL when tlsCert holds a root CA. The client talks to Sentinels or a
+// Cluster instead if cfg says so.
+func New(address, tlsCert string, cfg Config) (redis.UniversalClient, error) {
+	roots := x509.NewCertPool()
+
+	// AppendCertsFromPEM reports whether a cert was parsed
+	certFound := roots.AppendCertsFromPEM([]byte(tlsCert))
+	if certFound {
+		log.Println("found a cert")
+	} else {
+		log.Println("didnt find a cert")
+		roots = nil
+	}
+	f, err := newFiles(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig(roots, cfg)
+	if err != nil {
+		return nil, err
+	}
+	// Connections are made with the current material of the files, and
+	// replaced once it may have changed, so that no connection outlives a
+	// rotated Secret by more than the reload interval.
+	var dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+	var lifetime time.Duration
+	if f != nil {
+		lifetime = cfg.ReloadInterval
+		if f.tls() {
+			dialer = f.dialer(tlsConfig)
+		}
+	}
+
+	switch {
+	case cfg.SentinelMaster != "" && cfg.Cluster:
+		return nil, errors.New("redis can't be both a Sentinel master and a Cluster")
+	case cfg.SentinelMaster != "":
+		client := redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.SentinelMaster,
+			SentinelAddrs:    splitAddresses(address),
+			SentinelUsername: cfg.SentinelUsername,
+			SentinelPassword: sentinelPassword(cfg, f),
+			Username:         cfg.Username,
+			Password:         cfg.Password,
+			DB:               cfg.DB,
+			Dialer:           dialer,
+			TLSConfig:        tlsConfig,
+			ConnMaxLifetime:  lifetime,
+		})
+		if f != nil {
+			client.Options().CredentialsProvider = f.credentials(cfg.Username)
+		}
+		return client, nil
+	case cfg.Cluster:
+		if cfg.DB != 0 {
+			return nil, errors.New("redis cluster only has database 0")
+		}
+		opt := &redis.ClusterOptions{
+			Addrs:           splitAddresses(address),
+			Username:        cfg.Username,
+			Password:        cfg.Password,
+			Dialer:          dialer,
+			TLSConfig:       tlsConfig,
+			ConnMaxLifetime: lifetime,
+		}
+		if f != nil {
+			opt.NewClient = func(opt *redis.Options) *redis.Client {
+				opt.CredentialsProvider = f.credentials(cfg.Username)
+				return redis.NewClient(opt)
+			}
+		}
+		return redis.NewClusterClient(opt), nil
+	}
+
+	opt := &redis.Options{Addr: address}
+	if certFound || strings.HasPrefix(address, "redis://") || strings.HasPrefix(address, "rediss://") {
+		opt, err = redis.ParseURL(address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Credentials and TLS options set apart take precedence over the URL.
+	if cfg.Username != "" {
+		opt.Username = cfg.Username
+	}
+	if cfg.Password != "" {
+		opt.Password = cfg.Password
+	}
+	if cfg.DB != 0 {
+		opt.DB = cfg.DB
+	}
+	if tlsConfig != nil {
+		if opt.TLSConfig != nil && tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = opt.TLSConfig.ServerName
+		}
+		opt.TLSConfig = tlsConfig
+	}
+	if f != nil {
+		opt.Dialer = dialer
+		opt.CredentialsProvider = f.credentials(opt.Username)
+		opt.ConnMaxLifetime = lifetime
+	}
+	return redis.NewClient(opt), nil
+}
+
+// sentinelPassword returns the password of the Sentinels, which share the
+// password of the file unless they have one of their own. Their clients are
+// made by the failover client, so they only read it once.
+func sentinelPassword(cfg Config, f *files) string {
+	if cfg.SentinelPassword != "" || f == nil || cfg.PasswordFile == "" {
+		return cfg.SentinelPassword
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.password
+}
+
+// newTLSConfig returns the TLS configuration for the given root CAs and
+// client certificate, or nil if the connection doesn't use TLS.
+func newTLSConfig(roots *x509.CertPool, cfg Config) (*tls.Config, error) {
+	if roots == nil && !cfg.TLS && cfg.ClientCert == "" && cfg.TLSCertFile == "" && cfg.ClientCertFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		RootCAs:    roots,
+		ServerName: cfg.TLSServerName,
+	}
+	if cfg.ClientCertFile == "" && (cfg.ClientCert != "" || cfg.ClientKey != "") {
+		cert, err := tls.X509KeyPair([]byte(cfg.ClientCert), []byte(cfg.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// splitAddresses splits a comma separated list of addresses.
+func splitAddresses(address string) []string {
+	addrs := make([]string, 0)
+	for _, a := range strings.Split(address, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// now is swapped in tests.
+var now = time.Now
+
+// files holds the root CA, client certificate and password read from the
+// files of a mounted Secret. Once the reload interval has passed, they are
+// read again when a connection is made, so connections made after the Secret
+// was rotated use the new material while open connections are kept.
+type files struct {
+	cfg Config
+
+	mu       sync.Mutex
+	checked  time.Time
+	contents map[string][]byte
+	roots    *x509.CertPool
+	cert     *tls.Certificate
+	password string
+}
+
+// newFiles reads the files set in cfg, or returns nil if none are set.
+func newFiles(cfg Config) (*files, error) {
+	if cfg.TLSCertFile == "" && cfg.ClientCertFile == "" && cfg.ClientKeyFile == "" && cfg.PasswordFile == "" {
+		return nil, nil
+	}
+	if (cfg.ClientCertFile == "") != (cfg.ClientKeyFile == "") {
+		return nil, errors.New("redis client certificate and key files must be set together")
+	}
+	f := &files{cfg: cfg}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	f.checked = now()
+	return f, nil
+}
+
+// tls reports whether the files hold TLS material.
+func (f *files) tls() bool {
+	return f.cfg.TLSCertFile != "" || f.cfg.ClientCertFile != ""
+}
+
+// load reads the files, and parses them if any of them changed. Nothing is
+// changed if one of them can't be read or parsed. The lock must be held.
+func (f *files) load() error {
+	contents := make(map[string][]byte)
+	changed := false
+	for _, path := range []string{f.cfg.TLSCertFile, f.cfg.ClientCertFile, f.cfg.ClientKeyFile, f.cfg.PasswordFile} {
+		if path == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		contents[path] = b
+		changed = changed || !bytes.Equal(b, f.contents[path])
+	}
+	if !changed {
+		return nil
+	}
+
+	var roots *x509.CertPool
+	if f.cfg.TLSCertFile != "" {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(contents[f.cfg.TLSCertFile]) {
+			return fmt.Errorf("no certificate found in %s", f.cfg.TLSCertFile)
+		}
+	}
+	var cert *tls.Certificate
+	if f.cfg.ClientCertFile != "" {
+		pair, err := tls.X509KeyPair(contents[f.cfg.ClientCertFile], contents[f.cfg.ClientKeyFile])
+		if err != nil {
+			return fmt.Errorf("invalid redis client certificate: %w", err)
+		}
+		cert = &pair
+	}
+	if f.contents != nil {
+		log.Println("reloaded redis secrets")
+	}
+	f.contents = contents
+	f.roots = roots
+	f.cert = cert
+	f.password = string(bytes.TrimRight(contents[f.cfg.PasswordFile], "\r\n"))
+	return nil
+}
+
+// refresh reads the files again if the reload interval has passed since they
+// were last read. The previous material is kept if they can't be read.
+func (f *files) refresh() {
+	if now().Sub(f.checked) < f.cfg.ReloadInterval {
+		return
+	}
+	f.checked = now()
+	if err := f.load(); err != nil {
+		log.Printf("Failed to reload redis secrets: %v", err)
+	}
+}
+
+// credentials returns the username and current password, to be used as the
+// CredentialsProvider of a client.
+func (f *files) credentials(username string) func() (string, string) {
+	return func() (string, string) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.refresh()
+		return username, f.password
+	}
+}
+
+// dialer returns a dialer that connects with TLS, using the current root CA
+// and client certificate in place of those of base.
+func (f *files) dialer(base *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		cfg := base.Clone()
+		f.mu.Lock()
+		f.refresh()
+		if f.roots != nil {
+			cfg.RootCAs = f.roots
+		}
+		if f.cert != nil {
+			cfg.Certificates = []tls.Certificate{*f.cert}
+		}
+		f.mu.Unlock()
+		d := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 5 * time.Minute},
+			Config:    cfg,
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
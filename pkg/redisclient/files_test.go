@@ -0,0 +1,213 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v9"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilesReload(t *testing.T) {
+	checked := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return checked }
+	defer func() { now = time.Now }()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	passwordFile := filepath.Join(dir, "password")
+	cert, _ := newCert(t)
+	writeFile(t, caFile, cert)
+	writeFile(t, passwordFile, "one\n")
+
+	f, err := newFiles(Config{TLSCertFile: caFile, PasswordFile: passwordFile, ReloadInterval: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := f.credentials("producer")
+	if user, password := credentials(); user != "producer" || password != "one" {
+		t.Errorf("credentials() = %q, %q, want producer, one", user, password)
+	}
+
+	writeFile(t, passwordFile, "two")
+	if _, password := credentials(); password != "one" {
+		t.Errorf("credentials() before the reload interval = %q, want one", password)
+	}
+	checked = checked.Add(time.Minute)
+	if _, password := credentials(); password != "two" {
+		t.Errorf("credentials() after the reload interval = %q, want two", password)
+	}
+
+	// Material that can't be parsed is not used.
+	roots := f.roots
+	writeFile(t, caFile, "not a certificate")
+	writeFile(t, passwordFile, "three")
+	checked = checked.Add(time.Minute)
+	if _, password := credentials(); password != "two" {
+		t.Errorf("credentials() with an invalid root CA = %q, want two", password)
+	}
+	if f.roots != roots {
+		t.Error("invalid root CA replaced the previous one")
+	}
+}
+
+func TestNewFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	passwordFile := filepath.Join(dir, "password")
+	cert, key := newCert(t)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	writeFile(t, passwordFile, "secret")
+
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(cert))
+	s := miniredis.NewMiniRedis()
+	err = s.StartTLS(&tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.RequireUserAuth("producer", "secret")
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+		pingErr bool
+	}{{
+		name: "root CA, client certificate and password",
+		cfg: Config{
+			Username:       "producer",
+			PasswordFile:   passwordFile,
+			TLSCertFile:    certFile,
+			ClientCertFile: certFile,
+			ClientKeyFile:  keyFile,
+		},
+	}, {
+		name: "without client certificate",
+		cfg: Config{
+			Username:     "producer",
+			PasswordFile: passwordFile,
+			TLSCertFile:  certFile,
+		},
+		pingErr: true,
+	}, {
+		name: "client certificate without key",
+		cfg: Config{
+			TLSCertFile:    certFile,
+			ClientCertFile: certFile,
+		},
+		wantErr: true,
+	}, {
+		name: "missing file",
+		cfg: Config{
+			PasswordFile: filepath.Join(dir, "missing"),
+		},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := New(s.Addr(), "", test.cfg)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer client.Close()
+			if err := client.Ping(context.Background()).Err(); (err != nil) != test.pingErr {
+				t.Errorf("Ping() error = %v, wantErr %v", err, test.pingErr)
+			}
+		})
+	}
+}
+
+func TestFilesConnections(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	writeFile(t, passwordFile, "secret")
+	cfg := Config{PasswordFile: passwordFile, ReloadInterval: time.Minute}
+
+	tests := []struct {
+		name    string
+		address string
+		cfg     Config
+	}{{
+		name:    "single",
+		address: "localhost:6379",
+		cfg:     cfg,
+	}, {
+		name:    "sentinel",
+		address: "sentinel-0:26379,sentinel-1:26379",
+		cfg:     Config{PasswordFile: passwordFile, ReloadInterval: time.Minute, SentinelMaster: "mymaster"},
+	}, {
+		name:    "cluster",
+		address: "node-0:6379,node-1:6379",
+		cfg:     Config{PasswordFile: passwordFile, ReloadInterval: time.Minute, Cluster: true},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := New(test.address, "", test.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			var lifetime time.Duration
+			switch c := client.(type) {
+			case *redis.Client:
+				lifetime = c.Options().ConnMaxLifetime
+			case *redis.ClusterClient:
+				lifetime = c.Options().ConnMaxLifetime
+			}
+			if lifetime != time.Minute {
+				t.Errorf("ConnMaxLifetime = %v, want %v", lifetime, time.Minute)
+			}
+		})
+	}
+
+	f, err := newFiles(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sentinelPassword(cfg, f); got != "secret" {
+		t.Errorf("sentinelPassword() = %q, want the password of the file", got)
+	}
+	cfg.SentinelPassword = "sentinel"
+	if got := sentinelPassword(cfg, f); got != "sentinel" {
+		t.Errorf("sentinelPassword() = %q, want sentinel", got)
+	}
+}
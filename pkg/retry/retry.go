@@ -0,0 +1,250 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package retry decides whether and when the consumer tries a request again.
+package retry
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers overriding the retry policy. They are sent by clients, and the
+// async ingress caps them with the service headers, taken from the
+// annotations of a service.
+const (
+	MaxAttemptsHeader = "Async-Retry-Max-Attempts"
+	StatusCodesHeader = "Async-Retry-Status-Codes"
+	BackoffHeader     = "Async-Retry-Backoff"
+	MaxBackoffHeader  = "Async-Retry-Max-Backoff"
+
+	ServiceMaxAttemptsHeader = "Async-Service-Retry-Max-Attempts"
+	ServiceStatusCodesHeader = "Async-Service-Retry-Status-Codes"
+	ServiceBackoffHeader     = "Async-Service-Retry-Backoff"
+	ServiceMaxBackoffHeader  = "Async-Service-Retry-Max-Backoff"
+)
+
+// Headers lists all headers read by FromHeaders.
+var Headers = []string{
+	MaxAttemptsHeader, StatusCodesHeader, BackoffHeader, MaxBackoffHeader,
+	ServiceMaxAttemptsHeader, ServiceStatusCodesHeader, ServiceBackoffHeader, ServiceMaxBackoffHeader,
+}
+
+// policyHeaders names the headers a policy is read from.
+type policyHeaders struct {
+	maxAttempts, statusCodes, backoff, maxBackoff string
+}
+
+var (
+	clientHeaders  = policyHeaders{MaxAttemptsHeader, StatusCodesHeader, BackoffHeader, MaxBackoffHeader}
+	serviceHeaders = policyHeaders{ServiceMaxAttemptsHeader, ServiceStatusCodesHeader, ServiceBackoffHeader, ServiceMaxBackoffHeader}
+)
+
+// Policy describes how often and how fast a request is retried.
+type Policy struct {
+	// MaxAttempts is the number of times a request is sent, including the
+	// first attempt.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// StatusCodes are the response codes a request is retried on. Requests
+	// that fail to connect are always retried.
+	StatusCodes []int `json:"statusCodes,omitempty"`
+	// Backoff is the delay before the first retry, which doubles with every
+	// further attempt up to MaxBackoff.
+	Backoff    time.Duration `json:"backoff,omitempty"`
+	MaxBackoff time.Duration `json:"maxBackoff,omitempty"`
+}
+
+// Merge returns the policy with all fields set in override replaced.
+func (p Policy) Merge(override *Policy) Policy {
+	if override == nil {
+		return p
+	}
+	if override.MaxAttempts > 0 {
+		p.MaxAttempts = override.MaxAttempts
+	}
+	if len(override.StatusCodes) > 0 {
+		p.StatusCodes = override.StatusCodes
+	}
+	if override.Backoff > 0 {
+		p.Backoff = override.Backoff
+	}
+	if override.MaxBackoff > 0 {
+		p.MaxBackoff = override.MaxBackoff
+	}
+	return p
+}
+
+// Limit returns the policy with at most maxAttempts attempts and no backoff
+// longer than maxBackoff, so overrides can't keep a request around for too
+// long. Limits of zero or less aren't applied.
+func (p Policy) Limit(maxAttempts int, maxBackoff time.Duration) Policy {
+	if maxAttempts > 0 && p.MaxAttempts > maxAttempts {
+		p.MaxAttempts = maxAttempts
+	}
+	if maxBackoff > 0 {
+		if p.Backoff > maxBackoff {
+			p.Backoff = maxBackoff
+		}
+		if p.MaxBackoff <= 0 || p.MaxBackoff > maxBackoff {
+			p.MaxBackoff = maxBackoff
+		}
+	}
+	return p
+}
+
+// Cap returns the policy with the attempts and backoffs lowered to those of
+// max if they are unset or higher, and the status codes of max if it has
+// any, so a service decides which of its responses are worth retrying.
+func (p Policy) Cap(max Policy) Policy {
+	if max.MaxAttempts > 0 && (p.MaxAttempts <= 0 || p.MaxAttempts > max.MaxAttempts) {
+		p.MaxAttempts = max.MaxAttempts
+	}
+	if len(max.StatusCodes) > 0 {
+		p.StatusCodes = max.StatusCodes
+	}
+	if max.Backoff > 0 && (p.Backoff <= 0 || p.Backoff > max.Backoff) {
+		p.Backoff = max.Backoff
+	}
+	if max.MaxBackoff > 0 && (p.MaxBackoff <= 0 || p.MaxBackoff > max.MaxBackoff) {
+		p.MaxBackoff = max.MaxBackoff
+	}
+	return p
+}
+
+// Retryable reports whether a response with the given status code is retried.
+func (p Policy) Retryable(code int) bool {
+	for _, c := range p.StatusCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns how long to wait after the given attempt. A Retry-After value
+// sent by the target is honoured, otherwise the exponential backoff is used
+// with half of it randomized. Either way the delay is capped at MaxBackoff.
+func (p Policy) Delay(attempt int, retryAfter string) time.Duration {
+	if d, ok := parseRetryAfter(retryAfter); ok {
+		return p.cap(d)
+	}
+	d := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	d = p.cap(d)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (p Policy) cap(d time.Duration) time.Duration {
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return d
+}
+
+// parseRetryAfter parses a Retry-After value given in seconds or as a date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// ParseStatusCodes parses a comma separated list of HTTP status codes.
+func ParseStatusCodes(v string) ([]int, error) {
+	codes := make([]int, 0)
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		code, err := strconv.Atoi(s)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code %q", s)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// FromHeaders reads a policy override from the retry headers, capped at the
+// policy of the service headers. It returns nil if none of them are set.
+func FromHeaders(h http.Header) (*Policy, error) {
+	p, err := fromHeaders(h, clientHeaders)
+	if err != nil {
+		return nil, err
+	}
+	service, err := fromHeaders(h, serviceHeaders)
+	if err != nil {
+		return nil, err
+	} else if service == nil {
+		return p, nil
+	}
+	if p == nil {
+		p = &Policy{}
+	}
+	*p = p.Cap(*service)
+	return p, nil
+}
+
+// fromHeaders reads a policy from the given headers, or nil if none of them
+// are set.
+func fromHeaders(h http.Header, names policyHeaders) (*Policy, error) {
+	set := false
+	p := &Policy{}
+	if v := h.Get(names.maxAttempts); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid value for %s: %q", names.maxAttempts, v)
+		}
+		p.MaxAttempts, set = n, true
+	}
+	if v := h.Get(names.statusCodes); v != "" {
+		codes, err := ParseStatusCodes(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", names.statusCodes, err)
+		}
+		p.StatusCodes, set = codes, true
+	}
+	for header, field := range map[string]*time.Duration{names.backoff: &p.Backoff, names.maxBackoff: &p.MaxBackoff} {
+		if v := h.Get(header); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid value for %s: %q", header, v)
+			}
+			*field, set = d, true
+		}
+	}
+	if !set {
+		return nil, nil
+	}
+	return p, nil
+}
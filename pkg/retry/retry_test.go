@@ -0,0 +1,203 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retry
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDelay(t *testing.T) {
+	p := Policy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	tests := []struct {
+		name       string
+		attempt    int
+		retryAfter string
+		min, max   time.Duration
+	}{{
+		name:    "first retry",
+		attempt: 1,
+		min:     500 * time.Millisecond,
+		max:     time.Second,
+	}, {
+		name:    "third retry",
+		attempt: 3,
+		min:     2 * time.Second,
+		max:     4 * time.Second,
+	}, {
+		name:    "capped at max backoff",
+		attempt: 10,
+		min:     2500 * time.Millisecond,
+		max:     5 * time.Second,
+	}, {
+		name:       "retry after in seconds",
+		attempt:    1,
+		retryAfter: "3",
+		min:        3 * time.Second,
+		max:        3 * time.Second,
+	}, {
+		name:       "retry after capped at max backoff",
+		attempt:    1,
+		retryAfter: "3600",
+		min:        5 * time.Second,
+		max:        5 * time.Second,
+	}, {
+		name:       "retry after date in the past",
+		attempt:    1,
+		retryAfter: "Wed, 21 Oct 2015 07:28:00 GMT",
+		min:        0,
+		max:        0,
+	}, {
+		name:       "invalid retry after",
+		attempt:    1,
+		retryAfter: "soon",
+		min:        500 * time.Millisecond,
+		max:        time.Second,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 10; i++ {
+				if got := p.Delay(test.attempt, test.retryAfter); got < test.min || got > test.max {
+					t.Errorf("got %v, want between %v and %v", got, test.min, test.max)
+				}
+			}
+		})
+	}
+}
+
+func TestFromHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		want    *Policy
+		wantErr bool
+	}{{
+		name:   "no headers",
+		header: http.Header{},
+	}, {
+		name: "all headers",
+		header: http.Header{
+			MaxAttemptsHeader: []string{"5"},
+			StatusCodesHeader: []string{"500, 503"},
+			BackoffHeader:     []string{"2s"},
+			MaxBackoffHeader:  []string{"1m"},
+		},
+		want: &Policy{
+			MaxAttempts: 5,
+			StatusCodes: []int{500, 503},
+			Backoff:     2 * time.Second,
+			MaxBackoff:  time.Minute,
+		},
+	}, {
+		name: "service headers",
+		header: http.Header{
+			ServiceMaxAttemptsHeader: []string{"5"},
+			ServiceStatusCodesHeader: []string{"503"},
+		},
+		want: &Policy{MaxAttempts: 5, StatusCodes: []int{503}},
+	}, {
+		name: "service caps the client",
+		header: http.Header{
+			MaxAttemptsHeader:        []string{"10"},
+			StatusCodesHeader:        []string{"500"},
+			BackoffHeader:            []string{"1s"},
+			MaxBackoffHeader:         []string{"1h"},
+			ServiceMaxAttemptsHeader: []string{"5"},
+			ServiceStatusCodesHeader: []string{"503"},
+			ServiceBackoffHeader:     []string{"2s"},
+			ServiceMaxBackoffHeader:  []string{"1m"},
+		},
+		want: &Policy{
+			MaxAttempts: 5,
+			StatusCodes: []int{503},
+			Backoff:     time.Second,
+			MaxBackoff:  time.Minute,
+		},
+	}, {
+		name:    "invalid service backoff",
+		header:  http.Header{ServiceBackoffHeader: []string{"2"}},
+		wantErr: true,
+	}, {
+		name:    "invalid max attempts",
+		header:  http.Header{MaxAttemptsHeader: []string{"0"}},
+		wantErr: true,
+	}, {
+		name:    "invalid status code",
+		header:  http.Header{StatusCodesHeader: []string{"500,ok"}},
+		wantErr: true,
+	}, {
+		name:    "invalid backoff",
+		header:  http.Header{BackoffHeader: []string{"2"}},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := FromHeaders(test.header)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("unexpected policy (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	p := Policy{MaxAttempts: 3, StatusCodes: []int{503}, Backoff: time.Second, MaxBackoff: time.Minute}
+	if diff := cmp.Diff(p, p.Merge(nil)); diff != "" {
+		t.Errorf("unexpected policy (-want, +got): %s", diff)
+	}
+	want := Policy{MaxAttempts: 5, StatusCodes: []int{503}, Backoff: time.Second, MaxBackoff: time.Minute}
+	if diff := cmp.Diff(want, p.Merge(&Policy{MaxAttempts: 5})); diff != "" {
+		t.Errorf("unexpected policy (-want, +got): %s", diff)
+	}
+	if !p.Retryable(503) || p.Retryable(500) {
+		t.Errorf("expected only 503 to be retryable")
+	}
+}
+
+func TestLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		want   Policy
+	}{{
+		name:   "within the limits",
+		policy: Policy{MaxAttempts: 3, Backoff: time.Second, MaxBackoff: time.Minute},
+		want:   Policy{MaxAttempts: 3, Backoff: time.Second, MaxBackoff: time.Minute},
+	}, {
+		name:   "past the limits",
+		policy: Policy{MaxAttempts: 1000, Backoff: 24 * time.Hour, MaxBackoff: 48 * time.Hour},
+		want:   Policy{MaxAttempts: 10, Backoff: time.Hour, MaxBackoff: time.Hour},
+	}, {
+		name:   "unbounded backoff",
+		policy: Policy{MaxAttempts: 3, Backoff: time.Second},
+		want:   Policy{MaxAttempts: 3, Backoff: time.Second, MaxBackoff: time.Hour},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := cmp.Diff(test.want, test.policy.Limit(10, time.Hour)); diff != "" {
+				t.Errorf("unexpected policy (-want, +got): %s", diff)
+			}
+		})
+	}
+	p := Policy{MaxAttempts: 1000, Backoff: 24 * time.Hour}
+	if diff := cmp.Diff(p, p.Limit(0, 0)); diff != "" {
+		t.Errorf("unexpected policy without limits (-want, +got): %s", diff)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedule
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps entries in memory. It is meant for tests and single
+// process setups.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries []memoryEntry
+}
+
+// memoryEntry is an entry along with when it is due, or its lease runs out
+// once taken.
+type memoryEntry struct {
+	Entry
+	at time.Time
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Add keeps the entry until it is due.
+func (s *MemoryStore) Add(ctx context.Context, e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, memoryEntry{Entry: e, at: e.Due})
+	s.sort()
+	return nil
+}
+
+// TakeDue leases up to limit entries that are due and returns them.
+func (s *MemoryStore) TakeDue(ctx context.Context, now time.Time, limit int64, lease time.Duration) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	due := make([]Entry, 0)
+	for i := 0; i < len(s.entries) && int64(i) < limit && !s.entries[i].at.After(now); i++ {
+		due = append(due, s.entries[i].Entry)
+		s.entries[i].at = now.Add(lease)
+	}
+	s.sort()
+	return due, nil
+}
+
+// Done removes an entry returned by TakeDue.
+func (s *MemoryStore) Done(ctx context.Context, e Entry) (bool, error) {
+	removed, _ := s.Remove(ctx, e.ID)
+	return removed != nil, nil
+}
+
+// Remove removes the entry of the request with the given ID.
+func (s *MemoryStore) Remove(ctx context.Context, id string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, entry := range s.entries {
+		if entry.ID == id {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			return &entry.Entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// sort orders the entries by when they are due.
+func (s *MemoryStore) sort() {
+	sort.SliceStable(s.entries, func(i, j int) bool {
+		return s.entries[i].at.Before(s.entries[j].at)
+	})
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package schedule holds asynchronous requests back until they are due.
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+
+	"knative.dev/async-component/pkg/priority"
+)
+
+// Headers scheduling a request for later.
+const (
+	NotBeforeHeader = "Async-Not-Before"
+	DelayHeader     = "Async-Delay"
+)
+
+// Headers lists all headers read by FromHeaders.
+var Headers = []string{NotBeforeHeader, DelayHeader}
+
+// FromHeaders returns when a request received at now is due, which is the
+// later of the time given in RFC 3339 format by NotBeforeHeader and now plus
+// the Go duration given by DelayHeader. It returns false if the request is
+// due right away.
+func FromHeaders(h http.Header, now time.Time) (time.Time, bool, error) {
+	due := now
+	if v := h.Get(NotBeforeHeader); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("invalid value for %s: %q", NotBeforeHeader, v)
+		}
+		if t.After(due) {
+			due = t
+		}
+	}
+	if v := h.Get(DelayHeader); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return time.Time{}, false, fmt.Errorf("invalid value for %s: %q", DelayHeader, v)
+		}
+		if t := now.Add(d); t.After(due) {
+			due = t
+		}
+	}
+	return due.UTC(), due.After(now), nil
+}
+
+// Entry is a request waiting to be queued.
+type Entry struct {
+	ID       string            `json:"id"`
+	Due      time.Time         `json:"due"`
+	Service  string            `json:"service,omitempty"`
+	Priority priority.Priority `json:"priority,omitempty"`
+	// Request is the JSON encoded request as it is queued.
+	Request json.RawMessage `json:"request"`
+
+	// member is what the entry is kept as, once it was taken.
+	member string
+}
+
+// Store keeps requests until they are due.
+type Store interface {
+	// Add keeps the entry until it is due.
+	Add(ctx context.Context, e Entry) error
+	// TakeDue leases up to limit entries that are due at the given time and
+	// returns them, earliest first. An entry is only returned to one caller
+	// at a time, even to concurrent callers: it isn't due again until the
+	// lease has passed. Entries that are done with are removed with Done,
+	// so that entries whose caller failed on them or died are taken again.
+	TakeDue(ctx context.Context, now time.Time, limit int64, lease time.Duration) ([]Entry, error)
+	// Done removes an entry returned by TakeDue, and reports whether it was
+	// still there.
+	Done(ctx context.Context, e Entry) (bool, error)
+	// Remove removes the entry of the request with the given ID, whether it
+	// was taken or not, and returns it. It returns nil if there is none.
+	Remove(ctx context.Context, id string) (*Entry, error)
+}
+
+// RedisStore keeps the IDs of entries in a Redis sorted set, scored by the
+// Unix time in milliseconds they are due at, or their lease runs out at once
+// taken, and the entries in a hash by their ID.
+type RedisStore struct {
+	client  redis.Cmdable
+	key     string
+	entries string
+}
+
+// NewRedisStore creates a Store keeping entries under key.
+func NewRedisStore(client redis.Cmdable, key string) *RedisStore {
+	return &RedisStore{
+		client:  client,
+		key:     key,
+		entries: entriesKey(key),
+	}
+}
+
+// entriesKey returns the key of the hash holding the entries, which is in the
+// same Redis Cluster slot as the sorted set, as both are used by a script.
+func entriesKey(key string) string {
+	if open := strings.Index(key, "{"); open >= 0 {
+		if end := strings.Index(key[open+1:], "}"); end > 0 {
+			// The key has a hash tag of its own, which is kept.
+			return key + ":requests"
+		}
+	}
+	return "{" + key + "}:requests"
+}
+
+// addScript keeps an entry and schedules its ID in one go.
+var addScript = redis.NewScript(`
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+`)
+
+// Add keeps the entry until it is due.
+func (s *RedisStore) Add(ctx context.Context, e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scheduled request %s: %w", e.ID, err)
+	}
+	err = addScript.Run(ctx, s.client, []string{s.key, s.entries}, e.ID, b, e.Due.UnixMilli()).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("failed to schedule request %s: %w", e.ID, err)
+	}
+	return nil
+}
+
+// takeScript moves due entries to the end of their lease in one go, so that
+// concurrent producers never take the same entry, and returns every member
+// followed by its entry. Members scheduled by producers that kept the entries
+// in the sorted set have no entry in the hash.
+var takeScript = redis.NewScript(`
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+local taken = {}
+for _, member in ipairs(members) do
+	redis.call('ZADD', KEYS[1], ARGV[3], member)
+	table.insert(taken, member)
+	table.insert(taken, redis.call('HGET', KEYS[2], member) or '')
+end
+return taken
+`)
+
+// TakeDue leases up to limit entries that are due and returns them.
+func (s *RedisStore) TakeDue(ctx context.Context, now time.Time, limit int64, lease time.Duration) ([]Entry, error) {
+	taken, err := takeScript.Run(ctx, s.client, []string{s.key, s.entries},
+		now.UnixMilli(), limit, now.Add(lease).UnixMilli()).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take scheduled requests: %w", err)
+	}
+	entries := make([]Entry, 0, len(taken)/2)
+	for i := 0; i+1 < len(taken); i += 2 {
+		member, data := taken[i], taken[i+1]
+		if data == "" {
+			data = member
+		}
+		e := Entry{}
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return entries, fmt.Errorf("failed to unmarshal scheduled request: %w", err)
+		}
+		e.member = member
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// removeScript removes a member and its entry in one go, returning the entry
+// if the member was still there, so that only one caller gets to remove it.
+var removeScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return false
+end
+local entry = redis.call('HGET', KEYS[2], ARGV[1]) or ''
+redis.call('HDEL', KEYS[2], ARGV[1])
+return entry
+`)
+
+// Done removes an entry returned by TakeDue.
+func (s *RedisStore) Done(ctx context.Context, e Entry) (bool, error) {
+	err := removeScript.Run(ctx, s.client, []string{s.key, s.entries}, e.member).Err()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to remove scheduled request %s: %w", e.ID, err)
+	}
+	return true, nil
+}
+
+// Remove removes the entry of the request with the given ID. Entries
+// scheduled by producers that kept them in the sorted set aren't found, and
+// are only removed with Done once they are due.
+func (s *RedisStore) Remove(ctx context.Context, id string) (*Entry, error) {
+	data, err := removeScript.Run(ctx, s.client, []string{s.key, s.entries}, id).Text()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to remove scheduled request %s: %w", id, err)
+	}
+	e := &Entry{}
+	if err := json.Unmarshal([]byte(data), e); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal scheduled request %s: %w", id, err)
+	}
+	return e, nil
+}
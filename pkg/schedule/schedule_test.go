@@ -0,0 +1,228 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"knative.dev/async-component/pkg/priority"
+)
+
+func TestFromHeaders(t *testing.T) {
+	now := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		header    http.Header
+		want      time.Time
+		scheduled bool
+		wantErr   bool
+	}{{
+		name:   "no headers",
+		header: http.Header{},
+		want:   now,
+	}, {
+		name:      "delay",
+		header:    http.Header{DelayHeader: []string{"90m"}},
+		want:      now.Add(90 * time.Minute),
+		scheduled: true,
+	}, {
+		name:      "not before",
+		header:    http.Header{NotBeforeHeader: []string{"2022-12-02T08:00:00+01:00"}},
+		want:      time.Date(2022, 12, 2, 7, 0, 0, 0, time.UTC),
+		scheduled: true,
+	}, {
+		name:   "not before in the past",
+		header: http.Header{NotBeforeHeader: []string{"2022-11-30T12:00:00Z"}},
+		want:   now,
+	}, {
+		name: "later of both",
+		header: http.Header{
+			NotBeforeHeader: []string{"2022-12-01T13:00:00Z"},
+			DelayHeader:     []string{"2h"},
+		},
+		want:      now.Add(2 * time.Hour),
+		scheduled: true,
+	}, {
+		name:    "invalid not before",
+		header:  http.Header{NotBeforeHeader: []string{"tomorrow"}},
+		wantErr: true,
+	}, {
+		name:    "negative delay",
+		header:  http.Header{DelayHeader: []string{"-1h"}},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, scheduled, err := FromHeaders(test.header, now)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if !got.Equal(test.want) || scheduled != test.scheduled {
+				t.Errorf("got %v, %v, want %v, %v", got, scheduled, test.want, test.scheduled)
+			}
+		})
+	}
+}
+
+func TestStores(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	stores := map[string]Store{
+		"redis":  NewRedisStore(client, "scheduled"),
+		"memory": NewMemoryStore(),
+	}
+	ctx := context.Background()
+	now := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	entries := []Entry{{
+		ID:       "later",
+		Due:      now.Add(time.Hour),
+		Request:  json.RawMessage(`{"id":"later"}`),
+		Priority: priority.Low,
+	}, {
+		ID:      "first",
+		Due:     now.Add(time.Minute),
+		Service: "hello.default.svc.cluster.local",
+		Request: json.RawMessage(`{"id":"first"}`),
+	}, {
+		ID:      "second",
+		Due:     now.Add(2 * time.Minute),
+		Request: json.RawMessage(`{"id":"second"}`),
+	}}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, e := range entries {
+				if err := store.Add(ctx, e); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if got, err := store.TakeDue(ctx, now, 10, time.Minute); err != nil || len(got) != 0 {
+				t.Errorf("got %v, %v, want nothing due", got, err)
+			}
+			taken, err := store.TakeDue(ctx, now.Add(time.Hour), 2, time.Minute)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(entries[1:], taken, cmpopts.IgnoreUnexported(Entry{})); diff != "" {
+				t.Errorf("unexpected entries (-want, +got): %s", diff)
+			}
+			got, err := store.TakeDue(ctx, now.Add(time.Hour), 2, time.Minute)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(entries[:1], got, cmpopts.IgnoreUnexported(Entry{})); diff != "" {
+				t.Errorf("unexpected entries (-want, +got): %s", diff)
+			}
+
+			// Entries that aren't done with are taken again once their
+			// lease has passed.
+			if removed, err := store.Done(ctx, taken[0]); err != nil || !removed {
+				t.Fatalf("got %v, %v, want entry removed", removed, err)
+			}
+			if removed, err := store.Done(ctx, taken[0]); err != nil || removed {
+				t.Errorf("got %v, %v removing again, want nothing removed", removed, err)
+			}
+			got, err = store.TakeDue(ctx, now.Add(time.Hour+time.Minute), 10, time.Minute)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			byID := cmpopts.SortSlices(func(a, b Entry) bool { return a.ID < b.ID })
+			if diff := cmp.Diff([]Entry{entries[0], entries[2]}, got, byID, cmpopts.IgnoreUnexported(Entry{})); diff != "" {
+				t.Errorf("unexpected entries (-want, +got): %s", diff)
+			}
+
+			// Entries are removed by ID whether they were taken or not.
+			removed, err := store.Remove(ctx, "second")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(&entries[2], removed, cmpopts.IgnoreUnexported(Entry{})); diff != "" {
+				t.Errorf("unexpected entry (-want, +got): %s", diff)
+			}
+			for _, id := range []string{"second", "unknown"} {
+				if removed, err := store.Remove(ctx, id); err != nil || removed != nil {
+					t.Errorf("got %v, %v removing %s, want nothing", removed, err, id)
+				}
+			}
+			got, err = store.TakeDue(ctx, now.Add(2*time.Hour), 10, time.Minute)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(entries[:1], got, cmpopts.IgnoreUnexported(Entry{})); diff != "" {
+				t.Errorf("unexpected entries (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestRedisStoreKeepsEntriesApart(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	store := NewRedisStore(client, "scheduled")
+	ctx := context.Background()
+	now := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+
+	e := Entry{ID: "new", Due: now, Request: json.RawMessage(`{"id":"new"}`)}
+	if err := store.Add(ctx, e); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if members, _ := mr.ZMembers("scheduled"); len(members) != 1 || members[0] != "new" {
+		t.Errorf("got members %v, want the ID", members)
+	}
+	if !mr.Exists("{scheduled}:requests") {
+		t.Errorf("want the entry kept in %q", "{scheduled}:requests")
+	}
+
+	// Entries scheduled by older producers are still taken once due.
+	old, _ := json.Marshal(Entry{ID: "old", Due: now, Request: json.RawMessage(`{"id":"old"}`)})
+	mr.ZAdd("scheduled", float64(now.UnixMilli()), string(old))
+	taken, err := store.TakeDue(ctx, now, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ids := []string{}
+	for _, e := range taken {
+		ids = append(ids, e.ID)
+		if removed, err := store.Done(ctx, e); err != nil || !removed {
+			t.Errorf("got %v, %v, want %s removed", removed, err, e.ID)
+		}
+	}
+	if diff := cmp.Diff([]string{"new", "old"}, ids, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("unexpected entries (-want, +got): %s", diff)
+	}
+	if mr.Exists("scheduled") || mr.Exists("{scheduled}:requests") {
+		t.Errorf("want all entries removed, got keys %v", mr.Keys())
+	}
+}
+
+func TestEntriesKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"async-scheduled":     "{async-scheduled}:requests",
+		"{async}:scheduled":   "{async}:scheduled:requests",
+		"async-{unclosed":     "{async-{unclosed}:requests",
+		"tenant-{a}:schedule": "tenant-{a}:schedule:requests",
+	} {
+		if got := entriesKey(key); got != want {
+			t.Errorf("entriesKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package spill buffers queued requests on local disk while the queue can't
+// be written to.
+package spill
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"knative.dev/async-component/pkg/priority"
+	"knative.dev/async-component/pkg/queue"
+)
+
+const (
+	// segmentSize is the size past which a new segment is started, so that
+	// replayed entries can be removed from disk before all of them are.
+	segmentSize = 1 << 20
+	segmentExt  = ".log"
+	offsetFile  = "offset"
+)
+
+// ErrFull is returned by Add when an entry would take the buffer past its
+// size limit.
+var ErrFull = errors.New("spill buffer is full")
+
+// Entry is a message kept in the buffer.
+type Entry struct {
+	ID       string            `json:"id"`
+	Data     []byte            `json:"data"`
+	Service  string            `json:"service,omitempty"`
+	Priority priority.Priority `json:"priority,omitempty"`
+	// Added is when the entry was added to the buffer.
+	Added time.Time `json:"added"`
+}
+
+// Message returns the queue message of the entry.
+func (e Entry) Message() queue.Message {
+	return queue.Message{ID: e.ID, Data: e.Data, Service: e.Service, Priority: e.Priority}
+}
+
+// Buffer is a write-ahead log of entries in a directory, such as an emptyDir
+// volume. Entries are appended to numbered segment files, and replayed in the
+// order they were added by a single caller of Replay, which records how far it
+// got in a file next to them. Segments are removed once they are replayed, and
+// entries that weren't replayed yet survive a restart.
+type Buffer struct {
+	dir      string
+	maxBytes int64
+
+	mu sync.Mutex
+	// segments are the numbers of the segment files, oldest first, and size
+	// their total size. written is the size of the newest segment, and read
+	// how much of the oldest one was replayed. Segments are numbered on from
+	// next, never reusing a number a stale offset could refer to.
+	segments []int64
+	next     int64
+	size     int64
+	written  int64
+	read     int64
+	count    int
+}
+
+// Open opens the buffer in dir, creating it if needed. Entries are only added
+// while the segments take up to maxBytes, or without limit if it is zero.
+func Open(dir string, maxBytes int64) (*Buffer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spill directory: %w", err)
+	}
+	b := &Buffer{dir: dir, maxBytes: maxBytes}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list spill directory: %w", err)
+	}
+	for _, file := range files {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), segmentExt), 10, 64)
+		if err != nil || !strings.HasSuffix(file.Name(), segmentExt) || file.IsDir() {
+			continue
+		}
+		b.segments = append(b.segments, seq)
+	}
+	sort.Slice(b.segments, func(i, j int) bool { return b.segments[i] < b.segments[j] })
+
+	seq, offset, err := b.readOffset()
+	if err != nil {
+		return nil, err
+	}
+	b.next = seq + 1
+	if len(b.segments) > 0 && b.segments[len(b.segments)-1] >= b.next {
+		b.next = b.segments[len(b.segments)-1] + 1
+	}
+	for i, s := range b.segments {
+		n, size, err := b.scan(s, i == len(b.segments)-1)
+		if err != nil {
+			return nil, err
+		}
+		b.count += n
+		b.size += size
+		b.written = size
+	}
+	if len(b.segments) > 0 && b.segments[0] == seq {
+		// Only complete entries are skipped.
+		n, _, err := b.countLines(b.segments[0], offset)
+		if err != nil {
+			return nil, err
+		}
+		b.count -= n
+		b.read = offset
+	}
+	return b, nil
+}
+
+// scan returns the number of entries and the size of a segment. A partial
+// entry left at the end of the newest one by a crash is cut off.
+func (b *Buffer) scan(seq int64, newest bool) (int, int64, error) {
+	n, size, err := b.countLines(seq, -1)
+	if err != nil {
+		return 0, 0, err
+	}
+	info, err := os.Stat(b.segmentPath(seq))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read spill segment: %w", err)
+	}
+	if newest && info.Size() != size {
+		if err := os.Truncate(b.segmentPath(seq), size); err != nil {
+			return 0, 0, fmt.Errorf("failed to repair spill segment: %w", err)
+		}
+	}
+	return n, size, nil
+}
+
+// countLines counts the complete lines of a segment up to limit bytes, or all
+// of them if limit is negative, and returns their size.
+func (b *Buffer) countLines(seq int64, limit int64) (int, int64, error) {
+	file, err := os.Open(b.segmentPath(seq))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read spill segment: %w", err)
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if limit >= 0 {
+		r = io.LimitReader(file, limit)
+	}
+	reader := bufio.NewReader(r)
+	n, size := 0, int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return n, size, nil
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("failed to read spill segment: %w", err)
+		}
+		n++
+		size += int64(len(line))
+	}
+}
+
+// Add appends the entry to the newest segment and syncs it to disk.
+func (b *Buffer) Add(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %q: %w", e.ID, err)
+	}
+	line = append(line, '\n')
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.maxBytes > 0 && b.size+int64(len(line)) > b.maxBytes {
+		return ErrFull
+	}
+	if len(b.segments) == 0 || b.written >= segmentSize {
+		b.segments = append(b.segments, b.next)
+		b.next++
+		b.written = 0
+	}
+	file, err := os.OpenFile(b.segmentPath(b.segments[len(b.segments)-1]), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to spill %q: %w", e.ID, err)
+	}
+	defer file.Close()
+	if _, err := file.Write(line); err != nil {
+		return fmt.Errorf("failed to spill %q: %w", e.ID, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to spill %q: %w", e.ID, err)
+	}
+	b.written += int64(len(line))
+	b.size += int64(len(line))
+	b.count++
+	return nil
+}
+
+// Len returns the number of entries that weren't replayed yet.
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.count
+}
+
+// Size returns the size of the segments on disk.
+func (b *Buffer) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Replay calls handler for the entries in the order they were added, until it
+// fails for one of them or none are left. Entries the handler succeeded on are
+// removed, and the number of them is returned with the error of the handler.
+// Entries that can't be read are skipped.
+func (b *Buffer) Replay(ctx context.Context, handler func(ctx context.Context, e Entry) error) (int, error) {
+	replayed := 0
+	for {
+		b.mu.Lock()
+		if len(b.segments) == 0 {
+			b.mu.Unlock()
+			return replayed, nil
+		}
+		seq, offset := b.segments[0], b.read
+		// Entries added to the newest segment meanwhile are read next time.
+		end := int64(-1)
+		if len(b.segments) == 1 {
+			end = b.written
+		}
+		b.mu.Unlock()
+
+		n, err := b.replaySegment(ctx, seq, offset, end, handler)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+		if err := b.removeIfReplayed(seq); err != nil {
+			return replayed, err
+		}
+		b.mu.Lock()
+		done := len(b.segments) == 0 || b.segments[0] == seq
+		b.mu.Unlock()
+		if done {
+			return replayed, nil
+		}
+	}
+}
+
+// replaySegment hands the entries of a segment after offset, and before end
+// unless it is negative, to handler.
+func (b *Buffer) replaySegment(ctx context.Context, seq, offset, end int64, handler func(ctx context.Context, e Entry) error) (int, error) {
+	file, err := os.Open(b.segmentPath(seq))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read spill segment: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek spill segment: %w", err)
+	}
+	var r io.Reader = file
+	if end >= 0 {
+		r = io.LimitReader(file, end-offset)
+	}
+	reader := bufio.NewReader(r)
+	replayed := 0
+	for ctx.Err() == nil {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return replayed, nil
+		} else if err != nil {
+			return replayed, fmt.Errorf("failed to read spill segment: %w", err)
+		}
+		entry := Entry{}
+		if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+			log.Println("Error unmarshalling spilled entry ", err)
+		} else if err := handler(ctx, entry); err != nil {
+			return replayed, err
+		} else {
+			replayed++
+		}
+		if err := b.advance(seq, int64(len(line))); err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, ctx.Err()
+}
+
+// advance records that an entry of n bytes of the oldest segment was replayed.
+func (b *Buffer) advance(seq, n int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.read += n
+	b.count--
+	return b.writeOffset(seq, b.read)
+}
+
+// removeIfReplayed removes the oldest segment if all of it was replayed. The
+// newest segment is only removed if nothing was added to it meanwhile, and
+// the next entry then starts a new one.
+func (b *Buffer) removeIfReplayed(seq int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.segments) == 0 || b.segments[0] != seq {
+		return nil
+	}
+	info, err := os.Stat(b.segmentPath(seq))
+	if err != nil {
+		return fmt.Errorf("failed to read spill segment: %w", err)
+	}
+	if b.read < info.Size() {
+		return nil
+	}
+	if err := os.Remove(b.segmentPath(seq)); err != nil {
+		return fmt.Errorf("failed to remove spill segment: %w", err)
+	}
+	b.segments = b.segments[1:]
+	b.size -= info.Size()
+	b.read = 0
+	if len(b.segments) == 0 {
+		b.written = 0
+		return b.writeOffset(b.next, 0)
+	}
+	return b.writeOffset(b.segments[0], 0)
+}
+
+func (b *Buffer) segmentPath(seq int64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// readOffset returns the segment and position replaying got to.
+func (b *Buffer) readOffset() (int64, int64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(b.dir, offsetFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, fmt.Errorf("failed to read spill offset: %w", err)
+	}
+	var seq, offset int64
+	if _, err := fmt.Sscan(string(content), &seq, &offset); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse spill offset: %w", err)
+	}
+	return seq, offset, nil
+}
+
+// writeOffset records the segment and position replaying got to, replacing
+// the previous one atomically.
+func (b *Buffer) writeOffset(seq, offset int64) error {
+	path := filepath.Join(b.dir, offsetFile)
+	if err := ioutil.WriteFile(path+".tmp", []byte(fmt.Sprintf("%d %d", seq, offset)), 0o600); err != nil {
+		return fmt.Errorf("failed to write spill offset: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write spill offset: %w", err)
+	}
+	return nil
+}
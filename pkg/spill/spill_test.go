@@ -0,0 +1,254 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var added = time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+
+func entries(n int, size int) []Entry {
+	all := make([]Entry, 0, n)
+	for i := 0; i < n; i++ {
+		all = append(all, Entry{
+			ID:      fmt.Sprint(i),
+			Data:    []byte(strings.Repeat("x", size)),
+			Service: "hello.default.example.com",
+			Added:   added,
+		})
+	}
+	return all
+}
+
+// replayAll replays the buffer, collecting the entries and failing from the
+// failAt-th one on, if it isn't negative.
+func replayAll(t *testing.T, b *Buffer, failAt int) ([]Entry, error) {
+	t.Helper()
+	got := make([]Entry, 0)
+	n, err := b.Replay(context.Background(), func(ctx context.Context, e Entry) error {
+		if failAt >= 0 && len(got) == failAt {
+			return errors.New("queue down")
+		}
+		got = append(got, e)
+		return nil
+	})
+	if n != len(got) {
+		t.Errorf("Replay() = %d, want %d", n, len(got))
+	}
+	return got, err
+}
+
+func TestBuffer(t *testing.T) {
+	dir := t.TempDir()
+	b, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := entries(5, 10)
+	for _, e := range want {
+		if err := b.Add(e); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	if b.Len() != 5 {
+		t.Errorf("Len() = %d, want 5", b.Len())
+	}
+
+	// Replaying stops at the first entry the handler fails on.
+	got, err := replayAll(t, b, 2)
+	if err == nil {
+		t.Error("Replay() succeeded with a failing handler")
+	}
+	if diff := cmp.Diff(want[:2], got); diff != "" {
+		t.Errorf("unexpected entries (-want, +got): %s", diff)
+	}
+	if b.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", b.Len())
+	}
+
+	// Entries that weren't replayed survive a restart, in order.
+	b, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 3 {
+		t.Errorf("Len() after reopening = %d, want 3", b.Len())
+	}
+	more := entries(1, 10)
+	more[0].ID = "5"
+	if err := b.Add(more[0]); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	got, err = replayAll(t, b, -1)
+	if err != nil {
+		t.Errorf("Replay() error = %v", err)
+	}
+	if diff := cmp.Diff(append(want[2:], more...), got); diff != "" {
+		t.Errorf("unexpected entries (-want, +got): %s", diff)
+	}
+	if b.Len() != 0 || b.Size() != 0 {
+		t.Errorf("Len(), Size() = %d, %d, want 0, 0", b.Len(), b.Size())
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segments) != 0 {
+		t.Errorf("segments left after replaying: %v", segments)
+	}
+
+	// Nothing is replayed twice after a restart.
+	b, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(want[0]); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	b, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = replayAll(t, b, -1)
+	if diff := cmp.Diff(want[:1], got); diff != "" {
+		t.Errorf("unexpected entries (-want, +got): %s", diff)
+	}
+}
+
+// ids returns the IDs of the entries, which are cheaper to compare than
+// entries with large data.
+func ids(all []Entry) []string {
+	ids := make([]string, 0, len(all))
+	for _, e := range all {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestBufferSegments(t *testing.T) {
+	dir := t.TempDir()
+	b, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := entries(5, segmentSize/2)
+	for _, e := range want {
+		if err := b.Add(e); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segments) != 3 {
+		t.Errorf("got %d segments, want 3", len(segments))
+	}
+
+	// Segments are removed once they are replayed.
+	got, _ := replayAll(t, b, 3)
+	if diff := cmp.Diff(ids(want[:3]), ids(got)); diff != "" {
+		t.Errorf("unexpected entries (-want, +got): %s", diff)
+	}
+	segments, _ = filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segments) != 2 {
+		t.Errorf("got %d segments after replaying, want 2", len(segments))
+	}
+
+	b, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = replayAll(t, b, -1)
+	if err != nil {
+		t.Errorf("Replay() error = %v", err)
+	}
+	if diff := cmp.Diff(ids(want[3:]), ids(got)); diff != "" {
+		t.Errorf("unexpected entries (-want, +got): %s", diff)
+	}
+}
+
+func TestBufferFull(t *testing.T) {
+	b, err := Open(t.TempDir(), 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := entries(3, 50)
+	for i, e := range all {
+		err := b.Add(e)
+		if i < 2 && err != nil {
+			t.Errorf("Add() error = %v", err)
+		} else if i == 2 && !errors.Is(err, ErrFull) {
+			t.Errorf("Add() error = %v, want %v", err, ErrFull)
+		}
+	}
+
+	// Replaying makes room again.
+	if _, err := replayAll(t, b, -1); err != nil {
+		t.Errorf("Replay() error = %v", err)
+	}
+	if err := b.Add(all[2]); err != nil {
+		t.Errorf("Add() after replaying error = %v", err)
+	}
+}
+
+func TestBufferPartialEntry(t *testing.T) {
+	dir := t.TempDir()
+	b, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := entries(2, 10)
+	for _, e := range want {
+		if err := b.Add(e); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	// A crash while adding an entry leaves part of it behind.
+	file, err := os.OpenFile(b.segmentPath(b.segments[0]), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"id":"2","da`)
+	file.Close()
+
+	b, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", b.Len())
+	}
+	more := entries(1, 10)
+	more[0].ID = "3"
+	if err := b.Add(more[0]); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	got, err := replayAll(t, b, -1)
+	if err != nil {
+		t.Errorf("Replay() error = %v", err)
+	}
+	if diff := cmp.Diff(append(want, more...), got); diff != "" {
+		t.Errorf("unexpected entries (-want, +got): %s", diff)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(dir, offsetFile))
+	if len(content) == 0 {
+		t.Error("offset wasn't recorded")
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps request status in memory. It is meant for tests and
+// single process setups, and never expires anything.
+type MemoryStore struct {
+	mu       sync.Mutex
+	statuses map[string]Status
+	results  map[string]Result
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		statuses: make(map[string]Status),
+		results:  make(map[string]Result),
+	}
+}
+
+// Get returns the status of the request with the given ID.
+func (s *MemoryStore) Get(ctx context.Context, id string) (*Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.statuses[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &st, nil
+}
+
+// Set records the state of the request with the given ID.
+func (s *MemoryStore) Set(ctx context.Context, id string, state State, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.statuses[id]
+	s.statuses[id] = Status{
+		ID:       id,
+		State:    state,
+		Updated:  now().UTC(),
+		Reason:   reason,
+		Service:  st.Service,
+		Ref:      st.Ref,
+		Reserved: st.Reserved,
+	}
+	return nil
+}
+
+// Transition records state for a request only if it is currently in one of
+// the from states.
+func (s *MemoryStore) Transition(ctx context.Context, id string, from []State, to State, reason string) (*Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.statuses[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	for _, state := range from {
+		if st.State == state {
+			s.statuses[id] = Status{
+				ID:       id,
+				State:    to,
+				Updated:  now().UTC(),
+				Reason:   reason,
+				Service:  st.Service,
+				Ref:      st.Ref,
+				Reserved: st.Reserved,
+			}
+			return &st, nil
+		}
+	}
+	return &st, ErrConflict
+}
+
+// SetRef records where the request with the given ID was queued.
+func (s *MemoryStore) SetRef(ctx context.Context, id, service, ref string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.statuses[id]
+	if !ok {
+		return nil
+	}
+	st.Service, st.Ref = service, ref
+	s.statuses[id] = st
+	return nil
+}
+
+// SetReserved records that the request with the given ID counts towards the
+// depth of its queue.
+func (s *MemoryStore) SetReserved(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.statuses[id]
+	if !ok {
+		return nil
+	}
+	st.Reserved = true
+	s.statuses[id] = st
+	return nil
+}
+
+// Unreserve clears the record of SetReserved.
+func (s *MemoryStore) Unreserve(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.statuses[id]
+	if !ok || !st.Reserved {
+		return false, nil
+	}
+	st.Reserved = false
+	s.statuses[id] = st
+	return true, nil
+}
+
+// GetResult returns the recorded result of the request with the given ID.
+func (s *MemoryStore) GetResult(ctx context.Context, id string) (*Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := s.results[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &result, nil
+}
+
+// SetResult records the result of the request with the given ID.
+func (s *MemoryStore) SetResult(ctx context.Context, id string, result *Result, _ time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[id] = *result
+	return nil
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package status tracks the lifecycle of asynchronous requests so the producer
+// can report on work that the consumer has picked up.
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// State is the processing state of an asynchronous request.
+type State string
+
+const (
+	// Scheduled requests are held back until they are due.
+	Scheduled State = "scheduled"
+	// Queued requests have been written to the queue but not yet picked up.
+	Queued State = "queued"
+	// InFlight requests are currently being sent to the target service.
+	InFlight State = "in-flight"
+	// Succeeded requests got a successful response from the target service.
+	Succeeded State = "succeeded"
+	// Failed requests could not be delivered or got an error response.
+	Failed State = "failed"
+	// Expired requests were dropped before they could be delivered.
+	Expired State = "expired"
+	// Cancelled requests were withdrawn before they were picked up.
+	Cancelled State = "cancelled"
+)
+
+const (
+	stateField    = "state"
+	updatedField  = "updated"
+	reasonField   = "reason"
+	serviceField  = "service"
+	refField      = "ref"
+	reservedField = "reserved"
+)
+
+const resultSuffix = ":result"
+
+// ErrNotFound is returned when no status or result is recorded for a request ID.
+var ErrNotFound = errors.New("request not found")
+
+// ErrConflict is returned by Transition when a request is not in any of the
+// states it may move on from.
+var ErrConflict = errors.New("request is in another state")
+
+// Status is the recorded state of a single asynchronous request.
+type Status struct {
+	ID      string    `json:"id"`
+	State   State     `json:"state"`
+	Updated time.Time `json:"updated"`
+	Reason  string    `json:"reason,omitempty"`
+	// Service and Ref say where a queued request was written to, so that it
+	// can be taken back if it is cancelled. They are only known once the
+	// request is on the queue, and only to backends that hand out refs.
+	Service string `json:"-"`
+	Ref     string `json:"-"`
+	// Reserved is set while the request counts towards the depth of its
+	// service's queue, until whoever takes it off clears it with Unreserve.
+	Reserved bool `json:"-"`
+}
+
+// Result is the response of the target service to a completed request.
+type Result struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+	// Truncated is set when the body was cut to the configured size limit.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Store reads and writes request status and results.
+type Store interface {
+	Get(ctx context.Context, id string) (*Status, error)
+	Set(ctx context.Context, id string, state State, reason string) error
+	// Transition records state for a request only if it is currently in one
+	// of the from states, and returns the status it had before. Requests in
+	// any other state are left alone and ErrConflict is returned along with
+	// their status.
+	Transition(ctx context.Context, id string, from []State, to State, reason string) (*Status, error)
+	// SetRef records where a request was queued. Requests without a status
+	// are left alone.
+	SetRef(ctx context.Context, id, service, ref string) error
+	// SetReserved records that a request counts towards the depth of its
+	// service's queue. Requests without a status are left alone.
+	SetReserved(ctx context.Context, id string) error
+	// Unreserve clears the record of SetReserved, and reports whether it was
+	// there. Only one of concurrent callers gets true.
+	Unreserve(ctx context.Context, id string) (bool, error)
+	GetResult(ctx context.Context, id string) (*Result, error)
+	SetResult(ctx context.Context, id string, result *Result, ttl time.Duration) error
+}
+
+// RedisStore keeps each request status in a Redis hash that expires after ttl.
+type RedisStore struct {
+	client redis.Cmdable
+	prefix string
+	ttl    time.Duration
+}
+
+var now = time.Now
+
+// NewRedisStore creates a Store that keeps status under keys starting with prefix.
+// A ttl of zero keeps status records forever.
+func NewRedisStore(client redis.Cmdable, prefix string, ttl time.Duration) *RedisStore {
+	return &RedisStore{
+		client: client,
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
+
+func (s *RedisStore) key(id string) string {
+	return s.prefix + id
+}
+
+// Get returns the status of the request with the given ID.
+func (s *RedisStore) Get(ctx context.Context, id string) (*Status, error) {
+	values, err := s.client.HGetAll(ctx, s.key(id)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read status of %q: %w", id, err)
+	}
+	if len(values) == 0 {
+		return nil, ErrNotFound
+	}
+	st := &Status{
+		ID:     id,
+		State:  State(values[stateField]),
+		Reason: values[reasonField],
+		// The service and ref are kept as they were recorded.
+		Service:  values[serviceField],
+		Ref:      values[refField],
+		Reserved: values[reservedField] != "",
+	}
+	if updated, err := time.Parse(time.RFC3339Nano, values[updatedField]); err == nil {
+		st.Updated = updated
+	}
+	return st, nil
+}
+
+// Set records the state of the request with the given ID.
+func (s *RedisStore) Set(ctx context.Context, id string, state State, reason string) error {
+	key := s.key(id)
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			stateField, string(state),
+			updatedField, now().UTC().Format(time.RFC3339Nano),
+			reasonField, reason,
+		)
+		if s.ttl > 0 {
+			pipe.Expire(ctx, key, s.ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record status of %q: %w", id, err)
+	}
+	return nil
+}
+
+// transitionScript changes the state of a request only if it is in one of
+// the states given after the new fields, so that concurrent producers and
+// consumers can't overwrite each other's decisions.
+var transitionScript = redis.NewScript(`
+local current = redis.call('HMGET', KEYS[1], 'state', 'updated', 'reason', 'reserved')
+if not current[1] then
+	return false
+end
+local previous = {current[1], current[2] or '', current[3] or '', current[4] or ''}
+for i = 5, #ARGV do
+	if current[1] == ARGV[i] then
+		redis.call('HSET', KEYS[1], 'state', ARGV[1], 'updated', ARGV[2], 'reason', ARGV[3])
+		if tonumber(ARGV[4]) > 0 then
+			redis.call('PEXPIRE', KEYS[1], ARGV[4])
+		end
+		return {1, previous[1], previous[2], previous[3], previous[4]}
+	end
+end
+return {0, previous[1], previous[2], previous[3], previous[4]}
+`)
+
+// Transition records state for a request only if it is currently in one of
+// the from states.
+func (s *RedisStore) Transition(ctx context.Context, id string, from []State, to State, reason string) (*Status, error) {
+	args := []interface{}{string(to), now().UTC().Format(time.RFC3339Nano), reason, s.ttl.Milliseconds()}
+	for _, state := range from {
+		args = append(args, string(state))
+	}
+	reply, err := transitionScript.Run(ctx, s.client, []string{s.key(id)}, args...).Slice()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to change status of %q: %w", id, err)
+	}
+	if len(reply) != 5 {
+		return nil, fmt.Errorf("failed to change status of %q: unexpected reply %v", id, reply)
+	}
+	changed, _ := reply[0].(int64)
+	state, _ := reply[1].(string)
+	updated, _ := reply[2].(string)
+	st := &Status{ID: id, State: State(state)}
+	st.Reason, _ = reply[3].(string)
+	reserved, _ := reply[4].(string)
+	st.Reserved = reserved != ""
+	if t, err := time.Parse(time.RFC3339Nano, updated); err == nil {
+		st.Updated = t
+	}
+	if changed == 0 {
+		return st, ErrConflict
+	}
+	return st, nil
+}
+
+// refScript records where a request was queued only if it still has a
+// status, so that a late write doesn't leave a record without one behind.
+var refScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'service', ARGV[1], 'ref', ARGV[2])
+return 1
+`)
+
+// SetRef records where the request with the given ID was queued.
+func (s *RedisStore) SetRef(ctx context.Context, id, service, ref string) error {
+	if err := refScript.Run(ctx, s.client, []string{s.key(id)}, service, ref).Err(); err != nil {
+		return fmt.Errorf("failed to record queue ref of %q: %w", id, err)
+	}
+	return nil
+}
+
+// reservedScript records that a request counts towards the depth of its
+// queue only if it still has a status, like refScript.
+var reservedScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'reserved', '1')
+return 1
+`)
+
+// SetReserved records that the request with the given ID counts towards the
+// depth of its queue.
+func (s *RedisStore) SetReserved(ctx context.Context, id string) error {
+	if err := reservedScript.Run(ctx, s.client, []string{s.key(id)}).Err(); err != nil {
+		return fmt.Errorf("failed to record reservation of %q: %w", id, err)
+	}
+	return nil
+}
+
+// Unreserve clears the record of SetReserved. Deleting the field tells the
+// one caller that removed it.
+func (s *RedisStore) Unreserve(ctx context.Context, id string) (bool, error) {
+	removed, err := s.client.HDel(ctx, s.key(id), reservedField).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to clear reservation of %q: %w", id, err)
+	}
+	return removed > 0, nil
+}
+
+// GetResult returns the recorded result of the request with the given ID.
+func (s *RedisStore) GetResult(ctx context.Context, id string) (*Result, error) {
+	b, err := s.client.Get(ctx, s.key(id)+resultSuffix).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read result of %q: %w", id, err)
+	}
+	result := &Result{}
+	if err := json.Unmarshal(b, result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal result of %q: %w", id, err)
+	}
+	return result, nil
+}
+
+// SetResult records the result of the request with the given ID, which is kept
+// for ttl. A ttl of zero keeps the result forever.
+func (s *RedisStore) SetResult(ctx context.Context, id string, result *Result, ttl time.Duration) error {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to marshal result of %q: %w", id, err)
+	}
+	if err := s.client.Set(ctx, s.key(id)+resultSuffix, b, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to record result of %q: %w", id, err)
+	}
+	return nil
+}
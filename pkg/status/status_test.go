@@ -0,0 +1,241 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRedisStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	store := NewRedisStore(client, "status:", time.Hour)
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+
+	tests := []struct {
+		name   string
+		state  State
+		reason string
+	}{{
+		name:  "queued",
+		state: Queued,
+	}, {
+		name:  "in flight",
+		state: InFlight,
+	}, {
+		name:   "failed with reason",
+		state:  Failed,
+		reason: "target responded with status 500",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := store.Set(ctx, "123", test.state, test.reason); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, err := store.Get(ctx, "123")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.ID != "123" || got.State != test.state || got.Reason != test.reason {
+				t.Errorf("got %+v, want state %q with reason %q", got, test.state, test.reason)
+			}
+			if got.Updated.IsZero() {
+				t.Errorf("expected updated time to be set")
+			}
+		})
+	}
+
+	if ttl := mr.TTL("status:123"); ttl != time.Hour {
+		t.Errorf("got ttl %v, want %v", ttl, time.Hour)
+	}
+}
+
+func TestTransition(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+	stores := map[string]Store{
+		"redis":  NewRedisStore(client, "status:", time.Hour),
+		"memory": NewMemoryStore(),
+	}
+	pending := []State{Scheduled, Queued}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.Transition(ctx, "unknown", pending, Cancelled, ""); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v, want %v", err, ErrNotFound)
+			}
+
+			if err := store.Set(ctx, "queued", Queued, ""); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			previous, err := store.Transition(ctx, "queued", pending, Cancelled, "cancelled by user")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if previous.State != Queued {
+				t.Errorf("got previous state %q, want %q", previous.State, Queued)
+			}
+			got, err := store.Get(ctx, "queued")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.State != Cancelled || got.Reason != "cancelled by user" {
+				t.Errorf("got %+v, want state %q", got, Cancelled)
+			}
+
+			if err := store.Set(ctx, "running", InFlight, ""); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			current, err := store.Transition(ctx, "running", pending, Cancelled, "")
+			if !errors.Is(err, ErrConflict) {
+				t.Fatalf("got %v, want %v", err, ErrConflict)
+			}
+			if current.State != InFlight {
+				t.Errorf("got state %q, want %q", current.State, InFlight)
+			}
+			if got, _ := store.Get(ctx, "running"); got.State != InFlight {
+				t.Errorf("got state %q after conflict, want %q", got.State, InFlight)
+			}
+		})
+	}
+	if ttl := mr.TTL("status:queued"); ttl != time.Hour {
+		t.Errorf("got ttl %v, want %v", ttl, time.Hour)
+	}
+}
+
+func TestRedisStoreResult(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	store := NewRedisStore(client, "status:", time.Hour)
+	ctx := context.Background()
+
+	if _, err := store.GetResult(ctx, "123"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+
+	want := &Result{
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       []byte(`{"created":true}`),
+	}
+	if err := store.SetResult(ctx, "123", want, time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := store.GetResult(ctx, "123")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected result (-want, +got): %s", diff)
+	}
+	if ttl := mr.TTL("status:123:result"); ttl != time.Minute {
+		t.Errorf("got ttl %v, want %v", ttl, time.Minute)
+	}
+}
+
+func TestSetRef(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+	stores := map[string]Store{
+		"redis":  NewRedisStore(client, "status:", time.Hour),
+		"memory": NewMemoryStore(),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			if err := store.SetRef(ctx, "unknown", "svc", "ref"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := store.Get(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v, want %v", err, ErrNotFound)
+			}
+
+			if err := store.Set(ctx, "queued", Queued, ""); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := store.SetRef(ctx, "queued", "svc", "ref"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := store.Transition(ctx, "queued", []State{Queued}, Cancelled, ""); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, err := store.Get(ctx, "queued")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.State != Cancelled || got.Service != "svc" || got.Ref != "ref" {
+				t.Errorf("got %+v, want state %q with service %q and ref %q", got, Cancelled, "svc", "ref")
+			}
+		})
+	}
+}
+
+func TestReserved(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+	stores := map[string]Store{
+		"redis":  NewRedisStore(client, "status:", time.Hour),
+		"memory": NewMemoryStore(),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			if err := store.SetReserved(ctx, "unknown"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := store.Get(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v, want %v", err, ErrNotFound)
+			}
+
+			if err := store.Set(ctx, "queued", Queued, ""); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := store.SetReserved(ctx, "queued"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			previous, err := store.Transition(ctx, "queued", []State{Queued}, InFlight, "")
+			if err != nil || !previous.Reserved {
+				t.Fatalf("got %+v, %v, want it reserved", previous, err)
+			}
+			if err := store.Set(ctx, "queued", Succeeded, ""); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got, err := store.Get(ctx, "queued"); err != nil || !got.Reserved {
+				t.Errorf("got %+v, %v, want it still reserved", got, err)
+			}
+
+			// Only the first caller takes the reservation off.
+			for i, want := range []bool{true, false} {
+				if got, err := store.Unreserve(ctx, "queued"); err != nil || got != want {
+					t.Errorf("got %v, %v unreserving %d times, want %v", got, err, i+1, want)
+				}
+			}
+			if got, err := store.Get(ctx, "queued"); err != nil || got.Reserved {
+				t.Errorf("got %+v, %v, want it no longer reserved", got, err)
+			}
+		})
+	}
+}